@@ -0,0 +1,302 @@
+package connmgr
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	_defaultGracePeriod          = 10 * time.Second
+	_defaultMaxInboundHandshakes = 64
+)
+
+// Manager keeps track of the open connections of a node. When the number of
+// connections grows above the high watermark, the least valuable connections
+// are closed until the low watermark is reached. The value of a connection is
+// the sum of the tags of the peer it is connected to. Connections to
+// protected peers and connections younger than the grace period are never
+// closed by the manager.
+type Manager struct {
+	lowWater    int
+	highWater   int
+	gracePeriod time.Duration
+	handshakes  chan struct{}
+
+	lock      *sync.Mutex
+	conns     map[*ConnInfo]struct{}
+	tags      map[string]map[string]int
+	protected map[string]map[string]struct{}
+
+	// trimming is set while connections are trimmed, and trimDone is
+	// signaled when it is cleared.
+	trimming bool
+	trimDone *sync.Cond
+}
+
+// ConnInfo is the information the manager has about a tracked connection.
+type ConnInfo struct {
+	closer   io.Closer
+	peerID   string
+	protocol string
+	inbound  bool
+	opened   time.Time
+	manager  *Manager
+}
+
+type Option func(*Manager)
+
+func WithGracePeriod(d time.Duration) Option {
+	return func(m *Manager) {
+		m.gracePeriod = d
+	}
+}
+
+// WithMaxInboundHandshakes sets the maximum number of concurrent inbound
+// handshakes. Values below 1 are treated as 1.
+func WithMaxInboundHandshakes(num int) Option {
+	return func(m *Manager) {
+		m.handshakes = make(chan struct{}, max(num, 1))
+	}
+}
+
+func New(lowWater, highWater int, opts ...Option) *Manager {
+	lock := &sync.Mutex{}
+	m := &Manager{
+		lowWater:    lowWater,
+		highWater:   highWater,
+		gracePeriod: _defaultGracePeriod,
+		handshakes:  make(chan struct{}, _defaultMaxInboundHandshakes),
+		lock:        lock,
+		conns:       make(map[*ConnInfo]struct{}),
+		tags:        make(map[string]map[string]int),
+		protected:   make(map[string]map[string]struct{}),
+		trimDone:    sync.NewCond(lock),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// TrackConn starts tracking a connection to the peer with the given ID. The
+// connection is closed with c if it is trimmed. If the number of connections
+// is larger than the high watermark after adding the connection, the
+// connections are trimmed in the background unless they are already being
+// trimmed.
+func (m *Manager) TrackConn(c io.Closer, peerID []byte, inbound bool) *ConnInfo {
+	info := &ConnInfo{
+		closer:  c,
+		peerID:  string(peerID),
+		inbound: inbound,
+		opened:  time.Now(),
+		manager: m,
+	}
+
+	m.lock.Lock()
+	m.conns[info] = struct{}{}
+	shouldTrim := len(m.conns) > m.highWater && !m.trimming
+	m.lock.Unlock()
+
+	if shouldTrim {
+		go m.TrimConns()
+	}
+	return info
+}
+
+// UntrackConn stops tracking the connection. It does not close it.
+func (m *Manager) UntrackConn(info *ConnInfo) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.conns, info)
+}
+
+// SetProtocol sets the protocol used by the connection.
+func (info *ConnInfo) SetProtocol(protoID string) {
+	info.manager.lock.Lock()
+	defer info.manager.lock.Unlock()
+	info.protocol = protoID
+}
+
+func (info *ConnInfo) Protocol() string {
+	info.manager.lock.Lock()
+	defer info.manager.lock.Unlock()
+	return info.protocol
+}
+
+func (info *ConnInfo) PeerID() []byte {
+	return []byte(info.peerID)
+}
+
+func (info *ConnInfo) Inbound() bool {
+	return info.inbound
+}
+
+func (m *Manager) NumConns() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.conns)
+}
+
+func (m *Manager) NumConnsToPeer(peerID []byte) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	num := 0
+	for info := range m.conns {
+		if info.peerID == string(peerID) {
+			num++
+		}
+	}
+	return num
+}
+
+func (m *Manager) NumConnsUsingProtocol(protoID string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	num := 0
+	for info := range m.conns {
+		if info.protocol == protoID {
+			num++
+		}
+	}
+	return num
+}
+
+// TagPeer sets the value of a tag on a peer. The value of a peer is the sum
+// of all its tags.
+func (m *Manager) TagPeer(peerID []byte, tag string, value int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.tags[string(peerID)]; !ok {
+		m.tags[string(peerID)] = make(map[string]int)
+	}
+	m.tags[string(peerID)][tag] = value
+}
+
+func (m *Manager) UntagPeer(peerID []byte, tag string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.tags[string(peerID)], tag)
+	if len(m.tags[string(peerID)]) == 0 {
+		delete(m.tags, string(peerID))
+	}
+}
+
+// Protect prevents the connections to a peer from being trimmed until all
+// tags used to protect it are removed with Unprotect.
+func (m *Manager) Protect(peerID []byte, tag string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.protected[string(peerID)]; !ok {
+		m.protected[string(peerID)] = make(map[string]struct{})
+	}
+	m.protected[string(peerID)][tag] = struct{}{}
+}
+
+// Unprotect removes a protection tag from a peer and reports whether the peer
+// is still protected.
+func (m *Manager) Unprotect(peerID []byte, tag string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.protected[string(peerID)], tag)
+	if len(m.protected[string(peerID)]) == 0 {
+		delete(m.protected, string(peerID))
+		return false
+	}
+	return true
+}
+
+func (m *Manager) IsProtected(peerID []byte) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.protected[string(peerID)]
+	return ok
+}
+
+// TrimConns closes the least valuable connections until the number of
+// connections is at the low watermark or only connections that can not be
+// trimmed are left. Only one trim runs at the time, so TrimConns waits for a
+// trim in progress before it starts.
+func (m *Manager) TrimConns() {
+	m.lock.Lock()
+	for m.trimming {
+		m.trimDone.Wait()
+	}
+	m.trimming = true
+	toTrim := m.connsToTrim()
+	for _, info := range toTrim {
+		delete(m.conns, info)
+	}
+	m.lock.Unlock()
+
+	for _, info := range toTrim {
+		info.closer.Close()
+	}
+
+	m.lock.Lock()
+	m.trimming = false
+	m.trimDone.Broadcast()
+	m.lock.Unlock()
+}
+
+// connsToTrim must be called with the lock held.
+func (m *Manager) connsToTrim() []*ConnInfo {
+	numToTrim := len(m.conns) - m.lowWater
+	if numToTrim <= 0 {
+		return nil
+	}
+
+	candidates := make([]*ConnInfo, 0, len(m.conns))
+	for info := range m.conns {
+		if _, ok := m.protected[info.peerID]; ok {
+			continue
+		}
+		if time.Since(info.opened) < m.gracePeriod {
+			continue
+		}
+		candidates = append(candidates, info)
+	}
+
+	slices.SortFunc(candidates, func(a, b *ConnInfo) int {
+		if valueA, valueB := m.peerValue(a.peerID), m.peerValue(b.peerID); valueA != valueB {
+			return valueA - valueB
+		}
+		return a.opened.Compare(b.opened)
+	})
+
+	return candidates[:min(numToTrim, len(candidates))]
+}
+
+// peerValue must be called with the lock held.
+func (m *Manager) peerValue(peerID string) int {
+	value := 0
+	for _, v := range m.tags[peerID] {
+		value += v
+	}
+	return value
+}
+
+// AcquireHandshake blocks until there are less than the maximum number of
+// concurrent inbound handshakes in progress or ctx is done. ReleaseHandshake
+// must be called when the handshake is done.
+func (m *Manager) AcquireHandshake(ctx context.Context) error {
+	select {
+	case m.handshakes <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) ReleaseHandshake() {
+	<-m.handshakes
+}
@@ -0,0 +1,106 @@
+package connmgr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockedCloser struct {
+	isClosed bool
+}
+
+func (c *mockedCloser) Close() error {
+	c.isClosed = true
+	return nil
+}
+
+func TestTrimConns(t *testing.T) {
+	m := New(2, 4, WithGracePeriod(0))
+
+	valuable := &mockedCloser{}
+	m.TrackConn(valuable, []byte("valuable"), true)
+	m.TagPeer([]byte("valuable"), "dht", 10)
+
+	protected := &mockedCloser{}
+	m.TrackConn(protected, []byte("protected"), false)
+	m.Protect([]byte("protected"), "dht")
+
+	others := make([]*mockedCloser, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		c := &mockedCloser{}
+		m.TrackConn(c, []byte(id), true)
+		others = append(others, c)
+	}
+
+	m.TrimConns()
+	require.Equal(t, 2, m.NumConns())
+	require.False(t, valuable.isClosed)
+	require.False(t, protected.isClosed)
+	for _, c := range others {
+		require.True(t, c.isClosed)
+	}
+}
+
+func TestTrimRespectsGracePeriod(t *testing.T) {
+	m := New(0, 1, WithGracePeriod(time.Hour))
+
+	c := &mockedCloser{}
+	m.TrackConn(c, []byte("a"), true)
+	m.TrackConn(&mockedCloser{}, []byte("b"), true)
+
+	m.TrimConns()
+	require.Equal(t, 2, m.NumConns())
+	require.False(t, c.isClosed)
+}
+
+func TestProtect(t *testing.T) {
+	m := New(0, 1)
+	id := []byte("a")
+
+	m.Protect(id, "tag1")
+	m.Protect(id, "tag2")
+	require.True(t, m.IsProtected(id))
+	require.True(t, m.Unprotect(id, "tag1"))
+	require.False(t, m.Unprotect(id, "tag2"))
+	require.False(t, m.IsProtected(id))
+}
+
+func TestConnCounts(t *testing.T) {
+	m := New(10, 20)
+
+	info1 := m.TrackConn(&mockedCloser{}, []byte("a"), true)
+	info2 := m.TrackConn(&mockedCloser{}, []byte("a"), false)
+	m.TrackConn(&mockedCloser{}, []byte("b"), false)
+
+	info1.SetProtocol("/ping")
+	info2.SetProtocol("/ping")
+	require.Equal(t, 2, m.NumConnsToPeer([]byte("a")))
+	require.Equal(t, 2, m.NumConnsUsingProtocol("/ping"))
+
+	m.UntrackConn(info1)
+	require.Equal(t, 1, m.NumConnsToPeer([]byte("a")))
+	require.Equal(t, 1, m.NumConnsUsingProtocol("/ping"))
+}
+
+func TestHandshakeLimit(t *testing.T) {
+	m := New(10, 20, WithMaxInboundHandshakes(1))
+
+	require.NoError(t, m.AcquireHandshake(context.Background()))
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFunc()
+	require.ErrorIs(t, m.AcquireHandshake(ctx), context.DeadlineExceeded)
+
+	m.ReleaseHandshake()
+	require.NoError(t, m.AcquireHandshake(context.Background()))
+
+	// A limit below one still allows one handshake at the time.
+	m = New(10, 20, WithMaxInboundHandshakes(0))
+	require.NoError(t, m.AcquireHandshake(context.Background()))
+	ctx, cancelFunc = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelFunc()
+	require.ErrorIs(t, m.AcquireHandshake(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const _boxInfo = "pearly-sealed-box"
+
+var ErrInvalidBox = errors.New("invalid sealed box")
+
+// BoxKey is an X25519 key that sealed boxes are encrypted to. A sealed box is
+// encrypted with a new ephemeral key, so only the owner of the BoxKey can open
+// it and the sender stays anonymous.
+type BoxKey struct {
+	key *ecdh.PrivateKey
+}
+
+var _ Decrypter = BoxKey{}
+
+// GenerateBoxKey creates a new X25519 box key.
+func GenerateBoxKey() (BoxKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return BoxKey{}, err
+	}
+	return BoxKey{key}, nil
+}
+
+// NewBoxKey creates a box key from the bytes returned by Bytes.
+func NewBoxKey(privateKey []byte) (BoxKey, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return BoxKey{}, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+	return BoxKey{key}, nil
+}
+
+// Bytes returns the private key.
+func (k BoxKey) Bytes() []byte {
+	return k.key.Bytes()
+}
+
+// PublicKey returns the key that boxes for this key are sealed to.
+func (k BoxKey) PublicKey() []byte {
+	return k.key.PublicKey().Bytes()
+}
+
+// Decrypt opens a box sealed to the public key of k.
+func (k BoxKey) Decrypt(box []byte) ([]byte, error) {
+	keySize := len(k.PublicKey())
+	if len(box) < keySize {
+		return nil, ErrInvalidBox
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(box[:keySize])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBox, err)
+	}
+	shared, err := k.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBox, err)
+	}
+	aead, additionalData, err := boxCipher(shared, ephemeral, k.key.PublicKey())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBox, err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	plaintext, err := aead.Open(nil, nonce, box[keySize:], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBox, err)
+	}
+	return plaintext, nil
+}
+
+// BoxEncrypter seals boxes to a public box key.
+type BoxEncrypter struct {
+	recipient *ecdh.PublicKey
+}
+
+var _ Encrypter = BoxEncrypter{}
+
+// NewBoxEncrypter creates an encrypter for the public key returned by
+// BoxKey.PublicKey.
+func NewBoxEncrypter(publicKey []byte) (BoxEncrypter, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return BoxEncrypter{}, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+	return BoxEncrypter{recipient}, nil
+}
+
+// Encrypt seals plaintext in a box, which is the ephemeral public key followed
+// by the AES-256-GCM ciphertext. The key is derived with HKDF from the shared
+// secret of the ephemeral key and the recipient, and since it is only used
+// once the nonce is zero.
+func (e BoxEncrypter) Encrypt(plaintext []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(e.recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, additionalData, err := boxCipher(shared, ephemeral.PublicKey(), e.recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ephemeral.PublicKey().Bytes(), nonce, plaintext, additionalData), nil
+}
+
+// boxCipher returns the cipher of a box and the additional data, which is the
+// ephemeral key followed by the key of the recipient.
+func boxCipher(shared []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, []byte, error) {
+	additionalData := append(ephemeral.Bytes(), recipient.Bytes()...)
+	key, err := hkdf.Key(sha256.New, shared, additionalData, _boxInfo, _streamKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, additionalData, nil
+}
@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealedBox(t *testing.T) {
+	key, err := GenerateBoxKey()
+	require.NoError(t, err)
+	encrypter, err := NewBoxEncrypter(key.PublicKey())
+	require.NoError(t, err)
+
+	msg := []byte("only the owner of the box key can read this")
+	box, err := encrypter.Encrypt(msg)
+	require.NoError(t, err)
+
+	plaintext, err := key.Decrypt(box)
+	require.NoError(t, err)
+	require.Equal(t, msg, plaintext)
+
+	restored, err := NewBoxKey(key.Bytes())
+	require.NoError(t, err)
+	plaintext, err = restored.Decrypt(box)
+	require.NoError(t, err)
+	require.Equal(t, msg, plaintext)
+}
+
+func TestSealedBoxRejectsWrongKey(t *testing.T) {
+	key, err := GenerateBoxKey()
+	require.NoError(t, err)
+	otherKey, err := GenerateBoxKey()
+	require.NoError(t, err)
+	encrypter, err := NewBoxEncrypter(key.PublicKey())
+	require.NoError(t, err)
+
+	box, err := encrypter.Encrypt([]byte("message"))
+	require.NoError(t, err)
+
+	_, err = otherKey.Decrypt(box)
+	require.ErrorIs(t, err, ErrInvalidBox)
+
+	box[len(box)-1] ^= 1
+	_, err = key.Decrypt(box)
+	require.ErrorIs(t, err, ErrInvalidBox)
+
+	_, err = key.Decrypt(box[:10])
+	require.ErrorIs(t, err, ErrInvalidBox)
+}
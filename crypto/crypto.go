@@ -70,6 +70,10 @@ type stream struct {
 	io.Writer
 }
 
+// NewEncryptionStream encrypts the stream with AES-CTR.
+//
+// Deprecated: both directions use the same keystream and the data is not
+// authenticated. Use NewAuthenticatedStream instead.
 func NewEncryptionStream(secretKey []byte, underlying io.ReadWriter) (*stream, error) {
 	block, err := aes.NewCipher(secretKey)
 	if err != nil {
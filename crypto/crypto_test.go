@@ -46,7 +46,7 @@ func TestStream(t *testing.T) {
 }
 
 func TestStreamReadBeforeWrite(t *testing.T) {
-	port, err := testutil.GetAvilablePort()
+	port, err := testutil.GetAvailablePort()
 	require.NoError(t, err)
 	c := tcp.New(port)
 	listner, _, _ := c.Listen(context.Background())
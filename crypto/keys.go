@@ -0,0 +1,340 @@
+package crypto
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	_rsaBits = 2048
+	// _minRSABits is the smallest RSA key that is accepted.
+	_minRSABits = 2048
+)
+
+var (
+	ErrUnsupportedKey   = errors.New("unsupported key type")
+	ErrInvalidKey       = errors.New("invalid key")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// KeyType is the first byte of a marshaled key.
+type KeyType byte
+
+const (
+	KeyTypeEd25519 KeyType = iota + 1
+	KeyTypeECDSA
+	KeyTypeRSA
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeEd25519:
+		return "ed25519"
+	case KeyTypeECDSA:
+		return "ecdsa"
+	case KeyTypeRSA:
+		return "rsa"
+	default:
+		return "unknown"
+	}
+}
+
+type Signer interface {
+	Sign(msg []byte) ([]byte, error)
+}
+
+type Verifier interface {
+	// Verify returns ErrInvalidSignature if sig is not a signature of msg.
+	Verify(msg []byte, sig []byte) error
+}
+
+// PublicKey is an Ed25519, ECDSA P-256 or RSA public key.
+type PublicKey interface {
+	Verifier
+	Type() KeyType
+	// Std returns the key used by the standard library.
+	Std() stdcrypto.PublicKey
+}
+
+// PrivateKey is an Ed25519, ECDSA P-256 or RSA private key. Ed25519 keys sign
+// the message directly, ECDSA keys sign the SHA-256 hash in ASN.1 form and RSA
+// keys use PSS with SHA-256.
+type PrivateKey interface {
+	Signer
+	Type() KeyType
+	Public() PublicKey
+	// Std returns the key used by the standard library.
+	Std() stdcrypto.Signer
+}
+
+// GenerateKey creates a new private key. RSA keys are 2048 bits.
+func GenerateKey(keyType KeyType) (PrivateKey, error) {
+	switch keyType {
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return ed25519PrivateKey{key}, err
+	case KeyTypeECDSA:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return ecdsaPrivateKey{key}, err
+	case KeyTypeRSA:
+		key, err := rsa.GenerateKey(rand.Reader, _rsaBits)
+		return rsaPrivateKey{key}, err
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// PublicKeyFromStd wraps a public key of the standard library.
+func PublicKeyFromStd(key stdcrypto.PublicKey) (PublicKey, error) {
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		if len(key) != ed25519.PublicKeySize {
+			return nil, ErrInvalidKey
+		}
+		return ed25519PublicKey{key}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: only the P-256 curve is supported", ErrUnsupportedKey)
+		}
+		return ecdsaPublicKey{key}, nil
+	case *rsa.PublicKey:
+		if err := checkRSASize(key); err != nil {
+			return nil, err
+		}
+		return rsaPublicKey{key}, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// PrivateKeyFromStd wraps a private key of the standard library.
+func PrivateKeyFromStd(key stdcrypto.Signer) (PrivateKey, error) {
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		if len(key) != ed25519.PrivateKeySize {
+			return nil, ErrInvalidKey
+		}
+		return ed25519PrivateKey{key}, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%w: only the P-256 curve is supported", ErrUnsupportedKey)
+		}
+		return ecdsaPrivateKey{key}, nil
+	case *rsa.PrivateKey:
+		if err := checkRSASize(&key.PublicKey); err != nil {
+			return nil, err
+		}
+		return rsaPrivateKey{key}, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// MarshalPublicKey returns the canonical form of the key, which is the key
+// type followed by the raw Ed25519 key, the uncompressed ECDSA point or the
+// PKCS #1 RSA key.
+func MarshalPublicKey(key PublicKey) ([]byte, error) {
+	var body []byte
+	switch key := key.(type) {
+	case ed25519PublicKey:
+		body = key.key
+	case ecdsaPublicKey:
+		ecdhKey, err := key.key.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		body = ecdhKey.Bytes()
+	case rsaPublicKey:
+		body = x509.MarshalPKCS1PublicKey(key.key)
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	return append([]byte{byte(key.Type())}, body...), nil
+}
+
+// UnmarshalPublicKey parses a key marshaled by MarshalPublicKey.
+func UnmarshalPublicKey(data []byte) (PublicKey, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	body := data[1:]
+	switch KeyType(data[0]) {
+	case KeyTypeEd25519:
+		if len(body) != ed25519.PublicKeySize {
+			return nil, ErrInvalidKey
+		}
+		return ed25519PublicKey{ed25519.PublicKey(append([]byte{}, body...))}, nil
+	case KeyTypeECDSA:
+		// Parsing the point with crypto/ecdh checks that it is on the curve.
+		if _, err := ecdh.P256().NewPublicKey(body); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		size := (len(body) - 1) / 2
+		return ecdsaPublicKey{&ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(body[1 : 1+size]),
+			Y:     new(big.Int).SetBytes(body[1+size:]),
+		}}, nil
+	case KeyTypeRSA:
+		key, err := x509.ParsePKCS1PublicKey(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		if err := checkRSASize(key); err != nil {
+			return nil, err
+		}
+		return rsaPublicKey{key}, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// MarshalPrivateKey returns the key type followed by the PKCS #8 form of the
+// key.
+func MarshalPrivateKey(key PrivateKey) ([]byte, error) {
+	body, err := x509.MarshalPKCS8PrivateKey(key.Std())
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(key.Type())}, body...), nil
+}
+
+// UnmarshalPrivateKey parses a key marshaled by MarshalPrivateKey.
+func UnmarshalPrivateKey(data []byte) (PrivateKey, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(data[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+	signer, ok := parsed.(stdcrypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+
+	key, err := PrivateKeyFromStd(signer)
+	if err != nil {
+		return nil, err
+	}
+	if key.Type() != KeyType(data[0]) {
+		return nil, fmt.Errorf("%w: key type does not match the prefix", ErrInvalidKey)
+	}
+	return key, nil
+}
+
+// PeerID returns the ID of the peer with the public key, which is the SHA-256
+// hash of the marshaled key. It is the same ID as the one given by
+// peer.NewWithPublicKey for the marshaled key.
+func PeerID(key PublicKey) ([]byte, error) {
+	data, err := MarshalPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(data)
+	return id[:], nil
+}
+
+func checkRSASize(key *rsa.PublicKey) error {
+	if key.N == nil || key.N.BitLen() < _minRSABits {
+		return fmt.Errorf("%w: RSA keys must be at least %d bits", ErrInvalidKey, _minRSABits)
+	}
+	return nil
+}
+
+type ed25519PublicKey struct {
+	key ed25519.PublicKey
+}
+
+func (k ed25519PublicKey) Type() KeyType            { return KeyTypeEd25519 }
+func (k ed25519PublicKey) Std() stdcrypto.PublicKey { return k.key }
+func (k ed25519PublicKey) Verify(msg, sig []byte) error {
+	return verified(ed25519.Verify(k.key, msg, sig))
+}
+
+type ed25519PrivateKey struct {
+	key ed25519.PrivateKey
+}
+
+func (k ed25519PrivateKey) Type() KeyType         { return KeyTypeEd25519 }
+func (k ed25519PrivateKey) Std() stdcrypto.Signer { return k.key }
+func (k ed25519PrivateKey) Public() PublicKey {
+	return ed25519PublicKey{k.key.Public().(ed25519.PublicKey)}
+}
+
+func (k ed25519PrivateKey) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(k.key, msg), nil
+}
+
+type ecdsaPublicKey struct {
+	key *ecdsa.PublicKey
+}
+
+func (k ecdsaPublicKey) Type() KeyType            { return KeyTypeECDSA }
+func (k ecdsaPublicKey) Std() stdcrypto.PublicKey { return k.key }
+func (k ecdsaPublicKey) Verify(msg, sig []byte) error {
+	digest := sha256.Sum256(msg)
+	return verified(ecdsa.VerifyASN1(k.key, digest[:], sig))
+}
+
+type ecdsaPrivateKey struct {
+	key *ecdsa.PrivateKey
+}
+
+func (k ecdsaPrivateKey) Type() KeyType         { return KeyTypeECDSA }
+func (k ecdsaPrivateKey) Std() stdcrypto.Signer { return k.key }
+func (k ecdsaPrivateKey) Public() PublicKey     { return ecdsaPublicKey{&k.key.PublicKey} }
+
+func (k ecdsaPrivateKey) Sign(msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	return ecdsa.SignASN1(rand.Reader, k.key, digest[:])
+}
+
+var _pssOptions = &rsa.PSSOptions{
+	SaltLength: rsa.PSSSaltLengthEqualsHash,
+	Hash:       stdcrypto.SHA256,
+}
+
+type rsaPublicKey struct {
+	key *rsa.PublicKey
+}
+
+func (k rsaPublicKey) Type() KeyType            { return KeyTypeRSA }
+func (k rsaPublicKey) Std() stdcrypto.PublicKey { return k.key }
+func (k rsaPublicKey) Verify(msg, sig []byte) error {
+	digest := sha256.Sum256(msg)
+	return verified(rsa.VerifyPSS(k.key, stdcrypto.SHA256, digest[:], sig, _pssOptions) == nil)
+}
+
+type rsaPrivateKey struct {
+	key *rsa.PrivateKey
+}
+
+func (k rsaPrivateKey) Type() KeyType         { return KeyTypeRSA }
+func (k rsaPrivateKey) Std() stdcrypto.Signer { return k.key }
+func (k rsaPrivateKey) Public() PublicKey     { return rsaPublicKey{&k.key.PublicKey} }
+
+func (k rsaPrivateKey) Sign(msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	return rsa.SignPSS(rand.Reader, k.key, stdcrypto.SHA256, digest[:], _pssOptions)
+}
+
+func verified(ok bool) error {
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
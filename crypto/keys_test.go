@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeEd25519, KeyTypeECDSA, KeyTypeRSA} {
+		t.Run(keyType.String(), func(t *testing.T) {
+			key, err := GenerateKey(keyType)
+			require.NoError(t, err)
+			require.Equal(t, keyType, key.Type())
+			require.Equal(t, keyType, key.Public().Type())
+
+			msg := []byte("written by the owner of the key")
+			sig, err := key.Sign(msg)
+			require.NoError(t, err)
+			require.NoError(t, key.Public().Verify(msg, sig))
+			require.ErrorIs(t, key.Public().Verify([]byte("another message"), sig), ErrInvalidSignature)
+
+			other, err := GenerateKey(keyType)
+			require.NoError(t, err)
+			require.ErrorIs(t, other.Public().Verify(msg, sig), ErrInvalidSignature)
+		})
+	}
+}
+
+func TestMarshalKeys(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeEd25519, KeyTypeECDSA, KeyTypeRSA} {
+		t.Run(keyType.String(), func(t *testing.T) {
+			key, err := GenerateKey(keyType)
+			require.NoError(t, err)
+
+			data, err := MarshalPublicKey(key.Public())
+			require.NoError(t, err)
+			require.Equal(t, byte(keyType), data[0])
+
+			publicKey, err := UnmarshalPublicKey(data)
+			require.NoError(t, err)
+			require.Equal(t, key.Public().Std(), publicKey.Std())
+
+			data, err = MarshalPrivateKey(key)
+			require.NoError(t, err)
+			privateKey, err := UnmarshalPrivateKey(data)
+			require.NoError(t, err)
+			require.Equal(t, key.Std(), privateKey.Std())
+
+			// A key with the prefix of another key type is rejected.
+			data[0] = byte(keyType%KeyTypeRSA + 1)
+			_, err = UnmarshalPrivateKey(data)
+			require.ErrorIs(t, err, ErrInvalidKey)
+		})
+	}
+
+	_, err := UnmarshalPublicKey([]byte{byte(KeyTypeEd25519), 1, 2, 3})
+	require.ErrorIs(t, err, ErrInvalidKey)
+	_, err = UnmarshalPublicKey([]byte{0, 1, 2, 3})
+	require.ErrorIs(t, err, ErrUnsupportedKey)
+}
+
+func TestRejectSmallRSAKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	_, err = PublicKeyFromStd(&key.PublicKey)
+	require.ErrorIs(t, err, ErrInvalidKey)
+	_, err = PrivateKeyFromStd(key)
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	data := append([]byte{byte(KeyTypeRSA)}, x509.MarshalPKCS1PublicKey(&key.PublicKey)...)
+	_, err = UnmarshalPublicKey(data)
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestPeerID(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeEd25519, KeyTypeECDSA, KeyTypeRSA} {
+		key, err := GenerateKey(keyType)
+		require.NoError(t, err)
+
+		id, err := PeerID(key.Public())
+		require.NoError(t, err)
+		data, err := MarshalPublicKey(key.Public())
+		require.NoError(t, err)
+
+		p := peer.NewWithPublicKey("localhost:8080", data)
+		require.Equal(t, id, p.ID())
+		require.Equal(t, data, p.PublicKey())
+	}
+}
@@ -0,0 +1,269 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// _maxFrameSize is the maximum size of the plaintext of a frame.
+	_maxFrameSize    = 16 * 1024
+	_frameHeaderSize = 2
+	_streamKeySize   = 32
+
+	// DefaultRekeyAfter is the number of bytes sent in one direction of an
+	// authenticated stream before the key of that direction is replaced.
+	DefaultRekeyAfter = 1 << 30
+)
+
+const (
+	_initiatorStreamInfo = "pearly-stream-initiator"
+	_responderStreamInfo = "pearly-stream-responder"
+	_rekeyInfo           = "pearly-stream-rekey"
+)
+
+var (
+	ErrInvalidFrame   = errors.New("invalid authenticated frame")
+	ErrNonceExhausted = errors.New("all nonces of the stream key are used")
+)
+
+type StreamOption func(*streamOptions)
+
+type streamOptions struct {
+	rekeyAfter uint64
+}
+
+// WithRekeyAfter sets the number of bytes sent in one direction before the key
+// of that direction is replaced. Zero disables rekeying.
+func WithRekeyAfter(n uint64) StreamOption {
+	return func(o *streamOptions) {
+		o.rekeyAfter = n
+	}
+}
+
+// AuthenticatedStream encrypts and authenticates data written to the
+// underlying stream with AES-256-GCM. Each direction has its own key derived
+// from the secret key with HKDF, data is sent in frames prefixed by their
+// length, and the nonce of a frame is a counter, so frames that are modified,
+// reordered or replayed are rejected. After a number of bytes the key of a
+// direction is replaced by a key derived from the previous one.
+type AuthenticatedStream struct {
+	underlying io.ReadWriter
+
+	readLock   *sync.Mutex
+	readState  *streamCipher
+	unread     []byte
+	readBuffer []byte
+
+	writeLock   *sync.Mutex
+	writeState  *streamCipher
+	writeBuffer []byte
+}
+
+var _ io.ReadWriter = &AuthenticatedStream{}
+
+// NewAuthenticatedStream wraps underlying in an authenticated stream. Both
+// ends must use the same secret key, and exactly one of them must be the
+// initiator.
+func NewAuthenticatedStream(
+	secretKey []byte,
+	initiator bool,
+	underlying io.ReadWriter,
+	opts ...StreamOption,
+) (*AuthenticatedStream, error) {
+	options := &streamOptions{rekeyAfter: DefaultRekeyAfter}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	sendInfo, recvInfo := _initiatorStreamInfo, _responderStreamInfo
+	if !initiator {
+		sendInfo, recvInfo = recvInfo, sendInfo
+	}
+
+	writeState, err := newStreamCipher(secretKey, sendInfo, options.rekeyAfter)
+	if err != nil {
+		return nil, err
+	}
+	readState, err := newStreamCipher(secretKey, recvInfo, options.rekeyAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthenticatedStream{
+		underlying: underlying,
+		readLock:   &sync.Mutex{},
+		readState:  readState,
+		writeLock:  &sync.Mutex{},
+		writeState: writeState,
+	}, nil
+}
+
+func (s *AuthenticatedStream) Read(p []byte) (int, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+
+	for len(s.unread) == 0 {
+		if err := s.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.unread)
+	s.unread = s.unread[n:]
+	return n, nil
+}
+
+func (s *AuthenticatedStream) readFrame() error {
+	header := make([]byte, _frameHeaderSize)
+	if _, err := io.ReadFull(s.underlying, header); err != nil {
+		return err
+	}
+
+	size := int(binary.BigEndian.Uint16(header))
+	if size < s.readState.aead.Overhead() {
+		return ErrInvalidFrame
+	}
+	if cap(s.readBuffer) < size {
+		s.readBuffer = make([]byte, size)
+	}
+	ciphertext := s.readBuffer[:size]
+	if _, err := io.ReadFull(s.underlying, ciphertext); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	plaintext, err := s.readState.open(ciphertext[:0], header, ciphertext)
+	if err != nil {
+		return err
+	}
+	s.unread = plaintext
+	return nil
+}
+
+func (s *AuthenticatedStream) Write(p []byte) (n int, err error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	overhead := s.writeState.aead.Overhead()
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+_maxFrameSize)]
+
+		// The header is the additional data of the frame, which must not
+		// overlap with the buffer the frame is sealed into.
+		var header [_frameHeaderSize]byte
+		binary.BigEndian.PutUint16(header[:], uint16(len(chunk)+overhead))
+		frame := append(s.writeBuffer[:0], header[:]...)
+		frame, err = s.writeState.seal(frame, header[:], chunk)
+		if err != nil {
+			return n, err
+		}
+		s.writeBuffer = frame
+
+		if _, err := s.underlying.Write(frame); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// streamCipher is the state of one direction of an authenticated stream.
+type streamCipher struct {
+	key        []byte
+	aead       cipher.AEAD
+	nonce      uint64
+	processed  uint64
+	rekeyAfter uint64
+}
+
+func newStreamCipher(secretKey []byte, info string, rekeyAfter uint64) (*streamCipher, error) {
+	if len(secretKey) == 0 {
+		return nil, fmt.Errorf("%w: empty secret key", ErrInvalidKey)
+	}
+
+	key, err := hkdf.Key(sha256.New, secretKey, nil, info, _streamKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &streamCipher{rekeyAfter: rekeyAfter}
+	return s, s.setKey(key)
+}
+
+func (s *streamCipher) setKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	s.key = key
+	s.aead = aead
+	s.nonce = 0
+	s.processed = 0
+	return nil
+}
+
+func (s *streamCipher) seal(dst, additionalData, plaintext []byte) ([]byte, error) {
+	nonce, err := s.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := s.aead.Seal(dst, nonce, plaintext, additionalData)
+	return ciphertext, s.advance(len(plaintext))
+}
+
+func (s *streamCipher) open(dst, additionalData, ciphertext []byte) ([]byte, error) {
+	nonce, err := s.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.aead.Open(dst, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFrame, err)
+	}
+	return plaintext, s.advance(len(plaintext))
+}
+
+func (s *streamCipher) nextNonce() ([]byte, error) {
+	if s.nonce == math.MaxUint64 {
+		return nil, ErrNonceExhausted
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.nonce)
+	s.nonce++
+	return nonce, nil
+}
+
+// advance counts n processed bytes and replaces the key once enough bytes are
+// processed. Both ends count the same bytes, so they replace the key after the
+// same frame.
+func (s *streamCipher) advance(n int) error {
+	s.processed += uint64(n)
+	if s.rekeyAfter == 0 || s.processed < s.rekeyAfter {
+		return nil
+	}
+
+	key, err := hkdf.Key(sha256.New, s.key, nil, _rekeyInfo, _streamKeySize)
+	if err != nil {
+		return err
+	}
+	return s.setKey(key)
+}
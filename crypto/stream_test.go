@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createStreamPair(t *testing.T, underlying io.ReadWriter, opts ...StreamOption) (*AuthenticatedStream, *AuthenticatedStream) {
+	t.Helper()
+
+	secretKey := NewSymmetricEncryptionSecretKey()
+	initiator, err := NewAuthenticatedStream(secretKey, true, underlying, opts...)
+	require.NoError(t, err)
+	responder, err := NewAuthenticatedStream(secretKey, false, underlying, opts...)
+	require.NoError(t, err)
+	return initiator, responder
+}
+
+func TestAuthenticatedStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	secretKey := NewSymmetricEncryptionSecretKey()
+	s1, err := NewAuthenticatedStream(secretKey, true, c1)
+	require.NoError(t, err)
+	s2, err := NewAuthenticatedStream(secretKey, false, c2)
+	require.NoError(t, err)
+
+	msg := make([]byte, 3*_maxFrameSize+10)
+	rand.Read(msg)
+
+	go func() {
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(s2, buf); err != nil {
+			return
+		}
+		s2.Write(buf)
+	}()
+
+	_, err = s1.Write(msg)
+	require.NoError(t, err)
+
+	received := make([]byte, len(msg))
+	_, err = io.ReadFull(s1, received)
+	require.NoError(t, err)
+	require.Equal(t, msg, received)
+}
+
+func TestAuthenticatedStreamDirectionsUseDifferentKeys(t *testing.T) {
+	var buf bytes.Buffer
+	initiator, _ := createStreamPair(t, &buf)
+
+	_, err := initiator.Write([]byte("message"))
+	require.NoError(t, err)
+
+	// The initiator can not read its own frames, since they are encrypted with
+	// the key of the other direction.
+	_, err = initiator.Read(make([]byte, 10))
+	require.ErrorIs(t, err, ErrInvalidFrame)
+}
+
+func TestAuthenticatedStreamRejectsModifiedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	initiator, responder := createStreamPair(t, &buf)
+
+	_, err := initiator.Write([]byte("message"))
+	require.NoError(t, err)
+	buf.Bytes()[buf.Len()-1] ^= 1
+
+	_, err = responder.Read(make([]byte, 10))
+	require.ErrorIs(t, err, ErrInvalidFrame)
+}
+
+func TestAuthenticatedStreamRejectsReplayedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	initiator, responder := createStreamPair(t, &buf)
+
+	_, err := initiator.Write([]byte("message"))
+	require.NoError(t, err)
+	frame := bytes.Clone(buf.Bytes())
+
+	_, err = responder.Read(make([]byte, 10))
+	require.NoError(t, err)
+
+	buf.Write(frame)
+	_, err = responder.Read(make([]byte, 10))
+	require.ErrorIs(t, err, ErrInvalidFrame)
+}
+
+func TestAuthenticatedStreamRekey(t *testing.T) {
+	var buf bytes.Buffer
+	initiator, responder := createStreamPair(t, &buf, WithRekeyAfter(100))
+
+	firstKey := initiator.writeState.key
+	for i := 0; i < 10; i++ {
+		msg := make([]byte, 60)
+		rand.Read(msg)
+		_, err := initiator.Write(msg)
+		require.NoError(t, err)
+
+		received := make([]byte, len(msg))
+		_, err = io.ReadFull(responder, received)
+		require.NoError(t, err)
+		require.Equal(t, msg, received)
+	}
+	require.NotEqual(t, firstKey, initiator.writeState.key)
+	require.Equal(t, initiator.writeState.key, responder.readState.key)
+}
+
+func TestAuthenticatedStreamTruncatedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	initiator, responder := createStreamPair(t, &buf)
+
+	_, err := initiator.Write([]byte("message"))
+	require.NoError(t, err)
+	buf.Truncate(buf.Len() - 1)
+
+	_, err = responder.Read(make([]byte, 10))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
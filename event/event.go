@@ -0,0 +1,156 @@
+package event
+
+import (
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// PeerConnected is emitted when a connection to a peer is opened.
+type PeerConnected struct {
+	PeerID     []byte
+	RemoteAddr string
+	Inbound    bool
+}
+
+// PeerDisconnected is emitted when a connection to a peer is closed.
+type PeerDisconnected struct {
+	PeerID     []byte
+	RemoteAddr string
+	Inbound    bool
+}
+
+// ProtocolNegotiated is emitted when a protocol has been selected for a
+// connection.
+type ProtocolNegotiated struct {
+	PeerID     []byte
+	ProtocolID string
+	Inbound    bool
+}
+
+// HandlerError is emitted when handling a connection fails. ProtocolID and
+// PeerID are empty if they are unknown.
+type HandlerError struct {
+	PeerID     []byte
+	ProtocolID string
+	Err        error
+}
+
+// ListenAddrChanged is emitted when the node starts listening on a new
+// address.
+type ListenAddrChanged struct {
+	Addr string
+}
+
+// Bus delivers events to subscribers of the event type. Delivery never
+// blocks, if the buffer of a subscription is full the event is dropped for
+// that subscription.
+type Bus struct {
+	lock   *sync.RWMutex
+	subs   map[reflect.Type][]subscriber
+	closed bool
+}
+
+type subscriber interface {
+	deliver(any)
+	close()
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		lock: &sync.RWMutex{},
+		subs: make(map[reflect.Type][]subscriber),
+	}
+}
+
+// Subscription receives all events of type T emitted after it was created.
+type Subscription[T any] struct {
+	bus     *Bus
+	events  chan T
+	dropped *atomic.Uint64
+	once    *sync.Once
+}
+
+// Subscribe creates a subscription to events of type T with a buffer of size
+// bufSize.
+func Subscribe[T any](b *Bus, bufSize int) *Subscription[T] {
+	s := &Subscription[T]{
+		bus:     b,
+		events:  make(chan T, bufSize),
+		dropped: &atomic.Uint64{},
+		once:    &sync.Once{},
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		s.close()
+		return s
+	}
+
+	t := reflect.TypeFor[T]()
+	b.subs[t] = append(b.subs[t], s)
+	return s
+}
+
+// Emit sends the event to all subscribers of the event type.
+func Emit[T any](b *Bus, e T) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, s := range b.subs[reflect.TypeFor[T]()] {
+		s.deliver(e)
+	}
+}
+
+// Close closes all subscriptions. Events emitted after Close are dropped.
+func (b *Bus) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	for _, subs := range b.subs {
+		for _, s := range subs {
+			s.close()
+		}
+	}
+	b.subs = make(map[reflect.Type][]subscriber)
+}
+
+// Events returns the channel the events are delivered on. It is closed when
+// the subscription or the bus is closed.
+func (s *Subscription[T]) Events() <-chan T {
+	return s.events
+}
+
+// Dropped returns the number of events that were dropped because the buffer
+// was full.
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription[T]) Close() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+
+	t := reflect.TypeFor[T]()
+	s.bus.subs[t] = slices.DeleteFunc(s.bus.subs[t], func(sub subscriber) bool {
+		return sub == subscriber(s)
+	})
+	s.close()
+}
+
+func (s *Subscription[T]) deliver(e any) {
+	select {
+	case s.events <- e.(T):
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *Subscription[T]) close() {
+	s.once.Do(func() {
+		close(s.events)
+	})
+}
@@ -0,0 +1,31 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	connected := Subscribe[PeerConnected](bus, 1)
+	negotiated := Subscribe[ProtocolNegotiated](bus, 1)
+
+	Emit(bus, PeerConnected{PeerID: []byte("1")})
+	Emit(bus, PeerConnected{PeerID: []byte("2")})
+	require.Equal(t, PeerConnected{PeerID: []byte("1")}, <-connected.Events())
+	require.Equal(t, uint64(1), connected.Dropped())
+	require.Len(t, negotiated.Events(), 0)
+
+	connected.Close()
+	Emit(bus, PeerConnected{PeerID: []byte("3")})
+	_, ok := <-connected.Events()
+	require.False(t, ok)
+
+	bus.Close()
+	_, ok = <-negotiated.Events()
+	require.False(t, ok)
+
+	_, ok = <-Subscribe[PeerConnected](bus, 1).Events()
+	require.False(t, ok)
+}
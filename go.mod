@@ -1,12 +1,17 @@
 module github.com/FluffyKebab/pearly
 
-go 1.23.4
+go 1.24
 
 require (
 	github.com/multiformats/go-multistream v0.6.0
 	github.com/stretchr/testify v1.10.0
 )
 
+require (
+	golang.org/x/crypto v0.40.0
+	golang.org/x/sys v0.34.0 // indirect
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.6.0
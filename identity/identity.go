@@ -0,0 +1,93 @@
+// Package identity manages the long-term key of a node. The ID of a node is
+// the SHA-256 hash of its marshaled public key, so a node keeps its ID across
+// restarts as long as it loads the same key.
+package identity
+
+import (
+	"crypto/sha256"
+
+	"github.com/FluffyKebab/pearly/crypto"
+)
+
+var (
+	ErrUnsupportedKey   = crypto.ErrUnsupportedKey
+	ErrInvalidSignature = crypto.ErrInvalidSignature
+)
+
+type KeyType = crypto.KeyType
+
+const (
+	Ed25519 = crypto.KeyTypeEd25519
+	ECDSA   = crypto.KeyTypeECDSA
+	RSA     = crypto.KeyTypeRSA
+)
+
+// Identity is the private key of a node.
+type Identity struct {
+	privateKey crypto.PrivateKey
+	publicKey  []byte
+	id         []byte
+}
+
+// Generate creates an identity with a new key. ECDSA keys use the P-256 curve
+// and RSA keys are 2048 bits.
+func Generate(keyType KeyType) (*Identity, error) {
+	privateKey, err := crypto.GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	return FromPrivateKey(privateKey)
+}
+
+// FromPrivateKey creates an identity from a private key.
+func FromPrivateKey(privateKey crypto.PrivateKey) (*Identity, error) {
+	publicKey, err := crypto.MarshalPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		id:         IDFromPublicKey(publicKey),
+	}, nil
+}
+
+// ID returns the ID of the node, which is the same as crypto.PeerID of its
+// public key.
+func (i *Identity) ID() []byte {
+	return i.id
+}
+
+// PublicKey returns the public key marshaled with crypto.MarshalPublicKey.
+func (i *Identity) PublicKey() []byte {
+	return i.publicKey
+}
+
+func (i *Identity) PrivateKey() crypto.PrivateKey {
+	return i.privateKey
+}
+
+func (i *Identity) KeyType() KeyType {
+	return i.privateKey.Type()
+}
+
+func (i *Identity) Sign(msg []byte) ([]byte, error) {
+	return i.privateKey.Sign(msg)
+}
+
+// Verify checks that sig is a signature of msg made by the private key of the
+// marshaled public key.
+func Verify(publicKey []byte, msg []byte, sig []byte) error {
+	key, err := crypto.UnmarshalPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	return key.Verify(msg, sig)
+}
+
+// IDFromPublicKey returns the ID of the node with the marshaled public key.
+func IDFromPublicKey(publicKey []byte) []byte {
+	id := sha256.Sum256(publicKey)
+	return id[:]
+}
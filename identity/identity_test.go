@@ -0,0 +1,94 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	// Keep the tests fast, the number of iterations is stored in the file.
+	kdfIterations = 1000
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, keyType := range []KeyType{Ed25519, ECDSA, RSA} {
+		t.Run(keyType.String(), func(t *testing.T) {
+			id, err := Generate(keyType)
+			require.NoError(t, err)
+			require.Equal(t, keyType, id.KeyType())
+			require.Equal(t, IDFromPublicKey(id.PublicKey()), id.ID())
+
+			msg := []byte("signed by the node")
+			sig, err := id.Sign(msg)
+			require.NoError(t, err)
+			require.NoError(t, Verify(id.PublicKey(), msg, sig))
+
+			require.ErrorIs(t, Verify(id.PublicKey(), []byte("other message"), sig), ErrInvalidSignature)
+
+			other, err := Generate(keyType)
+			require.NoError(t, err)
+			require.ErrorIs(t, Verify(other.PublicKey(), msg, sig), ErrInvalidSignature)
+		})
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	for _, keyType := range []KeyType{Ed25519, ECDSA, RSA} {
+		t.Run(keyType.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "node.key")
+			passphrase := []byte("correct horse battery staple")
+
+			id, err := Generate(keyType)
+			require.NoError(t, err)
+			require.NoError(t, id.Save(path, passphrase))
+
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+			loaded, err := Load(path, passphrase)
+			require.NoError(t, err)
+			require.Equal(t, id.ID(), loaded.ID())
+			require.Equal(t, keyType, loaded.KeyType())
+
+			_, err = Load(path, []byte("wrong passphrase"))
+			require.ErrorIs(t, err, ErrWrongPassphrase)
+		})
+	}
+}
+
+func TestLoadOrGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	passphrase := []byte("passphrase")
+
+	id, err := LoadOrGenerate(path, passphrase, Ed25519)
+	require.NoError(t, err)
+
+	// The ID stays the same when the node is restarted.
+	loaded, err := LoadOrGenerate(path, passphrase, Ed25519)
+	require.NoError(t, err)
+	require.Equal(t, id.ID(), loaded.ID())
+
+	_, err = LoadOrGenerate(path, []byte("wrong"), Ed25519)
+	require.ErrorIs(t, err, ErrWrongPassphrase)
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	id, err := Generate(Ed25519)
+	require.NoError(t, err)
+
+	_, err = id.Marshal(nil)
+	require.ErrorIs(t, err, ErrEmptyPassphrase)
+
+	_, err = Unmarshal([]byte("not a key file"), []byte("passphrase"))
+	require.ErrorIs(t, err, ErrInvalidKeyFile)
+
+	data, err := id.Marshal([]byte("passphrase"))
+	require.NoError(t, err)
+	data[len(data)/2] ^= 1
+	_, err = Unmarshal(data, []byte("passphrase"))
+	require.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package identity
+
+import (
+	stdcrypto "crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/FluffyKebab/pearly/crypto"
+)
+
+const (
+	_pemType  = "PEARLY ENCRYPTED PRIVATE KEY"
+	_kdfName  = "pbkdf2-sha256"
+	_saltSize = 16
+	_keySize  = 32
+)
+
+// kdfIterations is the number of PBKDF2 iterations used when saving keys. It
+// is stored in the key file, so it can be raised without breaking old files.
+var kdfIterations = 600_000
+
+var (
+	ErrEmptyPassphrase = errors.New("passphrase is empty")
+	ErrInvalidKeyFile  = errors.New("invalid key file")
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key file")
+)
+
+// Marshal encrypts the private key with a key derived from the passphrase
+// and returns it PEM encoded. The private key is marshaled in PKCS #8 form
+// and encrypted with AES-256-GCM.
+func (i *Identity) Marshal(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+
+	plaintext, err := x509.MarshalPKCS8PrivateKey(i.privateKey.Std())
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, _saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt, kdfIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: _pemType,
+		Headers: map[string]string{
+			"KDF":        _kdfName,
+			"Iterations": strconv.Itoa(kdfIterations),
+			"Salt":       hex.EncodeToString(salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, plaintext, []byte(_pemType)),
+	}), nil
+}
+
+// Unmarshal decrypts an identity marshaled by Marshal.
+func Unmarshal(data []byte, passphrase []byte) (*Identity, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != _pemType {
+		return nil, ErrInvalidKeyFile
+	}
+	if block.Headers["KDF"] != _kdfName {
+		return nil, fmt.Errorf("%w: unknown kdf %q", ErrInvalidKeyFile, block.Headers["KDF"])
+	}
+
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("%w: invalid iterations", ErrInvalidKeyFile)
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid salt", ErrInvalidKeyFile)
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid nonce", ErrInvalidKeyFile)
+	}
+
+	aead, err := newAEAD(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce", ErrInvalidKeyFile)
+	}
+
+	plaintext, err := aead.Open(nil, nonce, block.Bytes, []byte(_pemType))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKeyFile, err)
+	}
+	signer, ok := privateKey.(stdcrypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	key, err := crypto.PrivateKeyFromStd(signer)
+	if err != nil {
+		return nil, err
+	}
+	return FromPrivateKey(key)
+}
+
+// Save writes the identity encrypted with the passphrase to path. The file is
+// only readable by the owner, and is replaced atomically if it exists.
+func (i *Identity) Save(path string, passphrase []byte) error {
+	data, err := i.Marshal(passphrase)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads an identity saved with Save.
+func Load(path string, passphrase []byte) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(data, passphrase)
+}
+
+// LoadOrGenerate loads the identity at path. If the file does not exist, a
+// new identity of the key type is generated and saved to path.
+func LoadOrGenerate(path string, passphrase []byte, keyType KeyType) (*Identity, error) {
+	id, err := Load(path, passphrase)
+	if !errors.Is(err, os.ErrNotExist) {
+		return id, err
+	}
+
+	id, err = Generate(keyType)
+	if err != nil {
+		return nil, err
+	}
+	return id, id.Save(path, passphrase)
+}
+
+func newAEAD(passphrase []byte, salt []byte, iterations int) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, iterations, _keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
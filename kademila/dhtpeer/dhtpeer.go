@@ -7,6 +7,7 @@ import (
 	"math/bits"
 
 	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/storage"
 )
 
 type Store struct {
@@ -70,8 +71,9 @@ func (s Store) Peers() []peer.Peer {
 }
 
 func (s Store) GetClosestPeers(key []byte, k int) ([]peer.Peer, []*big.Int, error) {
-	if len(s.nodeID) != len(key) {
-		return nil, nil, fmt.Errorf("diffrent len keys") // TODO: imprv
+	key, err := storage.MapKeyToIDSpace(key, len(s.nodeID))
+	if err != nil {
+		return nil, nil, err
 	}
 
 	type peerDistence struct {
@@ -114,9 +116,16 @@ func (s Store) GetClosestPeers(key []byte, k int) ([]peer.Peer, []*big.Int, erro
 	return res, dis, nil
 }
 
+// Distance returns the distance between two keys. Keys that do not have the
+// same length as the node ID are first mapped onto the node ID space.
 func (s Store) Distance(keyA, keyB []byte) (*big.Int, error) {
-	if len(keyA) != len(keyB) {
-		return nil, fmt.Errorf("diffrent len keys in dis") // TODO: imprv
+	keyA, err := storage.MapKeyToIDSpace(keyA, len(s.nodeID))
+	if err != nil {
+		return nil, err
+	}
+	keyB, err = storage.MapKeyToIDSpace(keyB, len(s.nodeID))
+	if err != nil {
+		return nil, err
 	}
 
 	return distenceBetween(keyA, keyB), nil
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/storage"
 	"github.com/stretchr/testify/require"
 )
 
@@ -56,3 +57,25 @@ func TestDistenceBetween(t *testing.T) {
 		[]byte{0b10101010, 0b10101010}),
 	))
 }
+
+func TestPeerStoreSelfDescribingKeys(t *testing.T) {
+	s := NewStore([]byte{0b11111111}, 2)
+
+	err := s.AddPeer(peer.New([]byte{0b11000000}, ""))
+	require.NoError(t, err)
+	err = s.AddPeer(peer.New([]byte{0b00000001}, ""))
+	require.NoError(t, err)
+
+	key := storage.EncodeKey(storage.SHA3_256, []byte{0b11000100})
+	closest, dis, err := s.GetClosestPeers(key, 1)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal([]byte{0b11000000}, closest[0].ID()))
+	require.Equal(t, big.NewInt(0b00000100), dis[0])
+
+	distance, err := s.Distance([]byte{0b11000000}, key)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(0b00000100), distance)
+
+	_, _, err = s.GetClosestPeers([]byte{1, 2}, 1)
+	require.ErrorIs(t, err, storage.ErrInvalidKey)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/big"
 	"sync"
+	"time"
 
 	"github.com/FluffyKebab/pearly/kademila/kdmgetvalue"
 	"github.com/FluffyKebab/pearly/kademila/kdmstore"
@@ -18,12 +19,15 @@ import (
 var (
 	ErrAllreadySet   = errors.New("a value with this key is allredy set in the DHT")
 	ErrSettingFailed = errors.New("failed to set value")
+	ErrPeerNotFound  = errors.New("peer not found in the DHT")
 )
 
 type DHT struct {
 	node              node.Node
 	peerstore         peer.Store
 	datastore         storage.Hashtable
+	addrBook          peer.AddrBook
+	addrTTL           time.Duration
 	getValueService   kdmgetvalue.Service
 	storeValueService kdmstore.Service
 
@@ -41,6 +45,8 @@ type DHT struct {
 	MinNumStores int
 }
 
+var _ node.Resolver = DHT{}
+
 func New(node node.Node, opts ...Option) DHT {
 	option := defualtOptions(node.ID())
 	for _, opt := range opts {
@@ -57,6 +63,8 @@ func New(node node.Node, opts ...Option) DHT {
 		node:              node,
 		peerstore:         option.peerstore,
 		datastore:         option.datastore,
+		addrBook:          option.addrBook,
+		addrTTL:           option.addrTTL,
 		getValueService:   getValueService,
 		storeValueService: storeValueService,
 
@@ -335,6 +343,60 @@ func (dht DHT) doGetValueSelfSearch(key []byte, nodes *searchNodes) ([]byte, err
 	return nil, nil
 }
 
+// FindPeer searches the network for the peer with the given ID.
+func (dht DHT) FindPeer(ctx context.Context, id []byte) (peer.Peer, error) {
+	peers, distances, err := dht.peerstore.GetClosestPeers(id, dht.NumPeerReturnedGet)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := &searchNodes{mutext: &sync.Mutex{}, nodes: make([]searchNode, 0, len(peers))}
+	for i, p := range peers {
+		if bytes.Equal(p.ID(), id) {
+			return p, nil
+		}
+		nodes.addSearchNode(searchNode{peer: p, distance: distances[i]})
+	}
+
+	errorCollection := make([]errorPeer, 0)
+	for ctx.Err() == nil {
+		newNodesFound, nodeContacted, _, err := dht.searchOnePeer(ctx, nodes, id, dht.NumPeerReturnedGet)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				break
+			}
+			if isExpectedKDMError(err) {
+				errorCollection = append(errorCollection, errorPeer{err, nodeContacted.peer})
+				continue
+			}
+			return nil, err
+		}
+
+		for _, node := range newNodesFound {
+			if bytes.Equal(node.peer.ID(), id) {
+				return node.peer, nil
+			}
+			nodes.addSearchNode(node)
+		}
+	}
+
+	return nil, fmt.Errorf(
+		"%w: possible errors connacting peers: [%w]",
+		ErrPeerNotFound,
+		combineErrors(errorCollection),
+	)
+}
+
+// Resolve finds the address of the peer with the given ID, making it possible
+// to use the DHT as a node.Resolver.
+func (dht DHT) Resolve(ctx context.Context, id []byte) ([]string, error) {
+	p, err := dht.FindPeer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return []string{p.PublicAddr()}, nil
+}
+
 func (dht DHT) Bootstrap(ctx context.Context, peerInNetwork peer.Peer) error {
 	response, err := dht.getValueService.Do(ctx, kdmgetvalue.Request{
 		Key: dht.node.ID(),
@@ -344,6 +406,7 @@ func (dht DHT) Bootstrap(ctx context.Context, peerInNetwork peer.Peer) error {
 		return fmt.Errorf("self lookup failed: %w", err)
 	}
 
+	dht.addToAddrBook(response.NodeContacted.ID, peerInNetwork.PublicAddr())
 	return dht.peerstore.AddPeer(peer.New(response.NodeContacted.ID, peerInNetwork.PublicAddr()))
 }
 
@@ -393,6 +456,7 @@ func (dht DHT) convertToSearchNodes(closestNodes []kdmgetvalue.Node) []searchNod
 
 func (dht DHT) addNodesToPeerstore(nodes []searchNode) error {
 	for _, node := range nodes {
+		dht.addToAddrBook(node.peer.ID(), node.peer.PublicAddr())
 		err := dht.peerstore.AddPeer(node.peer)
 		if err != nil && !errors.Is(err, peer.ErrNoSpaceToStorePeer) {
 			return fmt.Errorf(
@@ -404,6 +468,12 @@ func (dht DHT) addNodesToPeerstore(nodes []searchNode) error {
 	return nil
 }
 
+func (dht DHT) addToAddrBook(id []byte, addr string) {
+	if dht.addrBook != nil && addr != "" {
+		dht.addrBook.AddAddr(id, addr, dht.addrTTL, peer.SourceDHT)
+	}
+}
+
 type searchNode struct {
 	peer       peer.Peer
 	distance   *big.Int
@@ -104,13 +104,19 @@ func TestKadmilla(t *testing.T) {
 		nodes = append(nodes, newNode)
 	}
 
+	// Half of the keys are self-describing keys made with another hash
+	// function, which the DHT should map onto the node ID space.
+	keyHasher, err := storage.NewKeyHasher(storage.SHA3_256)
+	require.NoError(t, err)
+	hashers := []storage.Hasher{storage.NewHasher(), keyHasher}
+
 	values := make([][]byte, 0, numValuesStored)
 	keys := make([][]byte, 0, numValuesStored)
 	for i := 0; i < numValuesStored; i++ {
 		curValue := generateRandomString(20)
 		values = append(values, []byte(curValue))
 
-		hash, err := storage.NewHasher().Hash([]byte(curValue))
+		hash, err := hashers[i%len(hashers)].Hash([]byte(curValue))
 		require.NoError(t, err)
 		keys = append(keys, hash)
 	}
@@ -215,3 +221,33 @@ func generateRandomString(length int) string {
 
 	return string(result)
 }
+
+func TestFindPeer(t *testing.T) {
+	var err error
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancelFunc()
+
+	// Node 1 only knows node 2 and node 2 only knows node 3.
+	n1, _ := createEncryptedDHTNode(t, ctx)
+	n2, _ := createEncryptedDHTNode(t, ctx)
+	n3, _ := createEncryptedDHTNode(t, ctx)
+
+	err = n1.peerstore.AddPeer(peer.New(n2.node.ID(), n2.node.Transport().ListenAddr()))
+	require.NoError(t, err)
+	err = n2.peerstore.AddPeer(peer.New(n3.node.ID(), n3.node.Transport().ListenAddr()))
+	require.NoError(t, err)
+
+	found, err := n1.FindPeer(ctx, n3.node.ID())
+	require.NoError(t, err)
+	require.Equal(t, n3.node.ID(), found.ID())
+	require.Equal(t, n3.node.Transport().ListenAddr(), found.PublicAddr())
+
+	// The DHT can be used by the node to dial peers only knowing their ID.
+	n1.node.(*basic.Node).AddResolver(n1)
+	conn, err := n1.node.DialPeerByID(ctx, n3.node.ID())
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	_, err = n1.FindPeer(ctx, make([]byte, len(n3.node.ID())))
+	require.ErrorIs(t, err, ErrPeerNotFound)
+}
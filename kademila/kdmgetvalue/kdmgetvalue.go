@@ -54,7 +54,7 @@ func Register(node node.Node, peerstore peer.Store, storer storage.Hashtable) Se
 }
 
 func (s Service) Run() {
-	s.node.RegisterProtocol("/kdmgetvalue", func(c transport.Conn) error {
+	s.node.HandleProtocol("/kdmgetvalue", func(_ context.Context, c node.Stream) error {
 		var req Request
 		err := gob.NewDecoder(c).Decode(&req)
 		if err != nil {
@@ -159,7 +159,8 @@ func (s Service) Do(ctx context.Context, req Request, p peer.Peer) (Response, er
 }
 
 func (s Service) isValidRequest(req Request) bool {
-	return len(req.Key) == len(s.node.ID())
+	_, err := storage.MapKeyToIDSpace(req.Key, len(s.node.ID()))
+	return err == nil
 }
 
 func (s Service) isValidResponse(res Response, conn transport.Conn) bool {
@@ -171,18 +172,12 @@ func (s Service) isValidResponse(res Response, conn transport.Conn) bool {
 	return bytes.Equal(remoteId.RemoteID(), res.NodeContacted.ID)
 }
 
-func (s Service) tryAddPeerToStore(c transport.Conn) error {
-	ider, ok := c.(transport.RemoteIDHaver)
-	if !ok {
-		return nil
-	}
-
-	adder, ok := c.(transport.RemoteAddrHaver)
-	if !ok {
+func (s Service) tryAddPeerToStore(c node.Stream) error {
+	if c.RemoteID == nil || c.RemoteAddr == "" {
 		return nil
 	}
 
-	err := s.peerstore.AddPeer(peer.New(ider.RemoteID(), adder.RemoteAddr()))
+	err := s.peerstore.AddPeer(peer.New(c.RemoteID, c.RemoteAddr))
 	if err != nil && !errors.Is(err, peer.ErrNoSpaceToStorePeer) {
 		return err
 	}
@@ -1,6 +1,8 @@
 package kademila
 
 import (
+	"time"
+
 	"github.com/FluffyKebab/pearly/kademila/dhtpeer"
 	"github.com/FluffyKebab/pearly/peer"
 	"github.com/FluffyKebab/pearly/storage"
@@ -13,6 +15,8 @@ type options struct {
 	datastore          storage.Hashtable
 	numPeerReturnedSet int
 	numPeerReturnedGet int
+	addrBook           peer.AddrBook
+	addrTTL            time.Duration
 }
 
 func defualtOptions(nodeID []byte) *options {
@@ -21,6 +25,7 @@ func defualtOptions(nodeID []byte) *options {
 		datastore:          storage.NewHashtable(),
 		numPeerReturnedSet: 4,
 		numPeerReturnedGet: 10,
+		addrTTL:            time.Hour,
 	}
 }
 
@@ -47,3 +52,12 @@ func WithNumPeerReturnedGet(num int) Option {
 		o.numPeerReturnedGet = num
 	}
 }
+
+// WithAddrBook makes the DHT add the addresses of the peers it learns about to
+// the address book, where they are valid for ttl.
+func WithAddrBook(book peer.AddrBook, ttl time.Duration) Option {
+	return func(o *options) {
+		o.addrBook = book
+		o.addrTTL = ttl
+	}
+}
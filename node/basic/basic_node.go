@@ -1,49 +1,143 @@
 package basic
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/FluffyKebab/pearly/connmgr"
+	"github.com/FluffyKebab/pearly/event"
+	"github.com/FluffyKebab/pearly/identity"
 	"github.com/FluffyKebab/pearly/node"
 	"github.com/FluffyKebab/pearly/peer"
 	"github.com/FluffyKebab/pearly/protocolmux"
-	"github.com/FluffyKebab/pearly/protocolmux/multistream"
 	"github.com/FluffyKebab/pearly/transport"
 )
 
+var (
+	ErrNodeClosed         = errors.New("node is closed")
+	ErrNoAddrs            = errors.New("no known addresses for peer")
+	ErrPeerNotResolved    = errors.New("unable to resolve and dial peer")
+	ErrRemoteIDMismatch   = errors.New("remote id does not match the dialed id")
+	ErrRemoteIDUnverified = errors.New("transport does not provide remote ids")
+)
+
 type Node struct {
 	id            []byte
+	identity      *identity.Identity
 	transport     transport.Transport
 	protocolMuxer protocolmux.Muxer
 	connHandler   func(transport.Conn) error
+	connManager   *connmgr.Manager
+	addrBook      peer.AddrBook
+	resolvers     []node.Resolver
+	events        *event.Bus
 	errChan       chan error
+
+	protocolsLock      *sync.Mutex
+	protocols          []string
+	protocolsListeners []func([]string)
+
+	middlewareLock      *sync.RWMutex
+	middlewares         []node.Middleware
+	protocolMiddlewares map[string][]node.Middleware
+
+	lock     *sync.Mutex
+	closing  bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conns    map[*trackedConn]struct{}
+	handlers *sync.WaitGroup
+	workers  *sync.WaitGroup
+
+	// done is closed when the node starts closing. It unblocks errors being
+	// sent when no one is reading the error channel.
+	done        chan struct{}
+	errChanLock *sync.RWMutex
+	errChanDone bool
 }
 
 var _ node.Node = &Node{}
 
-func New(t transport.Transport, id []byte) *Node {
+func New(t transport.Transport, id []byte, opts ...Option) *Node {
+	option := defaultOptions()
+	for _, opt := range opts {
+		opt(option)
+	}
+
 	return &Node{
 		id:            id,
 		transport:     t,
-		protocolMuxer: multistream.NewMuxer(),
+		protocolMuxer: option.protocolMuxer,
+		connManager:   option.connManager,
+		addrBook:      option.addrBook,
+		resolvers:     option.resolvers,
+		events:        event.NewBus(),
 		errChan:       make(chan error),
+		lock:          &sync.Mutex{},
+		conns:         make(map[*trackedConn]struct{}),
+		handlers:      &sync.WaitGroup{},
+		workers:       &sync.WaitGroup{},
+		done:          make(chan struct{}),
+		errChanLock:   &sync.RWMutex{},
+		protocolsLock: &sync.Mutex{},
+
+		middlewareLock:      &sync.RWMutex{},
+		protocolMiddlewares: make(map[string][]node.Middleware),
 	}
 }
 
+// NewWithIdentity creates a node with the ID of the identity. The transport
+// should authenticate with the same identity, for example by creating it with
+// encrypted.WithIdentity.
+func NewWithIdentity(t transport.Transport, id *identity.Identity, opts ...Option) *Node {
+	n := New(t, id.ID(), opts...)
+	n.identity = id
+	return n
+}
+
 func (n *Node) Run(ctx context.Context) (<-chan error, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	n.lock.Lock()
+	if n.closing {
+		n.lock.Unlock()
+		cancel()
+		return nil, ErrNodeClosed
+	}
+	n.ctx = ctx
+	n.cancel = cancel
+	n.lock.Unlock()
+
 	connChan, transportErrChan, err := n.transport.Listen(ctx)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closing {
+		cancel()
+		return nil, ErrNodeClosed
+	}
+	n.workers.Add(2)
+	event.Emit(n.events, event.ListenAddrChanged{Addr: n.transport.ListenAddr()})
+
 	go func() {
+		defer n.workers.Done()
 		for {
 			select {
 			case err, ok := <-transportErrChan:
 				if !ok {
 					return
 				}
-				n.errChan <- err
+				n.SendError(err)
 			case <-ctx.Done():
 				return
 			}
@@ -51,10 +145,20 @@ func (n *Node) Run(ctx context.Context) (<-chan error, error) {
 	}()
 
 	go func() {
+		defer n.workers.Done()
 		for {
 			select {
-			case conn := <-connChan:
-				go n.handleConn(conn)
+			case conn, ok := <-connChan:
+				if !ok {
+					return
+				}
+				if n.connManager != nil {
+					if err := n.connManager.AcquireHandshake(ctx); err != nil {
+						conn.Close()
+						return
+					}
+				}
+				n.startHandler(conn)
 			case <-ctx.Done():
 				return
 			}
@@ -64,11 +168,80 @@ func (n *Node) Run(ctx context.Context) (<-chan error, error) {
 	return n.errChan, nil
 }
 
-func (n *Node) handleConn(conn transport.Conn) {
+// Close stops the node from accepting new connections and waits for the
+// active handlers to finish. If ctx is done before all handlers are finished,
+// the connections are closed anyway and the error of the context is returned.
+// All connections tracked by the node are closed and the error channel and
+// event subscriptions are closed before Close returns.
+func (n *Node) Close(ctx context.Context) error {
+	n.lock.Lock()
+	if n.closing {
+		n.lock.Unlock()
+		return ErrNodeClosed
+	}
+	n.closing = true
+	cancel := n.cancel
+	n.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	close(n.done)
+
+	var err error
+	handlersDone := make(chan struct{})
+	go func() {
+		n.handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for handlers: %w", ctx.Err())
+	}
+
+	n.closeConns()
+	n.workers.Wait()
+
+	n.errChanLock.Lock()
+	n.errChanDone = true
+	close(n.errChan)
+	n.errChanLock.Unlock()
+	n.events.Close()
+
+	return err
+}
+
+func (n *Node) startHandler(conn transport.Conn) {
+	n.lock.Lock()
+	if n.closing {
+		n.lock.Unlock()
+		n.releaseHandshake()
+		conn.Close()
+		return
+	}
+	n.handlers.Add(1)
+	tracked := n.trackConn(conn, remoteID(conn), true)
+	tracked.handshakeDone = &sync.Once{}
+	n.lock.Unlock()
+
+	go func() {
+		defer n.handlers.Done()
+		defer tracked.negotiated("")
+		// The connection is not closed, since handlers can keep using it
+		// after they return. It stays tracked until it is closed, so that
+		// Close closes it.
+		n.handleConn(tracked)
+	}()
+}
+
+func (n *Node) handleConn(tracked *trackedConn) {
+	conn := transport.WrapConn(tracked.Conn, tracked)
 	if n.connHandler != nil {
+		protocolNegotiated(conn, "")
 		err := n.connHandler(conn)
 		if err != nil {
-			n.errChan <- err
+			n.sendError(tracked.handlerError(err))
 		}
 
 		return
@@ -76,33 +249,198 @@ func (n *Node) handleConn(conn transport.Conn) {
 
 	err := n.protocolMuxer.HandleConn(conn)
 	if err != nil {
-		n.errChan <- err
+		n.sendError(tracked.handlerError(err))
 	}
 }
 
+// DialPeer dials the peer. If the peer has no address, the addresses of the
+// peer in the address book are tried in order.
 func (n *Node) DialPeer(ctx context.Context, p peer.Peer) (transport.Conn, error) {
-	return n.transport.Dial(ctx, p)
+	c, err := n.dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	peerID := p.ID()
+	if id := remoteID(c); id != nil {
+		peerID = id
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closing {
+		c.Close()
+		return nil, ErrNodeClosed
+	}
+	return transport.WrapConn(c, n.trackConn(c, peerID, false)), nil
 }
 
+func (n *Node) dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
+	if p.PublicAddr() != "" || n.addrBook == nil {
+		c, err := n.transport.Dial(ctx, p)
+		if n.addrBook != nil {
+			n.addrBook.ReportDial(p.ID(), p.PublicAddr(), err)
+		}
+		return c, err
+	}
+
+	addrs := n.addrBook.Addrs(p.ID())
+	if len(addrs) == 0 {
+		return nil, ErrNoAddrs
+	}
+
+	errs := make([]error, 0, len(addrs))
+	for _, addr := range addrs {
+		c, err := n.transport.Dial(ctx, peer.New(p.ID(), addr))
+		n.addrBook.ReportDial(p.ID(), addr, err)
+		if err == nil {
+			return c, nil
+		}
+
+		errs = append(errs, fmt.Errorf("dialing %s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// DialPeerByID resolves the addresses of the peer using the address book and
+// then the other resolvers in order, and returns a connection to the first
+// address where the remote has the given ID.
+func (n *Node) DialPeerByID(ctx context.Context, id []byte) (transport.Conn, error) {
+	errs := make([]error, 0)
+	for _, resolver := range n.allResolvers() {
+		addrs, err := resolver.Resolve(ctx, id)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, addr := range addrs {
+			c, err := n.DialPeer(ctx, peer.New(id, addr))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("dialing %s: %w", addr, err))
+				continue
+			}
+
+			if err := verifyRemoteID(c, id); err != nil {
+				c.Close()
+				errs = append(errs, fmt.Errorf("dialing %s: %w", addr, err))
+				continue
+			}
+			return c, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("%w: [%w]", ErrPeerNotResolved, errors.Join(errs...))
+}
+
+// AddResolver adds a resolver to the end of the resolvers used by
+// DialPeerByID. This makes it possible to use services that need the node,
+// like the DHT, as resolvers.
+func (n *Node) AddResolver(r node.Resolver) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.resolvers = append(n.resolvers, r)
+}
+
+func (n *Node) allResolvers() []node.Resolver {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	resolvers := make([]node.Resolver, 0, len(n.resolvers)+1)
+	if n.addrBook != nil {
+		resolvers = append(resolvers, node.ResolverFunc(func(_ context.Context, id []byte) ([]string, error) {
+			return n.addrBook.Addrs(id), nil
+		}))
+	}
+	return append(resolvers, n.resolvers...)
+}
+
+func verifyRemoteID(c transport.Conn, id []byte) error {
+	ider, ok := c.(transport.RemoteIDHaver)
+	if !ok {
+		return ErrRemoteIDUnverified
+	}
+	if !bytes.Equal(ider.RemoteID(), id) {
+		return ErrRemoteIDMismatch
+	}
+	return nil
+}
+
+// DialPeerUsingProcol dials the peer and selects the protocol.
 func (n *Node) DialPeerUsingProcol(ctx context.Context, prtoID string, p peer.Peer) (transport.Conn, error) {
+	c, _, err := n.DialPeerUsingProtocols(ctx, []string{prtoID}, p)
+	return c, err
+}
+
+// DialPeerUsingProtocols dials the peer and selects the first protocol in
+// protoIDs supported by the peer. The dial is wrapped by the outbound
+// middlewares of all the protocols in protoIDs.
+func (n *Node) DialPeerUsingProtocols(ctx context.Context, protoIDs []string, p peer.Peer) (transport.Conn, string, error) {
+	dial := node.ChainOutbound(n.dialProtocols, n.middlewaresFor(protoIDs...))
+	return dial(ctx, protoIDs, p)
+}
+
+func (n *Node) dialProtocols(ctx context.Context, protoIDs []string, p peer.Peer) (transport.Conn, string, error) {
 	c, err := n.DialPeer(ctx, p)
 	if err != nil {
-		fmt.Println("dail peer using proto failed")
-		return nil, err
+		return nil, "", err
 	}
 
-	err = n.protocolMuxer.SelectProtocol(ctx, prtoID, c)
-	return c, err
+	protoID, err := n.protocolMuxer.SelectOneOf(ctx, protoIDs, c)
+	if err != nil {
+		c.Close()
+		return nil, "", err
+	}
+	protocolNegotiated(c, protoID)
+	return c, protoID, nil
 }
 
+// SendError emits the error as a HandlerError event without a protocol or
+// peer and sends it to the error channel returned by Run. Errors sent after the
+// node has started closing are dropped if no one is reading the channel.
 func (n *Node) SendError(err error) {
-	n.errChan <- err
+	n.sendError(event.HandlerError{Err: err})
+}
+
+func (n *Node) sendError(e event.HandlerError) {
+	event.Emit(n.events, e)
+
+	n.errChanLock.RLock()
+	defer n.errChanLock.RUnlock()
+	if n.errChanDone {
+		return
+	}
+
+	select {
+	case n.errChan <- e.Err:
+	case <-n.done:
+	}
+}
+
+// Events returns the event bus of the node. The subscriptions are closed when
+// the node is closed.
+func (n *Node) Events() *event.Bus {
+	return n.events
 }
 
 func (n *Node) ID() []byte {
 	return n.id
 }
 
+// Identity returns the identity the node was created with, or nil if it was
+// created with New.
+func (n *Node) Identity() *identity.Identity {
+	return n.identity
+}
+
 func (n *Node) Transport() transport.Transport {
 	return n.transport
 }
@@ -112,5 +450,262 @@ func (n *Node) SetConnHandler(handler func(transport.Conn) error) {
 }
 
 func (n *Node) RegisterProtocol(protoID string, handler func(transport.Conn) error) {
-	n.protocolMuxer.RegisterProtocol(protoID, handler)
+	n.HandleProtocol(protoID, func(_ context.Context, s node.Stream) error {
+		return handler(s.Conn)
+	})
+}
+
+// HandleProtocol registers a handler for the protocol. The context given to
+// the handler is cancelled when the node is closed or the deadline of the
+// protocol is exceeded, in which case the stream is also closed.
+//
+// Registering a protocol that is already registered replaces the handler.
+// Streams negotiated after HandleProtocol returns use the new handler.
+func (n *Node) HandleProtocol(protoID string, handler node.StreamHandler, opts ...node.ProtocolOption) {
+	config := node.NewProtocolConfig(opts...)
+
+	n.protocolsLock.Lock()
+	defer n.protocolsLock.Unlock()
+
+	n.protocolMuxer.RegisterProtocol(protoID, func(c transport.Conn) error {
+		protocolNegotiated(c, protoID)
+
+		ctx, cancel := n.handlerContext(config.Deadline)
+		defer cancel()
+		stop := context.AfterFunc(ctx, func() {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				c.Close()
+			}
+		})
+		defer stop()
+
+		h := node.ChainInbound(handler, n.middlewaresFor(protoID))
+		return h(ctx, node.Stream{
+			Conn:       c,
+			ProtocolID: protoID,
+			RemoteID:   remoteID(c),
+			RemoteAddr: remoteAddr(c),
+		})
+	})
+
+	if slices.Contains(n.protocols, protoID) {
+		return
+	}
+	n.protocols = append(n.protocols, protoID)
+	slices.Sort(n.protocols)
+	n.notifyProtocolsChanged()
+}
+
+// RemoveProtocol stops serving the protocol. Handlers of streams that are
+// already negotiated keep running.
+func (n *Node) RemoveProtocol(protoID string) {
+	n.protocolsLock.Lock()
+	defer n.protocolsLock.Unlock()
+
+	n.protocolMuxer.RemoveProtocol(protoID)
+
+	i := slices.Index(n.protocols, protoID)
+	if i == -1 {
+		return
+	}
+	n.protocols = slices.Delete(n.protocols, i, i+1)
+	n.notifyProtocolsChanged()
+}
+
+// notifyProtocolsChanged must be called with the protocols lock held.
+func (n *Node) notifyProtocolsChanged() {
+	for _, listener := range n.protocolsListeners {
+		listener(slices.Clone(n.protocols))
+	}
+}
+
+// Use adds middlewares used for all protocols. Global middlewares wrap the
+// middlewares of the protocol, and middlewares added first are the outermost.
+// Middlewares also apply to protocols registered before they were added.
+func (n *Node) Use(mws ...node.Middleware) {
+	n.middlewareLock.Lock()
+	defer n.middlewareLock.Unlock()
+	n.middlewares = append(n.middlewares, mws...)
+}
+
+// UseForProtocol adds middlewares used only for the protocol.
+func (n *Node) UseForProtocol(protoID string, mws ...node.Middleware) {
+	n.middlewareLock.Lock()
+	defer n.middlewareLock.Unlock()
+	n.protocolMiddlewares[protoID] = append(n.protocolMiddlewares[protoID], mws...)
+}
+
+func (n *Node) middlewaresFor(protoIDs ...string) []node.Middleware {
+	n.middlewareLock.RLock()
+	defer n.middlewareLock.RUnlock()
+
+	mws := slices.Clone(n.middlewares)
+	for i, protoID := range protoIDs {
+		if slices.Contains(protoIDs[:i], protoID) {
+			continue
+		}
+		mws = append(mws, n.protocolMiddlewares[protoID]...)
+	}
+	return mws
+}
+
+// Protocols returns the sorted IDs of the registered protocols.
+func (n *Node) Protocols() []string {
+	n.protocolsLock.Lock()
+	defer n.protocolsLock.Unlock()
+	return slices.Clone(n.protocols)
+}
+
+// NotifyProtocolsChanged calls listener with the new set of protocols every
+// time the registered protocols change. The listener must not block.
+func (n *Node) NotifyProtocolsChanged(listener func(protoIDs []string)) {
+	n.protocolsLock.Lock()
+	defer n.protocolsLock.Unlock()
+	n.protocolsListeners = append(n.protocolsListeners, listener)
+}
+
+// ConnManager returns the connection manager of the node or nil if it does
+// not have one.
+func (n *Node) ConnManager() *connmgr.Manager {
+	return n.connManager
+}
+
+// trackConn must be called with the lock held.
+func (n *Node) trackConn(c transport.Conn, peerID []byte, inbound bool) *trackedConn {
+	tracked := &trackedConn{
+		Conn:        c,
+		node:        n,
+		peerID:      peerID,
+		inbound:     inbound,
+		protocol:    &atomic.Pointer[string]{},
+		once:        &sync.Once{},
+	}
+	if n.connManager != nil {
+		tracked.info = n.connManager.TrackConn(tracked, peerID, inbound)
+	}
+
+	n.conns[tracked] = struct{}{}
+	event.Emit(n.events, event.PeerConnected{
+		PeerID:     peerID,
+		RemoteAddr: remoteAddr(c),
+		Inbound:    inbound,
+	})
+	return tracked
+}
+
+func (n *Node) handlerContext(deadline time.Duration) (context.Context, context.CancelFunc) {
+	n.lock.Lock()
+	ctx := n.ctx
+	n.lock.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if deadline > 0 {
+		return context.WithTimeout(ctx, deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (n *Node) releaseHandshake() {
+	if n.connManager != nil {
+		n.connManager.ReleaseHandshake()
+	}
+}
+
+func (n *Node) closeConns() {
+	n.lock.Lock()
+	conns := make([]*trackedConn, 0, len(n.conns))
+	for c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.lock.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// trackedConn removes itself from the connections tracked by the node when it
+// is closed.
+type trackedConn struct {
+	transport.Conn
+	node     *Node
+	info     *connmgr.ConnInfo
+	peerID   []byte
+	inbound  bool
+	protocol *atomic.Pointer[string]
+	once     *sync.Once
+	err      error
+
+	// handshakeDone is only set for inbound connections.
+	handshakeDone *sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.err = c.Conn.Close()
+
+		c.node.lock.Lock()
+		delete(c.node.conns, c)
+		c.node.lock.Unlock()
+
+		if c.info != nil {
+			c.node.connManager.UntrackConn(c.info)
+		}
+
+		event.Emit(c.node.events, event.PeerDisconnected{
+			PeerID:     c.peerID,
+			RemoteAddr: remoteAddr(c.Conn),
+			Inbound:    c.inbound,
+		})
+	})
+	return c.err
+}
+
+// negotiated records the protocol used by the connection. For inbound
+// connections it also ends the handshake.
+func (c *trackedConn) negotiated(protoID string) {
+	if protoID != "" {
+		c.protocol.Store(&protoID)
+		if c.info != nil {
+			c.info.SetProtocol(protoID)
+		}
+		event.Emit(c.node.events, event.ProtocolNegotiated{
+			PeerID:     c.peerID,
+			ProtocolID: protoID,
+			Inbound:    c.inbound,
+		})
+	}
+	if c.handshakeDone != nil {
+		c.handshakeDone.Do(c.node.releaseHandshake)
+	}
+}
+
+func (c *trackedConn) handlerError(err error) event.HandlerError {
+	e := event.HandlerError{PeerID: c.peerID, Err: err}
+	if protoID := c.protocol.Load(); protoID != nil {
+		e.ProtocolID = *protoID
+	}
+	return e
+}
+
+func protocolNegotiated(c transport.Conn, protoID string) {
+	if tracked, ok := transport.Unwrap(c).(*trackedConn); ok {
+		tracked.negotiated(protoID)
+	}
+}
+
+func remoteID(c transport.Conn) []byte {
+	if ider, ok := c.(transport.RemoteIDHaver); ok {
+		return ider.RemoteID()
+	}
+	return nil
+}
+
+func remoteAddr(c transport.Conn) string {
+	if addrHaver, ok := c.(transport.RemoteAddrHaver); ok {
+		return addrHaver.RemoteAddr()
+	}
+	return ""
 }
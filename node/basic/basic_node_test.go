@@ -2,14 +2,23 @@ package basic
 
 import (
 	"context"
+	"errors"
 	"io"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/FluffyKebab/pearly/connmgr"
+	"github.com/FluffyKebab/pearly/event"
+	"github.com/FluffyKebab/pearly/identity"
+	"github.com/FluffyKebab/pearly/node"
+	"github.com/FluffyKebab/pearly/node/middleware"
 	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/protocolmux/native"
 	"github.com/FluffyKebab/pearly/testutil"
 	"github.com/FluffyKebab/pearly/transport"
+	"github.com/FluffyKebab/pearly/transport/encrypted"
 	"github.com/FluffyKebab/pearly/transport/tcp"
 	"github.com/stretchr/testify/require"
 )
@@ -61,3 +70,538 @@ func TestBesicNode(t *testing.T) {
 	default:
 	}
 }
+
+func TestCloseWaitsForHandlers(t *testing.T) {
+	goroutinesBefore := runtime.NumGoroutine()
+
+	node1, node2 := createNodes(t)
+
+	handlerStarted := make(chan struct{})
+	handlerDone := make(chan struct{})
+	node2.RegisterProtocol("/slow", func(c transport.Conn) error {
+		close(handlerStarted)
+		time.Sleep(100 * time.Millisecond)
+		close(handlerDone)
+		return nil
+	})
+
+	_, err := node1.DialPeerUsingProcol(context.Background(), "/slow", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	<-handlerStarted
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancelCtx()
+	require.NoError(t, node2.Close(ctx))
+
+	select {
+	case <-handlerDone:
+	default:
+		t.Fatal("close returned before the handler was done")
+	}
+
+	require.NoError(t, node1.Close(ctx))
+	require.ErrorIs(t, node1.Close(ctx), ErrNodeClosed)
+	requireNoLeakedGoroutines(t, goroutinesBefore)
+}
+
+func TestCloseDeadline(t *testing.T) {
+	goroutinesBefore := runtime.NumGoroutine()
+
+	node1, node2 := createNodes(t)
+
+	handlerStarted := make(chan struct{})
+	node2.RegisterProtocol("/blocking", func(c transport.Conn) error {
+		close(handlerStarted)
+
+		// Blocks until the connection is closed by the node.
+		_, err := io.Copy(io.Discard, c)
+		return err
+	})
+
+	_, err := node1.DialPeerUsingProcol(context.Background(), "/blocking", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	<-handlerStarted
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelCtx()
+	err = node2.Close(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, node1.Close(context.Background()))
+	requireNoLeakedGoroutines(t, goroutinesBefore)
+}
+
+func TestCloseClosesErrChan(t *testing.T) {
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	n := New(tcp.New(port), nil)
+	errChan, err := n.Run(context.Background())
+	require.NoError(t, err)
+
+	// No one is reading the errors, so this would block without Close.
+	go n.SendError(errors.New("unread error"))
+
+	require.NoError(t, n.Close(context.Background()))
+	for range errChan {
+	}
+
+	_, err = n.Run(context.Background())
+	require.ErrorIs(t, err, ErrNodeClosed)
+}
+
+func createNodes(t *testing.T) (*Node, *Node) {
+	t.Helper()
+
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	node1 := New(tcp.New(port1), nil)
+	node2 := New(tcp.New(port2), nil)
+
+	_, err = node1.Run(context.Background())
+	require.NoError(t, err)
+	_, err = node2.Run(context.Background())
+	require.NoError(t, err)
+
+	return node1, node2
+}
+
+func requireNoLeakedGoroutines(t *testing.T, numBefore int) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for runtime.NumGoroutine() > numBefore {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines were leaked: have %v, had %v", runtime.NumGoroutine(), numBefore)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnManager(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	manager1 := connmgr.New(10, 20)
+	manager2 := connmgr.New(10, 20, connmgr.WithMaxInboundHandshakes(1))
+	node1 := New(tcp.New(port1), nil, WithConnManager(manager1))
+	node2 := New(tcp.New(port2), nil, WithConnManager(manager2))
+
+	_, err = node1.Run(context.Background())
+	require.NoError(t, err)
+	_, err = node2.Run(context.Background())
+	require.NoError(t, err)
+	defer node1.Close(context.Background())
+	defer node2.Close(context.Background())
+
+	handlerCalled := make(chan struct{})
+	finishHandler := make(chan struct{})
+	node2.RegisterProtocol("/test", func(c transport.Conn) error {
+		handlerCalled <- struct{}{}
+		<-finishHandler
+		return nil
+	})
+
+	// Only one handshake is allowed at the time, but the handshake is done
+	// when the protocol is negotiated so both handlers should be called.
+	peer2 := peer.New([]byte("2"), node2.Transport().ListenAddr())
+	conn1, err := node1.DialPeerUsingProcol(context.Background(), "/test", peer2)
+	require.NoError(t, err)
+	<-handlerCalled
+	conn2, err := node1.DialPeerUsingProcol(context.Background(), "/test", peer2)
+	require.NoError(t, err)
+	<-handlerCalled
+
+	require.Equal(t, 2, manager1.NumConnsToPeer([]byte("2")))
+	require.Equal(t, 2, manager1.NumConnsUsingProtocol("/test"))
+	require.Equal(t, 2, manager2.NumConnsUsingProtocol("/test"))
+
+	require.NoError(t, conn1.Close())
+	require.NoError(t, conn2.Close())
+	require.Equal(t, 0, manager1.NumConns())
+
+	// Inbound connections stay tracked after their handler returns, until
+	// they are closed.
+	disconnected := event.Subscribe[event.PeerDisconnected](node2.Events(), 10)
+	close(finishHandler)
+	require.Equal(t, 2, manager2.NumConns())
+	require.NoError(t, node2.Close(context.Background()))
+	for i := 0; i < 2; i++ {
+		require.True(t, (<-disconnected.Events()).Inbound)
+	}
+	require.Equal(t, 0, manager2.NumConns())
+}
+
+func TestCloseClosesConnsOfReturnedHandlers(t *testing.T) {
+	node1, node2 := createNodes(t)
+	defer node1.Close(context.Background())
+
+	// The handler hands the connection to a goroutine and returns.
+	readDone := make(chan error, 1)
+	node2.RegisterProtocol("/test", func(c transport.Conn) error {
+		go func() {
+			_, err := io.Copy(io.Discard, c)
+			readDone <- err
+		}()
+		return nil
+	})
+
+	conn, err := node1.DialPeerUsingProcol(context.Background(), "/test", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	require.NoError(t, node2.Close(context.Background()))
+	select {
+	case <-readDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection of the returned handler was not closed")
+	}
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestDialPeerUsingAddrBook(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	unusedPort, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	book := peer.NewAddrBook()
+	node1 := New(tcp.New(port1), nil, WithAddrBook(book))
+	node2 := New(tcp.New(port2), nil)
+	_, err = node1.Run(context.Background())
+	require.NoError(t, err)
+	_, err = node2.Run(context.Background())
+	require.NoError(t, err)
+	defer node1.Close(context.Background())
+	defer node2.Close(context.Background())
+
+	id := []byte("2")
+	_, err = node1.DialPeer(context.Background(), peer.New(id, ""))
+	require.ErrorIs(t, err, ErrNoAddrs)
+
+	book.AddAddr(id, "localhost:"+unusedPort, time.Hour, peer.SourceManual)
+	book.AddAddr(id, node2.Transport().ListenAddr(), time.Hour, peer.SourceDHT)
+
+	conn, err := node1.DialPeer(context.Background(), peer.New(id, ""))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// The address that worked is tried first next time.
+	require.Equal(t, []string{node2.Transport().ListenAddr(), "localhost:" + unusedPort}, book.Addrs(id))
+}
+
+func TestDialPeerByID(t *testing.T) {
+	createEncryptedNode := func() *Node {
+		port, err := testutil.GetAvailablePort()
+		require.NoError(t, err)
+
+		transport, err := encrypted.NewTransport(tcp.New(port))
+		require.NoError(t, err)
+
+		n := New(transport, transport.ID(), WithAddrBook(peer.NewAddrBook()))
+		_, err = n.Run(context.Background())
+		require.NoError(t, err)
+		t.Cleanup(func() { n.Close(context.Background()) })
+		return n
+	}
+
+	node1 := createEncryptedNode()
+	node2 := createEncryptedNode()
+	node3 := createEncryptedNode()
+
+	resolved := make(map[string]string)
+	node1.AddResolver(node.ResolverFunc(func(_ context.Context, id []byte) ([]string, error) {
+		addr, ok := resolved[string(id)]
+		if !ok {
+			return nil, errors.New("unknown peer")
+		}
+		return []string{addr}, nil
+	}))
+
+	_, err := node1.DialPeerByID(context.Background(), node2.ID())
+	require.ErrorIs(t, err, ErrPeerNotResolved)
+
+	resolved[string(node2.ID())] = node2.Transport().ListenAddr()
+	conn, err := node1.DialPeerByID(context.Background(), node2.ID())
+	require.NoError(t, err)
+	require.Equal(t, node2.ID(), conn.(transport.RemoteIDHaver).RemoteID())
+	require.NoError(t, conn.Close())
+
+	// The address of node 3 is returned when resolving node 2, but the dial
+	// fails since the remote has the wrong id, which the encrypted transport
+	// finds before the node does.
+	resolved[string(node2.ID())] = node3.Transport().ListenAddr()
+	_, err = node1.DialPeerByID(context.Background(), node2.ID())
+	require.ErrorIs(t, err, ErrPeerNotResolved)
+	require.ErrorIs(t, err, encrypted.ErrPeerIDMismatch)
+}
+
+func TestEvents(t *testing.T) {
+	node1, node2 := createNodes(t)
+	defer node1.Close(context.Background())
+
+	connected := event.Subscribe[event.PeerConnected](node2.Events(), 10)
+	disconnected := event.Subscribe[event.PeerDisconnected](node2.Events(), 10)
+	negotiated := event.Subscribe[event.ProtocolNegotiated](node2.Events(), 10)
+	handlerErrors := event.Subscribe[event.HandlerError](node2.Events(), 10)
+
+	handlerErr := errors.New("handler failed")
+	node2.RegisterProtocol("/fail", func(c transport.Conn) error {
+		defer c.Close()
+		return handlerErr
+	})
+
+	_, err := node1.DialPeerUsingProcol(context.Background(), "/fail", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+
+	require.True(t, (<-connected.Events()).Inbound)
+	require.Equal(t, event.ProtocolNegotiated{ProtocolID: "/fail", Inbound: true}, <-negotiated.Events())
+	e := <-handlerErrors.Events()
+	require.Equal(t, "/fail", e.ProtocolID)
+	require.ErrorIs(t, e.Err, handlerErr)
+	require.True(t, (<-disconnected.Events()).Inbound)
+
+	// No one reads the error channel, so SendError blocks after emitting.
+	go node2.SendError(handlerErr)
+	require.Equal(t, event.HandlerError{Err: handlerErr}, <-handlerErrors.Events())
+
+	require.NoError(t, node2.Close(context.Background()))
+	_, ok := <-connected.Events()
+	require.False(t, ok)
+}
+
+func TestHandleProtocol(t *testing.T) {
+	node1, node2 := createNodes(t)
+	defer node1.Close(context.Background())
+
+	streams := make(chan node.Stream, 1)
+	node2.HandleProtocol("/wait", func(ctx context.Context, s node.Stream) error {
+		streams <- s
+		<-ctx.Done()
+		return nil
+	})
+
+	ctxErrs := make(chan error, 1)
+	node2.HandleProtocol("/deadline", func(ctx context.Context, s node.Stream) error {
+		// Blocks until the stream is closed when the deadline is exceeded.
+		io.Copy(io.Discard, s)
+		ctxErrs <- ctx.Err()
+		return nil
+	}, node.WithDeadline(50*time.Millisecond))
+
+	conn, err := node1.DialPeerUsingProcol(context.Background(), "/deadline", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case err := <-ctxErrs:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(3 * time.Second):
+		t.Fatal("deadline was not enforced")
+	}
+
+	conn, err = node1.DialPeerUsingProcol(context.Background(), "/wait", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	s := <-streams
+	require.Equal(t, "/wait", s.ProtocolID)
+	require.NotEmpty(t, s.RemoteAddr)
+	require.Nil(t, s.RemoteID)
+
+	// The handler returns when the node is closed.
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancelCtx()
+	require.NoError(t, node2.Close(ctx))
+}
+
+func TestMiddleware(t *testing.T) {
+	node1, node2 := createNodes(t)
+	defer node1.Close(context.Background())
+	defer node2.Close(context.Background())
+
+	calls := make(chan string, 10)
+	record := func(name string) node.Middleware {
+		return node.Middleware{
+			Inbound: func(next node.StreamHandler) node.StreamHandler {
+				return func(ctx context.Context, s node.Stream) error {
+					calls <- name
+					return next(ctx, s)
+				}
+			},
+			Outbound: func(next node.StreamDialer) node.StreamDialer {
+				return func(ctx context.Context, protoIDs []string, p peer.Peer) (transport.Conn, string, error) {
+					calls <- name + " " + strings.Join(protoIDs, ",")
+					return next(ctx, protoIDs, p)
+				}
+			},
+		}
+	}
+
+	handlerErrors := event.Subscribe[event.HandlerError](node2.Events(), 10)
+	node2.RegisterProtocol("/test", func(c transport.Conn) error {
+		calls <- "handler"
+		panic("handler failed")
+	})
+	node2.Use(middleware.Recover(), record("global"))
+	node2.UseForProtocol("/test", record("protocol"))
+	node2.UseForProtocol("/other", record("other"))
+	node1.UseForProtocol("/test", record("outbound"))
+
+	conn, err := node1.DialPeerUsingProcol(context.Background(), "/test", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Equal(t, "outbound /test", <-calls)
+	require.Equal(t, "global", <-calls)
+	require.Equal(t, "protocol", <-calls)
+	require.Equal(t, "handler", <-calls)
+
+	e := <-handlerErrors.Events()
+	require.Equal(t, "/test", e.ProtocolID)
+	require.ErrorIs(t, e.Err, middleware.ErrPanic)
+}
+
+func TestNativeProtocolMuxer(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	node1 := New(tcp.New(port1), nil, WithProtocolMuxer(native.NewMuxer()))
+	node2 := New(tcp.New(port2), nil, WithProtocolMuxer(native.NewMuxer()))
+	_, err = node1.Run(context.Background())
+	require.NoError(t, err)
+	_, err = node2.Run(context.Background())
+	require.NoError(t, err)
+	defer node1.Close(context.Background())
+	defer node2.Close(context.Background())
+
+	node2.RegisterProtocol("/echo/1.1.0", func(c transport.Conn) error {
+		_, err := io.Copy(c, c)
+		return err
+	})
+
+	conn, err := node1.DialPeerUsingProcol(context.Background(), "/echo/^1.0", peer.New(nil, node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestDialPeerUsingProtocols(t *testing.T) {
+	node1, node2 := createNodes(t)
+	defer node1.Close(context.Background())
+	defer node2.Close(context.Background())
+
+	selected := make(chan string, 1)
+	node.HandleVersions(node2, []string{"/test/1.0.0", "/test/2.0.0"}, func(ctx context.Context, s node.Stream) error {
+		selected <- s.ProtocolID
+		return nil
+	})
+
+	conn, protoID, err := node1.DialPeerUsingProtocols(
+		context.Background(),
+		[]string{"/test/3.0.0", "/test/2.0.0", "/test/1.0.0"},
+		peer.New(nil, node2.Transport().ListenAddr()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "/test/2.0.0", protoID)
+	require.Equal(t, "/test/2.0.0", <-selected)
+}
+
+func TestRemoveProtocol(t *testing.T) {
+	node1, node2 := createNodes(t)
+	defer node1.Close(context.Background())
+	defer node2.Close(context.Background())
+
+	changes := make(chan []string, 10)
+	node2.NotifyProtocolsChanged(func(protoIDs []string) {
+		changes <- protoIDs
+	})
+
+	handled := make(chan string, 1)
+	register := func(name string) {
+		node2.RegisterProtocol("/test", func(c transport.Conn) error {
+			handled <- name
+			return c.Close()
+		})
+	}
+	dial := func() error {
+		conn, err := node1.DialPeerUsingProcol(context.Background(), "/test", peer.New(nil, node2.Transport().ListenAddr()))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	register("first")
+	require.Equal(t, []string{"/test"}, <-changes)
+	require.NoError(t, dial())
+	require.Equal(t, "first", <-handled)
+
+	// Replacing the handler does not change the protocols.
+	register("second")
+	require.NoError(t, dial())
+	require.Equal(t, "second", <-handled)
+	require.Empty(t, changes)
+
+	node2.RemoveProtocol("/test")
+	require.Empty(t, <-changes)
+	require.Empty(t, node2.Protocols())
+	require.Error(t, dial())
+}
+
+func TestNewWithIdentity(t *testing.T) {
+	id, err := identity.Generate(identity.Ed25519)
+	require.NoError(t, err)
+
+	createNode := func() *Node {
+		port, err := testutil.GetAvailablePort()
+		require.NoError(t, err)
+		transport, err := encrypted.NewTransport(tcp.New(port), encrypted.WithIdentity(id))
+		require.NoError(t, err)
+
+		n := NewWithIdentity(transport, id)
+		_, err = n.Run(context.Background())
+		require.NoError(t, err)
+		return n
+	}
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	transport, err := encrypted.NewTransport(tcp.New(port))
+	require.NoError(t, err)
+	dialer := New(transport, transport.ID())
+	_, err = dialer.Run(context.Background())
+	require.NoError(t, err)
+	defer dialer.Close(context.Background())
+
+	// A node restarted with the same identity keeps its ID, so it can still be
+	// dialed by it.
+	for i := 0; i < 2; i++ {
+		n := createNode()
+		require.Equal(t, id.ID(), n.ID())
+		require.Equal(t, id, n.Identity())
+
+		conn, err := dialer.DialPeer(context.Background(), peer.New(id.ID(), n.Transport().ListenAddr()))
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		require.NoError(t, n.Close(context.Background()))
+	}
+}
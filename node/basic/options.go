@@ -0,0 +1,58 @@
+package basic
+
+import (
+	"github.com/FluffyKebab/pearly/connmgr"
+	"github.com/FluffyKebab/pearly/node"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/protocolmux"
+	"github.com/FluffyKebab/pearly/protocolmux/multistream"
+)
+
+type Option func(*options)
+
+type options struct {
+	connManager   *connmgr.Manager
+	addrBook      peer.AddrBook
+	resolvers     []node.Resolver
+	protocolMuxer protocolmux.Muxer
+}
+
+func defaultOptions() *options {
+	return &options{
+		protocolMuxer: multistream.NewMuxer(),
+	}
+}
+
+// WithConnManager makes the node track all its connections in the
+// connection manager and limits the number of concurrent inbound protocol
+// negotiations.
+func WithConnManager(m *connmgr.Manager) Option {
+	return func(o *options) {
+		o.connManager = m
+	}
+}
+
+// WithAddrBook makes the node look up the addresses of peers dialed without
+// an address in the address book. The address book is also used as the first
+// resolver by DialPeerByID.
+func WithAddrBook(b peer.AddrBook) Option {
+	return func(o *options) {
+		o.addrBook = b
+	}
+}
+
+// WithResolvers sets the resolvers used by DialPeerByID after the address
+// book.
+func WithResolvers(resolvers ...node.Resolver) Option {
+	return func(o *options) {
+		o.resolvers = append(o.resolvers, resolvers...)
+	}
+}
+
+// WithProtocolMuxer sets the muxer used to negotiate protocols. The default
+// is the multistream muxer.
+func WithProtocolMuxer(m protocolmux.Muxer) Option {
+	return func(o *options) {
+		o.protocolMuxer = m
+	}
+}
@@ -0,0 +1,55 @@
+package node
+
+import (
+	"context"
+	"time"
+
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+// Stream is a connection where a protocol has been negotiated. RemoteID and
+// RemoteAddr are empty if the transport does not provide them.
+type Stream struct {
+	transport.Conn
+	ProtocolID string
+	RemoteID   []byte
+	RemoteAddr string
+}
+
+// StreamHandler handles an inbound stream. The context is cancelled when the
+// node shuts down or the deadline of the protocol is exceeded.
+type StreamHandler func(ctx context.Context, s Stream) error
+
+// HandleVersions registers the handler for every protocol ID, which makes it
+// possible to support several versions of a protocol with one handler. The
+// selected version is the ProtocolID of the stream.
+func HandleVersions(n Node, protoIDs []string, handler StreamHandler, opts ...ProtocolOption) {
+	for _, protoID := range protoIDs {
+		n.HandleProtocol(protoID, handler, opts...)
+	}
+}
+
+type ProtocolOption func(*ProtocolConfig)
+
+// ProtocolConfig is the configuration of a protocol registered with
+// HandleProtocol.
+type ProtocolConfig struct {
+	// Deadline is the maximum time a handler can run. When it is exceeded the
+	// context of the handler is cancelled and the stream is closed. Zero means
+	// no deadline.
+	Deadline time.Duration
+}
+
+func WithDeadline(d time.Duration) ProtocolOption {
+	return func(c *ProtocolConfig) {
+		c.Deadline = d
+	}
+}
+
+func NewProtocolConfig(opts ...ProtocolOption) ProtocolConfig {
+	var config ProtocolConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
@@ -0,0 +1,41 @@
+package node
+
+import (
+	"context"
+
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+// StreamDialer opens an outbound stream to the peer using the first protocol
+// in protoIDs supported by the peer, and returns the selected protocol.
+type StreamDialer func(ctx context.Context, protoIDs []string, p peer.Peer) (transport.Conn, string, error)
+
+// Middleware wraps inbound stream handlers and outbound stream dialers. Either
+// field can be nil if the middleware only applies to one direction.
+type Middleware struct {
+	Inbound  func(next StreamHandler) StreamHandler
+	Outbound func(next StreamDialer) StreamDialer
+}
+
+// ChainInbound wraps the handler with the inbound middlewares. The first
+// middleware is the outermost.
+func ChainInbound(h StreamHandler, mws []Middleware) StreamHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i].Inbound != nil {
+			h = mws[i].Inbound(h)
+		}
+	}
+	return h
+}
+
+// ChainOutbound wraps the dialer with the outbound middlewares. The first
+// middleware is the outermost.
+func ChainOutbound(d StreamDialer, mws []Middleware) StreamDialer {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i].Outbound != nil {
+			d = mws[i].Outbound(d)
+		}
+	}
+	return d
+}
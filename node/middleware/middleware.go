@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/FluffyKebab/pearly/node"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+var (
+	ErrPanic       = errors.New("handler panicked")
+	ErrRateLimited = errors.New("peer is rate limited")
+)
+
+// _maxIdleLimiters is the number of peers tracked by the rate limiter before
+// peers with full buckets are forgotten.
+const _maxIdleLimiters = 1024
+
+// Recover turns panics in inbound handlers and outbound dialers into errors
+// wrapping ErrPanic. The stream is closed if a handler panics.
+func Recover() node.Middleware {
+	return node.Middleware{
+		Inbound: func(next node.StreamHandler) node.StreamHandler {
+			return func(ctx context.Context, s node.Stream) (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						s.Close()
+						err = fmt.Errorf("%w: %v\n%s", ErrPanic, r, debug.Stack())
+					}
+				}()
+				return next(ctx, s)
+			}
+		},
+		Outbound: func(next node.StreamDialer) node.StreamDialer {
+			return func(ctx context.Context, protoIDs []string, p peer.Peer) (c transport.Conn, protoID string, err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						c, protoID = nil, ""
+						err = fmt.Errorf("%w: %v\n%s", ErrPanic, r, debug.Stack())
+					}
+				}()
+				return next(ctx, protoIDs, p)
+			}
+		},
+	}
+}
+
+// RateLimit limits the number of inbound streams each peer can open to rate
+// per second, with bursts of up to burst streams. Peers are identified by
+// their ID, or by the host of their address if the transport does not provide
+// IDs.
+// Streams over the limit are closed and ErrRateLimited is returned.
+func RateLimit(rate float64, burst int) node.Middleware {
+	l := &limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		lock:    &sync.Mutex{},
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+
+	return node.Middleware{
+		Inbound: func(next node.StreamHandler) node.StreamHandler {
+			return func(ctx context.Context, s node.Stream) error {
+				if !l.allow(limitKey(s)) {
+					s.Close()
+					return fmt.Errorf("%w: %s", ErrRateLimited, s.ProtocolID)
+				}
+				return next(ctx, s)
+			}
+		},
+	}
+}
+
+// limitKey returns the key of the bucket of the peer of s. The port of the
+// address is left out, since it changes for every connection.
+func limitKey(s node.Stream) string {
+	if len(s.RemoteID) > 0 {
+		return "id:" + string(s.RemoteID)
+	}
+	host, _, err := net.SplitHostPort(s.RemoteAddr)
+	if err != nil {
+		return "addr:" + s.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type limiter struct {
+	rate  float64
+	burst float64
+
+	lock    *sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func (l *limiter) allow(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	if len(l.buckets) >= _maxIdleLimiters {
+		l.forgetFull(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	return min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+}
+
+// forgetFull must be called with the lock held.
+func (l *limiter) forgetFull(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
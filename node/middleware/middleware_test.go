@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/node"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/stretchr/testify/require"
+)
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func TestRecover(t *testing.T) {
+	handler := node.ChainInbound(func(context.Context, node.Stream) error {
+		panic("inbound")
+	}, []node.Middleware{Recover()})
+	s := node.Stream{Conn: transport.NewConn(nil, nil, nopCloser{})}
+	require.ErrorIs(t, handler(context.Background(), s), ErrPanic)
+
+	dial := node.ChainOutbound(func(context.Context, []string, peer.Peer) (transport.Conn, string, error) {
+		panic("outbound")
+	}, []node.Middleware{Recover()})
+	_, _, err := dial(context.Background(), []string{"/test"}, peer.New(nil, ""))
+	require.ErrorIs(t, err, ErrPanic)
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Now()
+	l := &limiter{
+		rate:    1,
+		burst:   2,
+		lock:    &sync.Mutex{},
+		buckets: make(map[string]*bucket),
+		now:     func() time.Time { return now },
+	}
+
+	require.True(t, l.allow("1"))
+	require.True(t, l.allow("1"))
+	require.False(t, l.allow("1"))
+	require.True(t, l.allow("2"))
+
+	now = now.Add(time.Second)
+	require.True(t, l.allow("1"))
+	require.False(t, l.allow("1"))
+
+	now = now.Add(time.Hour)
+	l.forgetFull(now)
+	require.Empty(t, l.buckets)
+
+	handler := node.ChainInbound(func(context.Context, node.Stream) error {
+		return nil
+	}, []node.Middleware{RateLimit(0, 1)})
+	s := node.Stream{Conn: transport.NewConn(nil, nil, nopCloser{}), RemoteAddr: "10.0.0.1:4001"}
+	require.NoError(t, handler(context.Background(), s))
+
+	// Connections from other ports of the same host share the limit.
+	s.RemoteAddr = "10.0.0.1:4002"
+	require.ErrorIs(t, handler(context.Background(), s), ErrRateLimited)
+	s.RemoteAddr = "10.0.0.2:4001"
+	require.NoError(t, handler(context.Background(), s))
+}
@@ -3,6 +3,7 @@ package node
 import (
 	"context"
 
+	"github.com/FluffyKebab/pearly/event"
 	"github.com/FluffyKebab/pearly/peer"
 	"github.com/FluffyKebab/pearly/transport"
 )
@@ -11,9 +12,30 @@ type Node interface {
 	ID() []byte
 	Transport() transport.Transport
 	Run(context.Context) (<-chan error, error)
+	Close(context.Context) error
 	SetConnHandler(handler func(transport.Conn) error)
 	RegisterProtocol(protoID string, handler func(transport.Conn) error)
+	HandleProtocol(protoID string, handler StreamHandler, opts ...ProtocolOption)
+	RemoveProtocol(protoID string)
+	Use(mws ...Middleware)
+	UseForProtocol(protoID string, mws ...Middleware)
+	Protocols() []string
+	NotifyProtocolsChanged(func(protoIDs []string))
 	DialPeer(ctx context.Context, p peer.Peer) (transport.Conn, error)
+	DialPeerByID(ctx context.Context, id []byte) (transport.Conn, error)
 	DialPeerUsingProcol(ctx context.Context, prtoID string, p peer.Peer) (transport.Conn, error)
+	DialPeerUsingProtocols(ctx context.Context, protoIDs []string, p peer.Peer) (transport.Conn, string, error)
 	SendError(err error)
+	Events() *event.Bus
+}
+
+// Resolver finds the addresses of a peer from its ID.
+type Resolver interface {
+	Resolve(ctx context.Context, id []byte) ([]string, error)
+}
+
+type ResolverFunc func(ctx context.Context, id []byte) ([]string, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, id []byte) ([]string, error) {
+	return f(ctx, id)
 }
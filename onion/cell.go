@@ -0,0 +1,156 @@
+package onion
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// CellSize is the size of every cell sent on a circuit.
+	CellSize        = 512
+	_cellHeaderSize = 5
+	// MaxCellPayload is the maximum size of the payload of a cell.
+	MaxCellPayload = CellSize - _cellHeaderSize
+)
+
+var (
+	ErrCellTooLarge   = errors.New("cell payload is too large")
+	ErrInvalidCell    = errors.New("invalid cell")
+	ErrCircuitClosed  = errors.New("circuit closed")
+	ErrStreamClosed   = errors.New("stream closed")
+	ErrUnexpectedCell = errors.New("unexpected cell")
+	ErrWindowExceeded = errors.New("remote exceeded the stream window")
+)
+
+// CellCommand is the first byte of a cell and tells the receiver what to do
+// with the payload.
+type CellCommand byte
+
+const (
+	// CellData carries data of a stream through the circuit.
+	CellData CellCommand = iota + 1
+	// CellEnd closes a stream, or tears down the circuit if the stream ID is
+	// zero. The payload is the reason, if any.
+	CellEnd
+	// CellExtend asks the last relay of the circuit to send the request in the
+	// payload to the next node, making it part of the circuit.
+	CellExtend
+	// CellExtended is the response to CellExtend.
+	CellExtended
+	// CellPadding is dropped by the receiver.
+	CellPadding
+	// CellBegin asks the exit relay to open a stream to the address in the
+	// payload.
+	CellBegin
+	// CellConnected is the response to CellBegin when the stream is open.
+	CellConnected
+	// CellSendme tells the sender of the DATA cells of a stream that
+	// _sendmeIncrement more of them are delivered, so it may send as many
+	// more.
+	CellSendme
+)
+
+const (
+	// _streamWindow is the number of DATA cells of a stream that may be sent
+	// before they are acknowledged with SENDME cells. The receiver never
+	// buffers more cells than this for a stream.
+	_streamWindow = 500
+	// _sendmeIncrement is the number of DATA cells a SENDME cell
+	// acknowledges.
+	_sendmeIncrement = 50
+)
+
+func (c CellCommand) String() string {
+	switch c {
+	case CellData:
+		return "DATA"
+	case CellEnd:
+		return "END"
+	case CellExtend:
+		return "EXTEND"
+	case CellExtended:
+		return "EXTENDED"
+	case CellPadding:
+		return "PADDING"
+	case CellBegin:
+		return "BEGIN"
+	case CellConnected:
+		return "CONNECTED"
+	case CellSendme:
+		return "SENDME"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Cell is the unit sent on circuits. On the wire a cell is always CellSize
+// bytes: the command, the stream ID and the length of the payload as
+// big-endian uint16s, the payload and zeros, so the size of the data sent is
+// hidden. Every hop wraps the cells in its own framing, so all frames sent on
+// one link of a circuit have the same size, but the size differs between
+// links.
+type Cell struct {
+	Command CellCommand
+	// StreamID is the stream of the circuit the cell belongs to. Zero is used
+	// for cells that belong to the circuit itself.
+	StreamID uint16
+	Payload  []byte
+}
+
+func (c Cell) Marshal() ([]byte, error) {
+	if len(c.Payload) > MaxCellPayload {
+		return nil, fmt.Errorf("%w: %v bytes", ErrCellTooLarge, len(c.Payload))
+	}
+
+	data := make([]byte, CellSize)
+	data[0] = byte(c.Command)
+	binary.BigEndian.PutUint16(data[1:3], c.StreamID)
+	binary.BigEndian.PutUint16(data[3:_cellHeaderSize], uint16(len(c.Payload)))
+	copy(data[_cellHeaderSize:], c.Payload)
+	return data, nil
+}
+
+func UnmarshalCell(data []byte) (Cell, error) {
+	if len(data) != CellSize {
+		return Cell{}, fmt.Errorf("%w: size is %v", ErrInvalidCell, len(data))
+	}
+
+	size := int(binary.BigEndian.Uint16(data[3:_cellHeaderSize]))
+	if size > MaxCellPayload {
+		return Cell{}, fmt.Errorf("%w: payload size is %v", ErrInvalidCell, size)
+	}
+	return Cell{
+		Command:  CellCommand(data[0]),
+		StreamID: binary.BigEndian.Uint16(data[1:3]),
+		Payload:  data[_cellHeaderSize : _cellHeaderSize+size],
+	}, nil
+}
+
+// writeCell writes the cell with a single call to Write, so that a stream
+// encrypting each write sends it as one frame.
+func writeCell(w io.Writer, c Cell) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readCell(r io.Reader) (Cell, error) {
+	data := make([]byte, CellSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Cell{}, err
+	}
+	return UnmarshalCell(data)
+}
+
+// endReason returns err with the reason sent in the END cell, if any.
+func endReason(err error, c Cell) error {
+	if len(c.Payload) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, c.Payload)
+}
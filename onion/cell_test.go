@@ -0,0 +1,187 @@
+package onion
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/protocolmux/multistream"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCell(t *testing.T) {
+	for _, payload := range [][]byte{nil, []byte("data"), bytes.Repeat([]byte{1}, MaxCellPayload)} {
+		data, err := Cell{Command: CellData, StreamID: 7, Payload: payload}.Marshal()
+		require.NoError(t, err)
+		require.Len(t, data, CellSize)
+
+		cell, err := UnmarshalCell(data)
+		require.NoError(t, err)
+		require.Equal(t, CellData, cell.Command)
+		require.Equal(t, uint16(7), cell.StreamID)
+		require.Equal(t, len(payload), len(cell.Payload))
+		require.True(t, bytes.Equal(payload, cell.Payload))
+	}
+
+	_, err := Cell{Command: CellData, Payload: make([]byte, MaxCellPayload+1)}.Marshal()
+	require.ErrorIs(t, err, ErrCellTooLarge)
+
+	_, err = UnmarshalCell(make([]byte, CellSize-1))
+	require.ErrorIs(t, err, ErrInvalidCell)
+}
+
+func TestCircuitFramesHaveSameSize(t *testing.T) {
+	// Every relay records what it writes to the previous and the next node.
+	relays := make([]peer.Peer, 0)
+	relayTransports := make([]*recordingTransport, 0)
+	for i := 0; i < 3; i++ {
+		port, err := testutil.GetAvailablePort()
+		require.NoError(t, err)
+		tr := newRecordingTransport(tcp.New(port))
+		relay, service := startRelay(t, tr, false)
+		service.PaddingInterval = 5 * time.Millisecond
+		relays = append(relays, relay)
+		relayTransports = append(relayTransports, tr)
+	}
+
+	clientPort, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	clientTransport := newRecordingTransport(tcp.New(clientPort))
+	client := NewClient(multistream.NewMuxer(), clientTransport)
+	client.PaddingInterval = 5 * time.Millisecond
+
+	peers := append(relays, startFinalNode(t, func(c transport.Conn) error {
+		_, err := io.Copy(c, c)
+		return err
+	}))
+	conn, _, err := client.EstablishCircuit(context.Background(), peers)
+	require.NoError(t, err)
+	clientTransport.reset()
+	for _, tr := range relayTransports {
+		tr.reset()
+	}
+
+	for _, size := range []int{1, 100, MaxCellPayload + 1, 5000} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		_, err := conn.Write(msg)
+		require.NoError(t, err)
+
+		received := make([]byte, size)
+		_, err = io.ReadFull(conn, received)
+		require.NoError(t, err)
+		require.Equal(t, msg, received)
+	}
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, conn.Close())
+
+	// Each hop adds its own framing, so the frames only have the same size on
+	// each link and in each direction. The exit writes the plain data of the
+	// stream to the destination, so its dialed connections are not checked.
+	requireSameSize(t, clientTransport.writeSizes(true))
+	for i, tr := range relayTransports {
+		requireSameSize(t, tr.writeSizes(false))
+		if i < len(relayTransports)-1 {
+			requireSameSize(t, tr.writeSizes(true))
+		}
+	}
+}
+
+func requireSameSize(t *testing.T, sizes []int) {
+	t.Helper()
+
+	require.NotEmpty(t, sizes)
+	for _, size := range sizes {
+		require.Equal(t, sizes[0], size)
+	}
+}
+
+// recordingTransport records the size of every write to its dialed and
+// accepted connections.
+type recordingTransport struct {
+	transport.Transport
+	lock        *sync.Mutex
+	dialSizes   []int
+	listenSizes []int
+}
+
+func newRecordingTransport(underlying transport.Transport) *recordingTransport {
+	return &recordingTransport{Transport: underlying, lock: &sync.Mutex{}}
+}
+
+func (t *recordingTransport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
+	c, err := t.Transport.Dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(c, &t.dialSizes), nil
+}
+
+func (t *recordingTransport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
+	conns, errs, err := t.Transport.Listen(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped := make(chan transport.Conn)
+	go func() {
+		for c := range conns {
+			wrapped <- t.wrap(c, &t.listenSizes)
+		}
+	}()
+	return wrapped, errs, nil
+}
+
+func (t *recordingTransport) wrap(c transport.Conn, sizes *[]int) transport.Conn {
+	return transport.WrapConn(c, transport.NewConn(c, writerFunc(func(p []byte) (int, error) {
+		t.lock.Lock()
+		*sizes = append(*sizes, len(p))
+		t.lock.Unlock()
+		return c.Write(p)
+	}), c))
+}
+
+func (t *recordingTransport) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.dialSizes = nil
+	t.listenSizes = nil
+}
+
+func (t *recordingTransport) writeSizes(dialed bool) []int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if dialed {
+		return append([]int{}, t.dialSizes...)
+	}
+	return append([]int{}, t.listenSizes...)
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestCircuitTeardown(t *testing.T) {
+	peers := append(startRelays(t, 3, false), startFinalNode(t, func(c transport.Conn) error {
+		_, err := c.Write([]byte("bye"))
+		c.Close()
+		return err
+	}))
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	conn, _, err := client.EstablishCircuit(context.Background(), peers)
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "bye", string(data))
+	require.NoError(t, conn.Close())
+}
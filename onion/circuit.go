@@ -0,0 +1,420 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+var ErrTooManyStreams = errors.New("no free stream IDs on circuit")
+
+// Circuit is a circuit through onion relays. Streams to any address are opened
+// on the circuit with OpenStream, and the exit relay of the circuit connects
+// to the address.
+type Circuit struct {
+	stream io.ReadWriter
+	closer io.Closer
+
+	lock         *sync.Mutex
+	streams      map[uint16]*Stream
+	nextStreamID uint16
+	err          error
+
+	closeOnce *sync.Once
+	done      chan struct{}
+}
+
+// newCircuit creates a circuit sending cells on stream, which is the stream of
+// the exit relay. If paddingInterval is positive a PADDING cell is sent every
+// interval.
+func newCircuit(stream io.ReadWriter, closer io.Closer, paddingInterval time.Duration) *Circuit {
+	c := &Circuit{
+		stream:       stream,
+		closer:       closer,
+		lock:         &sync.Mutex{},
+		streams:      make(map[uint16]*Stream),
+		nextStreamID: 1,
+		closeOnce:    &sync.Once{},
+		done:         make(chan struct{}),
+	}
+	if paddingInterval > 0 {
+		go sendPadding(stream, paddingInterval, c.done)
+	}
+	go c.readCells()
+	return c
+}
+
+// OpenStream asks the exit relay to connect to addr and returns the stream
+// when the connection is made.
+func (c *Circuit) OpenStream(ctx context.Context, addr string) (*Stream, error) {
+	s, err := c.newStream(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.writeCell(Cell{Command: CellBegin, StreamID: s.id, Payload: []byte(addr)})
+	if err != nil {
+		c.removeStream(s.id)
+		return nil, err
+	}
+
+	select {
+	case err := <-s.connected:
+		if err != nil {
+			c.removeStream(s.id)
+			return nil, err
+		}
+		return s, nil
+	case <-ctx.Done():
+		s.Close()
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.closeErr()
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (c *Circuit) NumStreams() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.streams)
+}
+
+// Done returns a channel that is closed when the circuit is torn down.
+func (c *Circuit) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close tears down the circuit with an END cell, closing all streams.
+func (c *Circuit) Close() error {
+	return c.shutdown(nil, true)
+}
+
+func (c *Circuit) newStream(addr string) (*Stream, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	if len(c.streams) >= math.MaxUint16 {
+		return nil, ErrTooManyStreams
+	}
+
+	// Zero is the ID of the circuit itself.
+	for c.streams[c.nextStreamID] != nil || c.nextStreamID == 0 {
+		c.nextStreamID++
+	}
+	s := newStream(c, c.nextStreamID, addr)
+	c.streams[s.id] = s
+	c.nextStreamID++
+	return s, nil
+}
+
+func (c *Circuit) getStream(id uint16) *Stream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.streams[id]
+}
+
+func (c *Circuit) removeStream(id uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.streams, id)
+}
+
+func (c *Circuit) writeCell(cell Cell) error {
+	select {
+	case <-c.done:
+		return c.closeErr()
+	default:
+	}
+	return writeCell(c.stream, cell)
+}
+
+// readCells reads the cells sent by the exit relay and passes them to the
+// streams until the circuit is torn down.
+func (c *Circuit) readCells() {
+	for {
+		cell, err := readNonPaddingCell(c.stream)
+		if err != nil {
+			c.shutdown(err, false)
+			return
+		}
+
+		if cell.StreamID == 0 {
+			if cell.Command == CellEnd {
+				c.shutdown(endReason(ErrCircuitClosed, cell), false)
+				return
+			}
+			c.shutdown(fmt.Errorf("%w: %v on circuit", ErrUnexpectedCell, cell.Command), true)
+			return
+		}
+
+		// Cells of streams closed by this side may still arrive and are
+		// dropped.
+		s := c.getStream(cell.StreamID)
+		if s == nil {
+			continue
+		}
+		switch cell.Command {
+		case CellConnected:
+			s.connect(nil)
+		case CellData:
+			if !s.receive(cell.Payload) {
+				s.remoteClose(ErrWindowExceeded)
+				c.removeStream(s.id)
+				c.writeCell(endCell(s.id, ErrWindowExceeded))
+			}
+		case CellSendme:
+			s.increaseSendWindow(_sendmeIncrement)
+		case CellEnd:
+			err := endReason(ErrStreamClosed, cell)
+			s.connect(err)
+			s.remoteClose(err)
+			c.removeStream(s.id)
+		default:
+			c.shutdown(fmt.Errorf("%w: %v on stream", ErrUnexpectedCell, cell.Command), true)
+			return
+		}
+	}
+}
+
+// shutdown closes the circuit and all its streams because of err. If sendEnd
+// is true the exit relay is told to tear down the circuit.
+func (c *Circuit) shutdown(err error, sendEnd bool) error {
+	var closeErr error
+	c.closeOnce.Do(func() {
+		if err == nil {
+			err = ErrCircuitClosed
+		}
+		if sendEnd {
+			writeCell(c.stream, Cell{Command: CellEnd})
+		}
+
+		c.lock.Lock()
+		c.err = err
+		streams := c.streams
+		c.streams = make(map[uint16]*Stream)
+		c.lock.Unlock()
+
+		close(c.done)
+		for _, s := range streams {
+			s.connect(err)
+			s.remoteClose(err)
+		}
+		closeErr = c.closer.Close()
+	})
+	return closeErr
+}
+
+func (c *Circuit) closeErr() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Stream is a stream of a circuit to the address given to OpenStream. Writes
+// block when the send window of the stream is used up until the exit relay
+// has delivered the data, and the exit relay is sent a SENDME cell when data
+// is read, so at most a window of DATA cells is buffered.
+type Stream struct {
+	id      uint16
+	addr    string
+	circuit *Circuit
+
+	// closeCircuit makes Close tear down the circuit, which is used for
+	// streams on circuits that are not shared.
+	closeCircuit bool
+
+	connected chan error
+
+	lock *sync.Mutex
+	// recvCells are the payloads of the received DATA cells that are not
+	// read yet, and delivered is the number of cells read since the last
+	// SENDME cell.
+	recvCells    [][]byte
+	delivered    int
+	sendWindow   int
+	readNotify   chan struct{}
+	windowNotify chan struct{}
+	remoteClosed bool
+	remoteErr    error
+	closed       bool
+}
+
+var (
+	_ transport.Conn            = &Stream{}
+	_ transport.RemoteAddrHaver = &Stream{}
+)
+
+func newStream(c *Circuit, id uint16, addr string) *Stream {
+	return &Stream{
+		id:           id,
+		addr:         addr,
+		circuit:      c,
+		connected:    make(chan error, 1),
+		lock:         &sync.Mutex{},
+		sendWindow:   _streamWindow,
+		readNotify:   make(chan struct{}, 1),
+		windowNotify: make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) ID() uint16 {
+	return s.id
+}
+
+// RemoteAddr returns the address the exit relay connected to.
+func (s *Stream) RemoteAddr() string {
+	return s.addr
+}
+
+// Read returns the data of the DATA cells of the stream. It returns io.EOF
+// when the exit relay closes the stream without an error.
+func (s *Stream) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if len(s.recvCells) > 0 {
+			n := copy(p, s.recvCells[0])
+			s.recvCells[0] = s.recvCells[0][n:]
+			sendme := false
+			if len(s.recvCells[0]) == 0 {
+				s.recvCells = s.recvCells[1:]
+				s.delivered++
+				if s.delivered == _sendmeIncrement {
+					s.delivered = 0
+					sendme = true
+				}
+			}
+			s.lock.Unlock()
+
+			if sendme {
+				s.circuit.writeCell(Cell{Command: CellSendme, StreamID: s.id})
+			}
+			return n, nil
+		}
+		if s.remoteClosed {
+			err := s.remoteErr
+			s.lock.Unlock()
+			// An END cell without a reason is a normal close.
+			if err == ErrStreamClosed {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		s.lock.Unlock()
+
+		<-s.readNotify
+	}
+}
+
+func (s *Stream) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		s.lock.Lock()
+		if s.closed || s.remoteClosed {
+			s.lock.Unlock()
+			return n, ErrStreamClosed
+		}
+		if s.sendWindow == 0 {
+			s.lock.Unlock()
+			select {
+			case <-s.windowNotify:
+			case <-s.circuit.done:
+				return n, s.circuit.closeErr()
+			}
+			continue
+		}
+		s.sendWindow--
+		s.lock.Unlock()
+
+		chunk := p[n:min(len(p), n+MaxCellPayload)]
+		err := s.circuit.writeCell(Cell{Command: CellData, StreamID: s.id, Payload: chunk})
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Close closes the stream with an END cell. Streams returned by
+// Client.EstablishCircuit also tear down their circuit.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	remoteClosed := s.remoteClosed
+	s.lock.Unlock()
+	s.notifyAll()
+
+	if s.closeCircuit {
+		return s.circuit.Close()
+	}
+
+	s.circuit.removeStream(s.id)
+	if remoteClosed {
+		return nil
+	}
+	return s.circuit.writeCell(Cell{Command: CellEnd, StreamID: s.id})
+}
+
+func (s *Stream) connect(err error) {
+	select {
+	case s.connected <- err:
+	default:
+	}
+}
+
+// receive buffers the data of a DATA cell. It reports false if the exit relay
+// has exceeded the window of the stream.
+func (s *Stream) receive(data []byte) bool {
+	s.lock.Lock()
+	if len(s.recvCells) >= _streamWindow {
+		s.lock.Unlock()
+		return false
+	}
+	s.recvCells = append(s.recvCells, data)
+	s.lock.Unlock()
+	s.notifyReader()
+	return true
+}
+
+func (s *Stream) increaseSendWindow(delta int) {
+	s.lock.Lock()
+	s.sendWindow += delta
+	s.lock.Unlock()
+	notify(s.windowNotify)
+}
+
+func (s *Stream) remoteClose(err error) {
+	s.lock.Lock()
+	if !s.remoteClosed {
+		s.remoteClosed = true
+		s.remoteErr = err
+	}
+	s.lock.Unlock()
+	s.notifyAll()
+}
+
+func (s *Stream) notifyReader() {
+	notify(s.readNotify)
+}
+
+func (s *Stream) notifyAll() {
+	notify(s.readNotify)
+	notify(s.windowNotify)
+}
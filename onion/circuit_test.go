@@ -0,0 +1,230 @@
+package onion
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/protocolmux/multistream"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitStreams(t *testing.T) {
+	relays := startRelays(t, 3, false)
+	echo := func(c transport.Conn) error {
+		_, err := io.Copy(c, c)
+		return err
+	}
+	destinations := []string{
+		startFinalNode(t, echo).PublicAddr(),
+		startFinalNode(t, echo).PublicAddr(),
+	}
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	circuit, _, err := client.BuildCircuit(context.Background(), relays)
+	require.NoError(t, err)
+	defer circuit.Close()
+
+	streams := make([]*Stream, 0)
+	for i := 0; i < 4; i++ {
+		s, err := circuit.OpenStream(context.Background(), destinations[i%2])
+		require.NoError(t, err)
+		streams = append(streams, s)
+	}
+	require.Equal(t, 4, circuit.NumStreams())
+
+	// The streams are used concurrently, and the results are checked once
+	// all of them are done.
+	errs := make(chan error, len(streams))
+	wg := &sync.WaitGroup{}
+	for i, s := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			msg := []byte(fmt.Sprintf("message %v ", i))
+			for len(msg) < 3*MaxCellPayload {
+				msg = append(msg, msg...)
+			}
+			if _, err := s.Write(msg); err != nil {
+				errs <- fmt.Errorf("stream %v: write: %w", i, err)
+				return
+			}
+
+			received := make([]byte, len(msg))
+			if _, err := io.ReadFull(s, received); err != nil {
+				errs <- fmt.Errorf("stream %v: read: %w", i, err)
+				return
+			}
+			if !bytes.Equal(msg, received) {
+				errs <- fmt.Errorf("stream %v: received other data than sent", i)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Closing a stream leaves the circuit and the other streams open.
+	require.NoError(t, streams[0].Close())
+	require.Equal(t, 3, circuit.NumStreams())
+
+	_, err = streams[1].Write([]byte("still open"))
+	require.NoError(t, err)
+	received := make([]byte, len("still open"))
+	_, err = io.ReadFull(streams[1], received)
+	require.NoError(t, err)
+	require.Equal(t, "still open", string(received))
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	relays := startRelays(t, 3, false)
+
+	// The destination echoes the data, but only reads a chunk every few
+	// milliseconds.
+	const chunkSize = 64 * 1024
+	destination := startFinalNode(t, func(c transport.Conn) error {
+		buf := make([]byte, chunkSize)
+		for {
+			if _, err := io.ReadFull(c, buf); err != nil {
+				return nil
+			}
+			time.Sleep(5 * time.Millisecond)
+			if _, err := c.Write(buf); err != nil {
+				return err
+			}
+		}
+	})
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	circuit, _, err := client.BuildCircuit(context.Background(), relays)
+	require.NoError(t, err)
+	defer circuit.Close()
+	s, err := circuit.OpenStream(context.Background(), destination.PublicAddr())
+	require.NoError(t, err)
+
+	msg := make([]byte, 4*1024*1024)
+	_, err = rand.Read(msg)
+	require.NoError(t, err)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := s.Write(msg)
+		writeErr <- err
+	}()
+
+	// The client also reads slowly, so both directions are held back by the
+	// windows instead of buffering the data.
+	received := make([]byte, len(msg))
+	for i := 0; i < len(msg); i += chunkSize {
+		_, err := io.ReadFull(s, received[i:i+chunkSize])
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+
+		s.lock.Lock()
+		require.LessOrEqual(t, len(s.recvCells), _streamWindow)
+		s.lock.Unlock()
+	}
+	require.NoError(t, <-writeErr)
+	require.True(t, bytes.Equal(msg, received))
+}
+
+func TestOpenStreamFails(t *testing.T) {
+	relays := startRelays(t, 2, false)
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	circuit, _, err := client.BuildCircuit(context.Background(), relays)
+	require.NoError(t, err)
+	defer circuit.Close()
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	_, err = circuit.OpenStream(context.Background(), "127.0.0.1:"+port)
+	require.ErrorIs(t, err, ErrStreamClosed)
+	require.Equal(t, 0, circuit.NumStreams())
+}
+
+func TestCircuitClose(t *testing.T) {
+	relays := startRelays(t, 2, false)
+	destination := startFinalNode(t, func(c transport.Conn) error {
+		_, err := io.Copy(io.Discard, c)
+		return err
+	})
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	circuit, _, err := client.BuildCircuit(context.Background(), relays)
+	require.NoError(t, err)
+
+	s, err := circuit.OpenStream(context.Background(), destination.PublicAddr())
+	require.NoError(t, err)
+
+	require.NoError(t, circuit.Close())
+	<-circuit.Done()
+
+	_, err = s.Read(make([]byte, 1))
+	require.ErrorIs(t, err, ErrCircuitClosed)
+	_, err = circuit.OpenStream(context.Background(), destination.PublicAddr())
+	require.ErrorIs(t, err, ErrCircuitClosed)
+}
+
+func TestExitStreamsDoNotBlockEachOther(t *testing.T) {
+	circuitConn, relayConn := net.Pipe()
+	defer circuitConn.Close()
+	streams := &exitStreams{lock: &sync.Mutex{}, streams: make(map[uint16]*exitStream)}
+
+	// The destination of stream 1 never reads, so writes to it block.
+	slow, _ := net.Pipe()
+	fast, fastRemote := net.Pipe()
+	for id, conn := range map[uint16]transport.Conn{1: slow, 2: fast} {
+		require.True(t, streams.register(id))
+		stream := streams.connect(id, conn)
+		require.NotNil(t, stream)
+		go writeStream(relayConn, streams, id, stream, 0)
+	}
+
+	s := &Service{}
+	loopErr := make(chan error, 1)
+	go func() { loopErr <- s.handleExitCells(relayConn, streams, 0) }()
+	cells := make(chan Cell, 1)
+	go func() {
+		for {
+			cell, err := readCell(circuitConn)
+			if err != nil {
+				close(cells)
+				return
+			}
+			cells <- cell
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, writeCell(circuitConn, Cell{Command: CellData, StreamID: 1, Payload: []byte("blocked")}))
+	}
+	require.NoError(t, writeCell(circuitConn, Cell{Command: CellData, StreamID: 2, Payload: []byte("hello")}))
+	received := make([]byte, len("hello"))
+	_, err := io.ReadFull(fastRemote, received)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(received))
+
+	// A circuit creator sending more cells than the window of the stream
+	// allows has the stream closed instead of blocking the circuit.
+	for i := 0; i < _streamWindow; i++ {
+		require.NoError(t, writeCell(circuitConn, Cell{Command: CellData, StreamID: 1, Payload: []byte("blocked")}))
+	}
+	cell := <-cells
+	require.Equal(t, CellEnd, cell.Command)
+	require.Equal(t, uint16(1), cell.StreamID)
+	require.Equal(t, ErrWindowExceeded.Error(), string(cell.Payload))
+
+	require.NoError(t, writeCell(circuitConn, endCell(0, nil)))
+	require.NoError(t, <-loopErr)
+}
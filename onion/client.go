@@ -1,11 +1,13 @@
 package onion
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/FluffyKebab/pearly/crypto"
 	"github.com/FluffyKebab/pearly/peer"
@@ -14,10 +16,19 @@ import (
 	"github.com/FluffyKebab/pearly/transport/transform"
 )
 
+var ErrMissingPublicKey = errors.New("relay has no public key")
+
 type Client struct {
+	// EncryptRequest makes the client seal the request to each relay with
+	// crypto.BoxEncrypter, so that only the relay can read its secret key and
+	// the next node. The public key of every relay must be the public key of
+	// the crypto.BoxKey used as the PublicKeyDecrypter of its service.
 	EncryptRequest bool
-	muxer          protocolmux.Muxer
-	transport      transport.Transport
+	// PaddingInterval makes the client send a PADDING cell to the exit relay
+	// every interval. Zero disables padding.
+	PaddingInterval time.Duration
+	muxer           protocolmux.Muxer
+	transport       transport.Transport
 }
 
 func NewClient(m protocolmux.Muxer, transport transport.Transport) Client {
@@ -27,65 +38,158 @@ func NewClient(m protocolmux.Muxer, transport transport.Transport) Client {
 	}
 }
 
+// EstablishCircuit creates a circuit through the relays in peers and opens a
+// stream to the last peer, which is the destination. Closing the stream tears
+// down the circuit. If establishing the circuit fails the index of the failing
+// relay is returned.
 func (c Client) EstablishCircuit(ctx context.Context, peers []peer.Peer) (transport.Conn, int, error) {
 	if len(peers) == 0 {
 		return nil, 0, errors.New("missing enough peers to create circuit")
 	}
+	if len(peers) == 1 {
+		conn, err := c.transport.Dial(ctx, peers[0])
+		if err != nil {
+			return nil, 0, fmt.Errorf("dialing peer 1: %w", err)
+		}
+		return conn, 0, nil
+	}
 
-	conn, err := c.transport.Dial(ctx, peers[0])
+	relays := peers[:len(peers)-1]
+	circuit, failed, err := c.BuildCircuit(ctx, relays)
+	if err != nil {
+		return nil, failed, err
+	}
+
+	s, err := circuit.OpenStream(ctx, peers[len(peers)-1].PublicAddr())
+	if err != nil {
+		circuit.Close()
+		return nil, len(relays) - 1, err
+	}
+	s.closeCircuit = true
+	return s, 0, nil
+}
+
+// BuildCircuit creates a circuit through the relays, where the last relay is
+// the exit of the circuit. The first relay is sent its request directly, and
+// the circuit is extended to the next relays with EXTEND cells. If building
+// the circuit fails the index of the failing relay is returned.
+func (c Client) BuildCircuit(ctx context.Context, relays []peer.Peer) (*Circuit, int, error) {
+	if len(relays) == 0 {
+		return nil, 0, errors.New("missing enough relays to create circuit")
+	}
+
+	conn, err := c.transport.Dial(ctx, relays[0])
 	if err != nil {
 		return nil, 0, fmt.Errorf("dialing peer 1: %w", err)
 	}
 
-	for i := 0; i < len(peers)-1; i++ {
-		err := c.muxer.SelectProtocol(ctx, OnionProtoID, conn)
-		if err != nil {
-			conn.Close()
-			return nil, i, err
-		}
+	err = c.muxer.SelectProtocol(ctx, OnionProtoID, conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
 
-		transformedConn := transform.NewConn(conn)
-		if c.EncryptRequest {
-			conn.Close()
-			return nil, 0, errors.New("not implemented")
-		}
+	stream, err := c.sendFirstRequest(conn, relays)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
 
-		curSecretKey := crypto.NewSymmetricEncryptionSecretKey()
-		err = sendRequest(transformedConn, Request{
-			SecretKey:         curSecretKey,
-			NextNodeAddr:      peers[i+1].PublicAddr(),
-			MaxRandomWaitTime: 0,
-		})
+	for i := 1; i < len(relays); i++ {
+		stream, err = c.extend(stream, conn, relays, i)
 		if err != nil {
 			conn.Close()
 			return nil, i, err
 		}
+	}
 
-		err = readResponse(transformedConn)
-		if err != nil {
-			conn.Close()
-			return nil, i, err
-		}
+	return newCircuit(stream, conn, c.PaddingInterval), 0, nil
+}
 
-		upgraded, err := crypto.NewEncryptionStream(curSecretKey, transformedConn)
-		if err != nil {
-			conn.Close()
-			return nil, i, err
-		}
-		conn = transport.NewConn(upgraded, upgraded, conn)
+// sendFirstRequest sends the request of the first relay and returns the
+// stream of the relay.
+func (c Client) sendFirstRequest(conn transport.Conn, relays []peer.Peer) (io.ReadWriter, error) {
+	request, secretKey, err := c.newRequest(relays, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	transformedConn := transform.NewConn(conn)
+	if _, err := transformedConn.Write(request); err != nil {
+		return nil, err
+	}
+	if err := readResponse(transformedConn); err != nil {
+		return nil, err
 	}
 
-	return conn, 0, err
+	return crypto.NewAuthenticatedStream(secretKey, true, transformedConn)
 }
 
-func sendRequest(c *transform.Conn, req Request) error {
-	buf := bufio.NewWriterSize(c, 1024)
-	err := gob.NewEncoder(buf).Encode(req)
+// extend sends the request of relay i in an EXTEND cell to the previous relay,
+// whose stream is prev, and returns the stream of relay i.
+func (c Client) extend(prev io.ReadWriter, conn transport.Conn, relays []peer.Peer, i int) (io.ReadWriter, error) {
+	request, secretKey, err := c.newRequest(relays, i)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := writeCell(prev, Cell{Command: CellExtend, Payload: request}); err != nil {
+		return nil, err
+	}
+	cell, err := readNonPaddingCell(prev)
+	if err != nil {
+		return nil, err
+	}
+	switch cell.Command {
+	case CellExtended:
+	case CellEnd:
+		return nil, endReason(ErrCircuitClosed, cell)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedCell, cell.Command)
 	}
 
-	return buf.Flush()
+	// The packets of the new relay are sent as data of the previous relay, so
+	// that every packet is encrypted as one frame by the previous relays.
+	transformedConn := transform.NewConn(transport.NewConn(prev, prev, conn))
+	return crypto.NewAuthenticatedStream(secretKey, true, transformedConn)
+}
+
+// newRequest returns the request for relay i, sealed to its public key if
+// EncryptRequest is set, and the secret key in the request.
+func (c Client) newRequest(relays []peer.Peer, i int) ([]byte, []byte, error) {
+	secretKey := crypto.NewSymmetricEncryptionSecretKey()
+
+	var nextNodeAddr string
+	if i+1 < len(relays) {
+		nextNodeAddr = relays[i+1].PublicAddr()
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(Request{
+		SecretKey:         secretKey,
+		NextNodeAddr:      nextNodeAddr,
+		MaxRandomWaitTime: 0,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !c.EncryptRequest {
+		return buf.Bytes(), secretKey, nil
+	}
+
+	encrypter, err := requestEncrypter(relays[i])
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := encrypter.Encrypt(buf.Bytes())
+	return request, secretKey, err
+}
+
+func requestEncrypter(p peer.Peer) (crypto.BoxEncrypter, error) {
+	if len(p.PublicKey()) == 0 {
+		return crypto.BoxEncrypter{}, fmt.Errorf("%w: %s", ErrMissingPublicKey, p.PublicAddr())
+	}
+	return crypto.NewBoxEncrypter(p.PublicKey())
 }
 
 func readResponse(c *transform.Conn) error {
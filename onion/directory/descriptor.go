@@ -0,0 +1,199 @@
+package directory
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/FluffyKebab/pearly/crypto"
+	"github.com/FluffyKebab/pearly/peer"
+)
+
+var (
+	ErrInvalidDescriptor = errors.New("invalid relay descriptor")
+	ErrExpiredDescriptor = errors.New("relay descriptor expired")
+)
+
+const (
+	_signaturePrefix = "pearly-relay-descriptor-v1"
+	// _maxClockSkew is how far in the future a descriptor can be published
+	// before it is rejected.
+	_maxClockSkew = 5 * time.Minute
+)
+
+// ExitPolicy tells which addresses a relay opens streams to when it is the
+// exit of a circuit.
+type ExitPolicy struct {
+	// Exit is false for relays that are only used in the middle of circuits.
+	Exit bool
+	// Ports are the ports the relay connects to. All ports are allowed if it
+	// is empty.
+	Ports []uint16
+}
+
+// Allows reports whether the relay opens streams to addr, which is a host and
+// port.
+func (p ExitPolicy) Allows(addr string) bool {
+	if !p.Exit {
+		return false
+	}
+	if len(p.Ports) == 0 {
+		return true
+	}
+
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(p.Ports, uint16(port))
+}
+
+// Descriptor describes a relay and is signed by the identity key of the relay,
+// so that clients can check that it was published by the relay with the ID.
+type Descriptor struct {
+	// ID is the ID of the relay, which is crypto.PeerID of IdentityKey.
+	ID   []byte
+	Addr string
+	// IdentityKey is the public key the descriptor is signed with, marshaled
+	// with crypto.MarshalPublicKey.
+	IdentityKey []byte
+	// OnionKey is the public key of the crypto.BoxKey the relay decrypts
+	// onion requests with.
+	OnionKey []byte
+	// Bandwidth is the number of bytes per second the relay is willing to
+	// relay.
+	Bandwidth  uint64
+	ExitPolicy ExitPolicy
+	// Uptime is how long the relay had been running when the descriptor was
+	// published.
+	Uptime    time.Duration
+	Published time.Time
+	Signature []byte
+}
+
+// Sign sets the ID and identity key of the descriptor from key and signs it.
+// Published is rounded to whole seconds.
+func (d *Descriptor) Sign(key crypto.PrivateKey) error {
+	identityKey, err := crypto.MarshalPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	id, err := crypto.PeerID(key.Public())
+	if err != nil {
+		return err
+	}
+
+	d.ID = id
+	d.IdentityKey = identityKey
+	d.Published = time.Unix(d.Published.Unix(), 0)
+	d.Signature, err = key.Sign(d.signedData())
+	return err
+}
+
+// Verify checks that the descriptor is well formed, signed by its identity
+// key and not older than maxAge at now.
+func (d Descriptor) Verify(now time.Time, maxAge time.Duration) error {
+	if d.Addr == "" {
+		return fmt.Errorf("%w: missing address", ErrInvalidDescriptor)
+	}
+	if _, err := ecdh.X25519().NewPublicKey(d.OnionKey); err != nil {
+		return fmt.Errorf("%w: onion key: %w", ErrInvalidDescriptor, err)
+	}
+
+	identityKey, err := crypto.UnmarshalPublicKey(d.IdentityKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+	id, err := crypto.PeerID(identityKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+	if !bytes.Equal(id, d.ID) {
+		return fmt.Errorf("%w: ID does not match the identity key", ErrInvalidDescriptor)
+	}
+	if err := identityKey.Verify(d.signedData(), d.Signature); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+
+	if d.Published.After(now.Add(_maxClockSkew)) {
+		return fmt.Errorf("%w: published in the future", ErrInvalidDescriptor)
+	}
+	if now.Sub(d.Published) > maxAge {
+		return fmt.Errorf("%w: published %v", ErrExpiredDescriptor, d.Published)
+	}
+	return nil
+}
+
+func (d Descriptor) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(d)
+	return buf.Bytes(), err
+}
+
+func UnmarshalDescriptor(data []byte) (Descriptor, error) {
+	var d Descriptor
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&d)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("%w: %w", ErrInvalidDescriptor, err)
+	}
+	return d, nil
+}
+
+// Peer returns the relay as a peer for onion.Client, where the public key is
+// the onion key the requests are sealed to.
+func (d Descriptor) Peer() peer.Peer {
+	return relayPeer{d}
+}
+
+// signedData is the canonical form of the descriptor without the signature.
+// Variable length fields are prefixed with their length so that different
+// descriptors never have the same form.
+func (d Descriptor) signedData() []byte {
+	data := []byte(_signaturePrefix)
+	data = appendField(data, d.ID)
+	data = appendField(data, []byte(d.Addr))
+	data = appendField(data, d.IdentityKey)
+	data = appendField(data, d.OnionKey)
+	data = binary.BigEndian.AppendUint64(data, d.Bandwidth)
+	if d.ExitPolicy.Exit {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = binary.AppendUvarint(data, uint64(len(d.ExitPolicy.Ports)))
+	for _, port := range d.ExitPolicy.Ports {
+		data = binary.BigEndian.AppendUint16(data, port)
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(d.Uptime))
+	return binary.BigEndian.AppendUint64(data, uint64(d.Published.Unix()))
+}
+
+func appendField(data, field []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(field)))
+	return append(data, field...)
+}
+
+type relayPeer struct {
+	descriptor Descriptor
+}
+
+func (p relayPeer) ID() []byte         { return p.descriptor.ID }
+func (p relayPeer) PublicKey() []byte  { return p.descriptor.OnionKey }
+func (p relayPeer) PublicAddr() string { return p.descriptor.Addr }
+
+// AllowsExit reports whether the exit policy of the relay allows streams to
+// addr.
+func (p relayPeer) AllowsExit(addr string) bool {
+	return p.descriptor.ExitPolicy.Allows(addr)
+}
@@ -0,0 +1,361 @@
+// Package directory publishes signed descriptors of onion relays in the DHT
+// and lets clients discover them.
+//
+// Values in the DHT can not be replaced, so descriptors are stored in slots
+// of epochs. The key of a slot is the hash of the namespace, the epoch and the
+// slot number. Relays publish their descriptor in the first free slot of the
+// current epoch once every epoch, and clients read the slots of the current
+// and the previous epoch until a number of slots in a row are empty.
+//
+// The slot keys are predictable and the DHT nodes storing them do not check
+// the values, so anyone can fill the slots of an epoch, including future ones,
+// before the relays do. Clients skip values that are not valid descriptors
+// published in the epoch of the slot, without counting them as empty, but
+// relays can not publish in an epoch where all slots are taken. The directory
+// is therefore only as available as the DHT is free of such peers.
+package directory
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/FluffyKebab/pearly/crypto"
+	"github.com/FluffyKebab/pearly/kademila"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/storage"
+)
+
+// Namespace is the prefix of the keys of all relay descriptors.
+const Namespace = "/pearly/onion/relays/1"
+
+var ErrNoFreeSlot = errors.New("no free slot for relay descriptor")
+
+const (
+	_defaultEpochLength     = time.Hour
+	_defaultMaxSlots        = 256
+	_defaultMaxMisses       = 3
+	_defaultRefreshInterval = 10 * time.Minute
+)
+
+// ValueStore is the DHT the descriptors are stored in, usually a
+// kademila.DHT. SetValue must return kademila.ErrAllreadySet for keys that
+// have a value and GetValue must return storage.ErrNotFound for keys that do
+// not.
+type ValueStore interface {
+	SetValue(ctx context.Context, key []byte, value []byte) error
+	GetValue(ctx context.Context, key []byte) ([]byte, error)
+}
+
+type Option func(*options)
+
+type options struct {
+	epochLength     time.Duration
+	maxSlots        int
+	maxMisses       int
+	refreshInterval time.Duration
+}
+
+func defaultOptions() *options {
+	return &options{
+		epochLength:     _defaultEpochLength,
+		maxSlots:        _defaultMaxSlots,
+		maxMisses:       _defaultMaxMisses,
+		refreshInterval: _defaultRefreshInterval,
+	}
+}
+
+// WithEpochLength sets how often relays publish their descriptor. Descriptors
+// expire after two epochs. Relays and clients must use the same length.
+func WithEpochLength(d time.Duration) Option {
+	return func(o *options) {
+		o.epochLength = d
+	}
+}
+
+// WithMaxSlots sets the maximum number of descriptors in an epoch.
+func WithMaxSlots(n int) Option {
+	return func(o *options) {
+		o.maxSlots = n
+	}
+}
+
+// WithMaxMisses sets the number of empty slots in a row after which a client
+// stops reading an epoch.
+func WithMaxMisses(n int) Option {
+	return func(o *options) {
+		o.maxMisses = n
+	}
+}
+
+// WithRefreshInterval sets how long a client uses the descriptors it has
+// found before reading the DHT again.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.refreshInterval = d
+	}
+}
+
+// SlotKey returns the DHT key of a slot of an epoch. It is a self-describing
+// SHA-256 key, see storage.EncodeKey.
+func SlotKey(epoch int64, slot int) []byte {
+	digest := sha256.Sum256(fmt.Appendf(nil, "%s/%d/%d", Namespace, epoch, slot))
+	return storage.EncodeKey(storage.SHA256, digest[:])
+}
+
+func epochOf(t time.Time, epochLength time.Duration) int64 {
+	return t.UnixNano() / int64(epochLength)
+}
+
+// Publisher publishes the descriptor of a relay.
+type Publisher struct {
+	dht     ValueStore
+	key     crypto.PrivateKey
+	relay   Descriptor
+	opts    *options
+	started time.Time
+	now     func() time.Time
+}
+
+// NewPublisher creates a publisher of relay, which needs the address, onion
+// key, bandwidth and exit policy set. The rest of the descriptor is set when
+// it is published, with the uptime counted from the creation of the
+// publisher.
+func NewPublisher(dht ValueStore, key crypto.PrivateKey, relay Descriptor, opts ...Option) *Publisher {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return &Publisher{
+		dht:     dht,
+		key:     key,
+		relay:   relay,
+		opts:    o,
+		started: time.Now(),
+		now:     time.Now,
+	}
+}
+
+// Publish signs the descriptor and stores it in the first free slot of the
+// current epoch, which is returned. Relays publishing at the same time can
+// pick the same slot, in which case clients only find one of them until the
+// next epoch.
+func (p *Publisher) Publish(ctx context.Context) (int, error) {
+	now := p.now()
+	d := p.relay
+	d.Published = now
+	d.Uptime = now.Sub(p.started)
+	if err := d.Sign(p.key); err != nil {
+		return 0, err
+	}
+	data, err := d.Marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	epoch := epochOf(now, p.opts.epochLength)
+	for slot := 0; slot < p.opts.maxSlots; slot++ {
+		key := SlotKey(epoch, slot)
+
+		// SetValue only checks the nodes closest to the key that it finds
+		// for a value, so the slot is looked up first to not replace the
+		// descriptor of another relay on some of the nodes.
+		_, err := p.dht.GetValue(ctx, key)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return 0, err
+		}
+
+		err = p.dht.SetValue(ctx, key, data)
+		if errors.Is(err, kademila.ErrAllreadySet) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return slot, nil
+	}
+	return 0, fmt.Errorf("%w: epoch %v", ErrNoFreeSlot, epoch)
+}
+
+// Run publishes the descriptor now and then once every epoch until ctx is
+// done. Failed publications are sent on the returned channel, which is closed
+// when Run returns.
+func (p *Publisher) Run(ctx context.Context) <-chan error {
+	errChan := make(chan error)
+	go func() {
+		defer close(errChan)
+
+		ticker := time.NewTicker(p.opts.epochLength)
+		defer ticker.Stop()
+		for {
+			if _, err := p.Publish(ctx); err != nil {
+				select {
+				case errChan <- fmt.Errorf("publishing relay descriptor: %w", err):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return errChan
+}
+
+// Directory finds the relays published in the DHT. Descriptors that are not
+// valid are ignored, and the valid ones are cached until they expire.
+type Directory struct {
+	dht  ValueStore
+	opts *options
+	now  func() time.Time
+
+	lock        *sync.Mutex
+	relays      map[string]Descriptor
+	lastRefresh time.Time
+}
+
+func New(dht ValueStore, opts ...Option) *Directory {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return &Directory{
+		dht:    dht,
+		opts:   o,
+		now:    time.Now,
+		lock:   &sync.Mutex{},
+		relays: make(map[string]Descriptor),
+	}
+}
+
+// Refresh reads the descriptors of the current and the previous epoch from
+// the DHT. An error is only returned if no descriptors are found and some
+// slots could not be read.
+func (d *Directory) Refresh(ctx context.Context) error {
+	now := d.now()
+	epoch := epochOf(now, d.opts.epochLength)
+
+	found := make([]Descriptor, 0)
+	errs := make([]error, 0)
+	for _, e := range []int64{epoch - 1, epoch} {
+		descriptors, err := d.readEpoch(ctx, e, now)
+		found = append(found, descriptors...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.lastRefresh = now
+	for _, relay := range found {
+		cached, ok := d.relays[string(relay.ID)]
+		if !ok || relay.Published.After(cached.Published) {
+			d.relays[string(relay.ID)] = relay
+		}
+	}
+
+	if len(found) == 0 && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// readEpoch returns the valid descriptors in the slots of an epoch, and the
+// first error other than storage.ErrNotFound. Slots with values that are not
+// valid descriptors of the epoch are skipped without resetting or adding to
+// the misses, so junk neither ends nor extends the read.
+func (d *Directory) readEpoch(ctx context.Context, epoch int64, now time.Time) ([]Descriptor, error) {
+	var firstErr error
+	descriptors := make([]Descriptor, 0)
+	misses := 0
+	for slot := 0; slot < d.opts.maxSlots && misses < d.opts.maxMisses; slot++ {
+		data, err := d.dht.GetValue(ctx, SlotKey(epoch, slot))
+		if err != nil {
+			if ctx.Err() != nil {
+				return descriptors, ctx.Err()
+			}
+			if !errors.Is(err, storage.ErrNotFound) && firstErr == nil {
+				firstErr = err
+			}
+			misses++
+			continue
+		}
+
+		relay, err := UnmarshalDescriptor(data)
+		if err != nil {
+			continue
+		}
+		if relay.Verify(now, d.maxAge()) != nil {
+			continue
+		}
+		if epochOf(relay.Published, d.opts.epochLength) != epoch {
+			continue
+		}
+		misses = 0
+		descriptors = append(descriptors, relay)
+	}
+	return descriptors, firstErr
+}
+
+// Descriptors returns the descriptors of the relays that are not expired. The
+// DHT is read if the descriptors are older than the refresh interval. If it
+// fails the cached descriptors are returned as long as there are any.
+func (d *Directory) Descriptors(ctx context.Context) ([]Descriptor, error) {
+	d.lock.Lock()
+	stale := d.now().Sub(d.lastRefresh) >= d.opts.refreshInterval
+	d.lock.Unlock()
+
+	var refreshErr error
+	if stale {
+		refreshErr = d.Refresh(ctx)
+	}
+
+	now := d.now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	descriptors := make([]Descriptor, 0, len(d.relays))
+	for id, relay := range d.relays {
+		if now.Sub(relay.Published) > d.maxAge() {
+			delete(d.relays, id)
+			continue
+		}
+		descriptors = append(descriptors, relay)
+	}
+
+	if len(descriptors) == 0 && refreshErr != nil {
+		return nil, refreshErr
+	}
+	return descriptors, nil
+}
+
+// Relays returns the relays of Descriptors as peers that can be used by
+// onion.Client.
+func (d *Directory) Relays(ctx context.Context) ([]peer.Peer, error) {
+	descriptors, err := d.Descriptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	relays := make([]peer.Peer, 0, len(descriptors))
+	for _, relay := range descriptors {
+		relays = append(relays, relay.Peer())
+	}
+	return relays, nil
+}
+
+func (d *Directory) maxAge() time.Duration {
+	return 2 * d.opts.epochLength
+}
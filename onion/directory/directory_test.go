@@ -0,0 +1,339 @@
+package directory
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/crypto"
+	"github.com/FluffyKebab/pearly/kademila"
+	"github.com/FluffyKebab/pearly/node/basic"
+	"github.com/FluffyKebab/pearly/onion"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/protocolmux/multistream"
+	"github.com/FluffyKebab/pearly/storage"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport"
+	onionTransport "github.com/FluffyKebab/pearly/transport/onion"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescriptor(t *testing.T) {
+	key, err := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	require.NoError(t, err)
+	now := time.Now()
+
+	d := newTestDescriptor(t, "127.0.0.1:4000")
+	d.Published = now
+	require.NoError(t, d.Sign(key))
+	require.NoError(t, d.Verify(now, time.Hour))
+
+	data, err := d.Marshal()
+	require.NoError(t, err)
+	decoded, err := UnmarshalDescriptor(data)
+	require.NoError(t, err)
+	require.NoError(t, decoded.Verify(now, time.Hour))
+	require.Equal(t, d.ID, decoded.Peer().ID())
+	require.Equal(t, d.OnionKey, decoded.Peer().PublicKey())
+
+	modified := decoded
+	modified.Addr = "127.0.0.1:4001"
+	require.ErrorIs(t, modified.Verify(now, time.Hour), ErrInvalidDescriptor)
+
+	modified = decoded
+	modified.ExitPolicy = ExitPolicy{Exit: true}
+	require.ErrorIs(t, modified.Verify(now, time.Hour), ErrInvalidDescriptor)
+
+	other, err := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	require.NoError(t, err)
+	modified = decoded
+	modified.ID, err = crypto.PeerID(other.Public())
+	require.NoError(t, err)
+	require.ErrorIs(t, modified.Verify(now, time.Hour), ErrInvalidDescriptor)
+
+	require.ErrorIs(t, decoded.Verify(now.Add(2*time.Hour), time.Hour), ErrExpiredDescriptor)
+	require.ErrorIs(t, decoded.Verify(now.Add(-time.Hour), time.Hour), ErrInvalidDescriptor)
+}
+
+func TestExitPolicy(t *testing.T) {
+	testCases := []struct {
+		policy  ExitPolicy
+		addr    string
+		allowed bool
+	}{
+		{ExitPolicy{}, "127.0.0.1:80", false},
+		{ExitPolicy{Exit: true}, "127.0.0.1:80", true},
+		{ExitPolicy{Exit: true, Ports: []uint16{80, 443}}, "127.0.0.1:443", true},
+		{ExitPolicy{Exit: true, Ports: []uint16{80, 443}}, "127.0.0.1:22", false},
+		{ExitPolicy{Exit: true, Ports: []uint16{80}}, "127.0.0.1", false},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.allowed, tc.policy.Allows(tc.addr), "%+v %s", tc.policy, tc.addr)
+	}
+}
+
+func TestPublishAndDiscover(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	now := time.Now()
+
+	publishers := make([]*Publisher, 0)
+	for i, addr := range []string{"127.0.0.1:4000", "127.0.0.1:4001"} {
+		key, err := crypto.GenerateKey(crypto.KeyTypeEd25519)
+		require.NoError(t, err)
+
+		p := NewPublisher(store, key, newTestDescriptor(t, addr))
+		p.now = func() time.Time { return now }
+		slot, err := p.Publish(ctx)
+		require.NoError(t, err)
+		require.Equal(t, i, slot)
+		publishers = append(publishers, p)
+	}
+
+	// Slots with values that are not valid descriptors are skipped.
+	epoch := epochOf(now, _defaultEpochLength)
+	require.NoError(t, store.SetValue(ctx, SlotKey(epoch, 2), []byte("not a descriptor")))
+	slot, err := publishers[0].Publish(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, slot)
+
+	// Junk in more slots in a row than the misses a read stops at does not
+	// hide the descriptors after it.
+	for slot := 4; slot < 4+_defaultMaxMisses; slot++ {
+		require.NoError(t, store.SetValue(ctx, SlotKey(epoch, slot), []byte("not a descriptor")))
+	}
+	slot, err = publishers[1].Publish(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 4+_defaultMaxMisses, slot)
+
+	// A descriptor copied to the slot of another epoch is skipped.
+	key, err := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	require.NoError(t, err)
+	otherStore := newMemStore()
+	other := NewPublisher(otherStore, key, newTestDescriptor(t, "127.0.0.1:4002"))
+	other.now = func() time.Time { return now }
+	_, err = other.Publish(ctx)
+	require.NoError(t, err)
+	require.NoError(t, store.SetValue(ctx, SlotKey(epoch-1, 0), otherStore.values[string(SlotKey(epoch, 0))]))
+
+	dir := New(store)
+	dir.now = func() time.Time { return now }
+	relays, err := dir.Descriptors(ctx)
+	require.NoError(t, err)
+	require.Len(t, relays, 2)
+
+	// The descriptors are cached until the refresh interval has passed.
+	numGets := store.numGets()
+	_, err = dir.Descriptors(ctx)
+	require.NoError(t, err)
+	require.Equal(t, numGets, store.numGets())
+
+	dir.now = func() time.Time { return now.Add(_defaultRefreshInterval) }
+	_, err = dir.Descriptors(ctx)
+	require.NoError(t, err)
+	require.Greater(t, store.numGets(), numGets)
+
+	// Descriptors expire after two epochs.
+	dir.now = func() time.Time { return now.Add(3 * _defaultEpochLength) }
+	_, err = dir.Descriptors(ctx)
+	require.NoError(t, err)
+	dir.lock.Lock()
+	require.Empty(t, dir.relays)
+	dir.lock.Unlock()
+}
+
+func TestTransportWithDirectory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Every relay is also a DHT node, and publishes its descriptor in the DHT
+	// when it knows the other relays.
+	addrs := make([]string, 0)
+	dhts := make([]kademila.DHT, 0)
+	publishers := make([]*Publisher, 0)
+	for i := 0; i < 4; i++ {
+		addr, dht, publisher := startDirectoryRelay(t, ctx, ExitPolicy{Exit: true})
+		addrs = append(addrs, addr)
+		dhts = append(dhts, dht)
+		publishers = append(publishers, publisher)
+	}
+	for i, dht := range dhts {
+		for j, addr := range addrs {
+			if i != j {
+				require.NoError(t, dht.Bootstrap(ctx, peer.New(nil, addr)))
+			}
+		}
+	}
+	for _, publisher := range publishers {
+		_, err := publisher.Publish(ctx)
+		require.NoError(t, err)
+	}
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	clientNode := basic.New(tcp.New(port), testID(t))
+	_, err = clientNode.Run(ctx)
+	require.NoError(t, err)
+	clientDHT := kademila.New(clientNode)
+	require.NoError(t, clientDHT.Bootstrap(ctx, peer.New(nil, addrs[0])))
+
+	dir := New(clientDHT)
+	relays, err := dir.Relays(ctx)
+	require.NoError(t, err)
+	require.Len(t, relays, 4)
+
+	port, err = testutil.GetAvailablePort()
+	require.NoError(t, err)
+	client := onion.NewClient(multistream.NewMuxer(), tcp.New(port))
+	client.EncryptRequest = true
+	tr := onionTransport.New(tcp.New(port), client, nil, onionTransport.WithRelayDirectory(dir))
+
+	conn, err := tr.Dial(ctx, startEchoNode(t))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, len("hello"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+	require.NoError(t, conn.Close())
+	require.NoError(t, tr.Close())
+}
+
+func TestRelayEnforcesExitPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _, middle := startDirectoryRelay(t, ctx, ExitPolicy{Exit: true})
+	_, _, exit := startDirectoryRelay(t, ctx, ExitPolicy{Exit: false})
+	destination := startEchoNode(t)
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	client := onion.NewClient(multistream.NewMuxer(), tcp.New(port))
+	client.EncryptRequest = true
+	circuit, _, err := client.BuildCircuit(ctx, []peer.Peer{middle.relay.Peer(), exit.relay.Peer()})
+	require.NoError(t, err)
+	defer circuit.Close()
+
+	// The relay answers the BEGIN cell with an END cell, and the circuit stays
+	// open.
+	_, err = circuit.OpenStream(ctx, destination.PublicAddr())
+	require.ErrorIs(t, err, onion.ErrStreamClosed)
+	require.ErrorContains(t, err, onion.ErrExitNotAllowed.Error())
+	require.Equal(t, 0, circuit.NumStreams())
+	_, err = circuit.OpenStream(ctx, destination.PublicAddr())
+	require.ErrorIs(t, err, onion.ErrStreamClosed)
+}
+
+func startDirectoryRelay(t *testing.T, ctx context.Context, policy ExitPolicy) (string, kademila.DHT, *Publisher) {
+	t.Helper()
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	addr := "127.0.0.1:" + port
+
+	identityKey, err := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	require.NoError(t, err)
+	id, err := crypto.PeerID(identityKey.Public())
+	require.NoError(t, err)
+	onionKey, err := crypto.GenerateBoxKey()
+	require.NoError(t, err)
+
+	n := basic.New(tcp.New(port), id)
+	service := onion.RegisterService(n)
+	service.PublicKeyDecrypter = onionKey
+	service.ExitPolicy = policy
+	service.Run()
+	dht := kademila.New(n)
+	_, err = n.Run(ctx)
+	require.NoError(t, err)
+
+	return addr, dht, NewPublisher(dht, identityKey, Descriptor{
+		Addr:       addr,
+		OnionKey:   onionKey.PublicKey(),
+		Bandwidth:  1 << 20,
+		ExitPolicy: policy,
+	})
+}
+
+func startEchoNode(t *testing.T) peer.Peer {
+	t.Helper()
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	n := basic.New(tcp.New(port), nil)
+	n.SetConnHandler(func(c transport.Conn) error {
+		_, err := io.Copy(c, c)
+		return err
+	})
+	_, err = n.Run(context.Background())
+	require.NoError(t, err)
+	return peer.New(testID(t), "127.0.0.1:"+port)
+}
+
+func newTestDescriptor(t *testing.T, addr string) Descriptor {
+	t.Helper()
+
+	onionKey, err := crypto.GenerateBoxKey()
+	require.NoError(t, err)
+	return Descriptor{
+		Addr:       addr,
+		OnionKey:   onionKey.PublicKey(),
+		Bandwidth:  1 << 20,
+		ExitPolicy: ExitPolicy{Exit: true, Ports: []uint16{80, 443}},
+	}
+}
+
+func testID(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	require.NoError(t, err)
+	id, err := crypto.PeerID(key.Public())
+	require.NoError(t, err)
+	return id
+}
+
+// memStore is a ValueStore where values can not be replaced, like the DHT.
+type memStore struct {
+	lock   *sync.Mutex
+	values map[string][]byte
+	gets   int
+}
+
+func newMemStore() *memStore {
+	return &memStore{lock: &sync.Mutex{}, values: make(map[string][]byte)}
+}
+
+func (s *memStore) SetValue(_ context.Context, key []byte, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.values[string(key)]; ok {
+		return kademila.ErrAllreadySet
+	}
+	s.values[string(key)] = value
+	return nil
+}
+
+func (s *memStore) GetValue(_ context.Context, key []byte) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gets++
+	value, ok := s.values[string(key)]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *memStore) numGets() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.gets
+}
@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"io"
 	"math/rand/v2"
+	"net"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/FluffyKebab/pearly/crypto"
@@ -17,21 +20,30 @@ import (
 	"github.com/FluffyKebab/pearly/transport/transform"
 )
 
-var ErrInvalidRequest = errors.New("invalid request")
+var (
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrExitNotAllowed = errors.New("exit not allowed by the exit policy of the relay")
+)
 
 const (
-	OnionProtoID       = "/onion"
+	// OnionProtoID is the protocol of circuit extension. Version 4 carries
+	// multiple streams in the fixed-size cells of a circuit, and version 5
+	// adds flow control of the streams with SENDME cells.
+	OnionProtoID       = "/onion/5.0.0"
 	_successResponse   = "success"
 	_defaultPacketSize = 1024 * 10
 	_defaultBatchSize  = 1024 * 6
 )
 
 type Request struct {
-	// SecretKey is the key that will be used for encrytpion and decryprion by
-	// the relay.
+	// SecretKey is the key of the authenticated stream between the circuit
+	// creator and the relay.
 	SecretKey []byte
 
-	// NextNodeAddr is the contact information for the next node in the circut.
+	// NextNodeAddr is the contact information for the next relay in the
+	// circut, which the circuit is extended to with an EXTEND cell. It is
+	// empty for the exit relay, which opens streams to the addresses of BEGIN
+	// cells.
 	NextNodeAddr string
 
 	// MaxRandomWaitTime is the maximum time this noe will wait to relay from
@@ -40,8 +52,93 @@ type Request struct {
 }
 
 type Service struct {
-	Node               node.Node
+	Node node.Node
+	// PublicKeyDecrypter decrypts the requests of circuit creators, usually a
+	// crypto.BoxKey. If it is nil the requests must be sent unencrypted.
 	PublicKeyDecrypter crypto.Decrypter
+	// PaddingInterval makes exit relays send a PADDING cell to the circuit
+	// creator every interval. Zero disables padding.
+	PaddingInterval time.Duration
+	// ExitPolicy decides which addresses streams are opened to, and should be
+	// the policy the relay publishes, like a directory.ExitPolicy. BEGIN cells
+	// to other addresses are answered with an END cell. If it is nil, streams
+	// are opened to every address, including loopback and private ones.
+	ExitPolicy ExitPolicy
+}
+
+// ExitPolicy decides which addresses an exit relay opens streams to.
+type ExitPolicy interface {
+	Allows(addr string) bool
+}
+
+// exitStreams are the streams of a circuit at the exit relay. A stream is
+// registered with a nil connection until it is connected.
+type exitStreams struct {
+	lock    *sync.Mutex
+	streams map[uint16]*exitStream
+}
+
+// exitStream is a stream at the exit relay. The data of its DATA cells is
+// queued and written to the connection by its own goroutine, so a slow
+// destination does not delay the other streams of the circuit. The queue
+// holds a whole window, and the circuit creator is sent a SENDME cell when
+// the data is written.
+type exitStream struct {
+	conn      transport.Conn
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce *sync.Once
+
+	lock         *sync.Mutex
+	sendWindow   int
+	windowNotify chan struct{}
+}
+
+func newExitStream() *exitStream {
+	return &exitStream{
+		queue:        make(chan []byte, _streamWindow),
+		done:         make(chan struct{}),
+		closeOnce:    &sync.Once{},
+		lock:         &sync.Mutex{},
+		sendWindow:   _streamWindow,
+		windowNotify: make(chan struct{}, 1),
+	}
+}
+
+// close stops the writer of the stream and closes its connection.
+func (s *exitStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		closeIfSet(s.conn)
+	})
+}
+
+// takeWindow waits until a DATA cell may be sent to the circuit creator and
+// uses up one cell of the send window. It reports false if the stream is
+// closed first.
+func (s *exitStream) takeWindow() bool {
+	for {
+		s.lock.Lock()
+		if s.sendWindow > 0 {
+			s.sendWindow--
+			s.lock.Unlock()
+			return true
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.windowNotify:
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+func (s *exitStream) increaseSendWindow(delta int) {
+	s.lock.Lock()
+	s.sendWindow += delta
+	s.lock.Unlock()
+	notify(s.windowNotify)
 }
 
 func RegisterService(n node.Node) *Service {
@@ -71,34 +168,62 @@ func (s *Service) handler(c transport.Conn) error {
 	}
 
 	req, err := s.readRequest(previousConn)
+	previousConn.Detransform = nil
 	if err != nil {
 		err = fmt.Errorf("%w: %w", ErrInvalidRequest, err)
 		sendFail(previousConn, err)
 		return err
 	}
 
-	nextConn, err := s.Node.DialPeer(
-		context.Background(),
-		peer.New(nil, req.NextNodeAddr),
-	)
-	if err != nil {
-		sendFail(previousConn, err)
-		return err
+	var nextConn transport.Conn
+	if req.NextNodeAddr != "" {
+		nextConn, err = s.Node.DialPeerUsingProcol(
+			context.Background(),
+			OnionProtoID,
+			peer.New(nil, req.NextNodeAddr),
+		)
+		if err != nil {
+			sendFail(previousConn, err)
+			return err
+		}
 	}
 
 	err = sendSuccess(previousConn)
 	if err != nil {
 		c.Close()
+		closeIfSet(nextConn)
 		return err
 	}
 
-	encryptedStream, err := crypto.NewEncryptionStream(req.SecretKey, nextConn)
+	// The circuit creator encrypts the data of this hop, so the relay decrypts
+	// what it receives from the previous node and encrypts what it sends back.
+	encryptedStream, err := crypto.NewAuthenticatedStream(req.SecretKey, false, previousConn)
 	if err != nil {
+		c.Close()
+		closeIfSet(nextConn)
 		return err
 	}
-	nextConn = transport.NewConn(encryptedStream, encryptedStream, nextConn)
+	prevConn := transport.NewConn(encryptedStream, encryptedStream, previousConn)
+
+	if nextConn == nil {
+		s.handleExit(prevConn, req.MaxRandomWaitTime)
+		return nil
+	}
+
+	// Errors after the stream is established are sent in END cells, since the
+	// circuit creator can no longer read a plain failure response.
+	nextPackets := transform.NewConn(nextConn)
+	if err := s.extend(prevConn, nextPackets); err != nil {
+		writeCell(prevConn, endCell(0, err))
+		prevConn.Close()
+		nextConn.Close()
+		s.Node.SendError(fmt.Errorf("onion relay: %w", err))
+		return nil
+	}
 
-	s.handleRelay(previousConn, nextConn, req.MaxRandomWaitTime)
+	// The relay forwards the packets of the next hop one at a time, so every
+	// packet sent on the circuit is encrypted as one frame of the same size.
+	s.handleRelay(transform.NewConn(prevConn), nextPackets, req.MaxRandomWaitTime)
 	return nil
 }
 
@@ -114,6 +239,27 @@ func (s *Service) readRequest(c transport.Conn) (Request, error) {
 	return req, err
 }
 
+// extend waits for the EXTEND cell of the circuit creator and sends the
+// request in it to the next relay. The response is sent back in an EXTENDED
+// cell.
+func (s *Service) extend(prevConn transport.Conn, next *transform.Conn) error {
+	cell, err := readNonPaddingCell(prevConn)
+	if err != nil {
+		return err
+	}
+	if cell.Command != CellExtend {
+		return fmt.Errorf("%w: %v", ErrUnexpectedCell, cell.Command)
+	}
+
+	if _, err := next.Write(cell.Payload); err != nil {
+		return err
+	}
+	if err := readResponse(next); err != nil {
+		return fmt.Errorf("extending circuit: %w", err)
+	}
+	return writeCell(prevConn, Cell{Command: CellExtended})
+}
+
 func (s *Service) handleRelay(
 	prevConn transport.Conn,
 	nextConn transport.Conn,
@@ -135,6 +281,239 @@ func (s *Service) handleRelay(
 	}()
 }
 
+// handleExit handles the cells of a circuit at the exit relay. Streams are
+// opened to the addresses of BEGIN cells, the data of DATA cells is sent to
+// the stream, and data from the stream is sent back in DATA cells. The circuit
+// is torn down with an END cell by either side.
+func (s *Service) handleExit(prevConn transport.Conn, maxRandomWaitTime time.Duration) {
+	done := make(chan struct{})
+	if s.PaddingInterval > 0 {
+		go sendPadding(prevConn, s.PaddingInterval, done)
+	}
+
+	go func() {
+		streams := &exitStreams{
+			lock:    &sync.Mutex{},
+			streams: make(map[uint16]*exitStream),
+		}
+		err := s.handleExitCells(prevConn, streams, maxRandomWaitTime)
+		if err != nil {
+			s.Node.SendError(fmt.Errorf("onion exit: %w", err))
+			writeCell(prevConn, endCell(0, err))
+		}
+
+		close(done)
+		streams.closeAll()
+		prevConn.Close()
+	}()
+}
+
+func (s *Service) handleExitCells(
+	prevConn transport.Conn,
+	streams *exitStreams,
+	maxRandomWaitTime time.Duration,
+) error {
+	for {
+		cell, err := readNonPaddingCell(prevConn)
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			return err
+		}
+
+		if cell.StreamID == 0 {
+			if cell.Command == CellEnd {
+				return nil
+			}
+			return fmt.Errorf("%w: %v on circuit", ErrUnexpectedCell, cell.Command)
+		}
+
+		switch cell.Command {
+		case CellBegin:
+			addr := string(cell.Payload)
+			if s.ExitPolicy != nil && !s.ExitPolicy.Allows(addr) {
+				err := fmt.Errorf("%w: %s", ErrExitNotAllowed, addr)
+				if err := writeCell(prevConn, endCell(cell.StreamID, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			if !streams.register(cell.StreamID) {
+				return fmt.Errorf("%w: stream %v is already open", ErrUnexpectedCell, cell.StreamID)
+			}
+			go s.beginStream(prevConn, streams, cell.StreamID, addr, maxRandomWaitTime)
+		case CellData:
+			// The cell loop never waits for a stream, since the queue of a
+			// stream holds its whole window. The queue is only full if the
+			// circuit creator ignores the window.
+			if !streams.send(cell.StreamID, cell.Payload) {
+				if stream := streams.remove(cell.StreamID); stream != nil {
+					stream.close()
+					writeCell(prevConn, endCell(cell.StreamID, ErrWindowExceeded))
+				}
+			}
+		case CellSendme:
+			streams.increaseSendWindow(cell.StreamID)
+		case CellEnd:
+			if stream := streams.remove(cell.StreamID); stream != nil {
+				stream.close()
+			}
+		default:
+			return fmt.Errorf("%w: %v on stream", ErrUnexpectedCell, cell.Command)
+		}
+	}
+}
+
+// beginStream connects the stream to addr and sends the data read from the
+// connection to the circuit until it is closed.
+func (s *Service) beginStream(
+	prevConn transport.Conn,
+	streams *exitStreams,
+	id uint16,
+	addr string,
+	maxRandomWaitTime time.Duration,
+) {
+	conn, err := s.Node.DialPeer(context.Background(), peer.New(nil, addr))
+	if err != nil {
+		streams.remove(id)
+		writeCell(prevConn, endCell(id, err))
+		return
+	}
+	stream := streams.connect(id, conn)
+	if stream == nil {
+		// The stream was closed by the circuit creator while connecting.
+		conn.Close()
+		return
+	}
+	if err := writeCell(prevConn, Cell{Command: CellConnected, StreamID: id}); err != nil {
+		return
+	}
+	go writeStream(prevConn, streams, id, stream, maxRandomWaitTime)
+
+	err = copyToCells(prevConn, conn, id, stream.takeWindow, maxRandomWaitTime)
+	if streams.remove(id) != nil {
+		stream.close()
+		writeCell(prevConn, endCell(id, err))
+	}
+}
+
+// writeStream writes the queued data of the stream to its connection until
+// the stream is closed. A SENDME cell is sent for every _sendmeIncrement
+// cells written.
+func writeStream(
+	prevConn transport.Conn,
+	streams *exitStreams,
+	id uint16,
+	stream *exitStream,
+	maxRandomWaitTime time.Duration,
+) {
+	delivered := 0
+	for {
+		select {
+		case data := <-stream.queue:
+			randomWait(maxRandomWaitTime)
+			if _, err := stream.conn.Write(data); err != nil {
+				if streams.remove(id) != nil {
+					stream.close()
+					writeCell(prevConn, endCell(id, err))
+				}
+				return
+			}
+
+			delivered++
+			if delivered == _sendmeIncrement {
+				delivered = 0
+				if err := writeCell(prevConn, Cell{Command: CellSendme, StreamID: id}); err != nil {
+					return
+				}
+			}
+		case <-stream.done:
+			return
+		}
+	}
+}
+
+func (s *exitStreams) register(id uint16) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.streams[id]; ok || s.streams == nil {
+		return false
+	}
+	s.streams[id] = newExitStream()
+	return true
+}
+
+// connect sets the connection of the stream. It returns the stream, or nil if
+// the stream is closed.
+func (s *exitStreams) connect(id uint16, conn transport.Conn) *exitStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stream, ok := s.streams[id]
+	if !ok {
+		return nil
+	}
+	stream.conn = conn
+	return stream
+}
+
+// send queues data to be written to the connection of the stream. Data of
+// streams that are closed or not connected is dropped. It reports false if
+// the queue of the stream is full, which means that the window is exceeded.
+func (s *exitStreams) send(id uint16, data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stream := s.streams[id]
+	if stream == nil || stream.conn == nil {
+		return true
+	}
+	select {
+	case stream.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// increaseSendWindow lets the stream send _sendmeIncrement more DATA cells.
+// SENDME cells of streams that are closed are dropped.
+func (s *exitStreams) increaseSendWindow(id uint16) {
+	s.lock.Lock()
+	stream := s.streams[id]
+	s.lock.Unlock()
+
+	if stream != nil {
+		stream.increaseSendWindow(_sendmeIncrement)
+	}
+}
+
+// remove removes the stream and returns it, or nil if the stream was already
+// removed.
+func (s *exitStreams) remove(id uint16) *exitStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stream := s.streams[id]
+	delete(s.streams, id)
+	return stream
+}
+
+// closeAll closes all streams. Streams connected later are closed by
+// beginStream.
+func (s *exitStreams) closeAll() {
+	s.lock.Lock()
+	streams := s.streams
+	s.streams = nil
+	s.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.close()
+	}
+}
+
 // sendFail informs the circuit creator that the exist node failed to establish
 // a connection with the node specified in the request.
 func sendFail(w io.Writer, err error) {
@@ -151,13 +530,11 @@ func copyWithRandomWait(dst io.Writer, src io.Reader, wait time.Duration) error
 	buf := make([]byte, size)
 
 	for {
-		if int64(wait) > 0 {
-			time.Sleep(time.Duration((rand.Int64N(int64(wait)))))
-		}
+		randomWait(wait)
 
 		numRead, err := src.Read(buf)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if isClosed(err) {
 				return nil
 			}
 			return err
@@ -168,6 +545,9 @@ func copyWithRandomWait(dst io.Writer, src io.Reader, wait time.Duration) error
 
 		numWritten, err := dst.Write(buf[0:numRead])
 		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
 			return err
 		}
 		if numWritten != numRead {
@@ -175,3 +555,111 @@ func copyWithRandomWait(dst io.Writer, src io.Reader, wait time.Duration) error
 		}
 	}
 }
+
+// copyToCells sends the data read from src to dst in DATA cells of the
+// stream. Nothing is read from src until takeWindow allows another cell to be
+// sent, and it returns when takeWindow reports false.
+func copyToCells(
+	dst io.Writer,
+	src io.Reader,
+	streamID uint16,
+	takeWindow func() bool,
+	wait time.Duration,
+) error {
+	buf := make([]byte, MaxCellPayload)
+	for {
+		if !takeWindow() {
+			return nil
+		}
+		randomWait(wait)
+
+		numRead, err := src.Read(buf)
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			return err
+		}
+		if numRead <= 0 {
+			continue
+		}
+
+		err = writeCell(dst, Cell{Command: CellData, StreamID: streamID, Payload: buf[:numRead]})
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func readNonPaddingCell(r io.Reader) (Cell, error) {
+	for {
+		cell, err := readCell(r)
+		if err != nil || cell.Command != CellPadding {
+			return cell, err
+		}
+	}
+}
+
+// sendPadding writes a PADDING cell to w every interval until done is closed
+// or writing fails.
+func sendPadding(w io.Writer, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := writeCell(w, Cell{Command: CellPadding}); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// endCell returns the END cell closing the stream, or the circuit if streamID
+// is zero, because of err, which may be nil.
+func endCell(streamID uint16, err error) Cell {
+	if err == nil {
+		return Cell{Command: CellEnd, StreamID: streamID}
+	}
+
+	reason := []byte(err.Error())
+	return Cell{
+		Command:  CellEnd,
+		StreamID: streamID,
+		Payload:  reason[:min(len(reason), MaxCellPayload)],
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func closeIfSet(c io.Closer) {
+	if c != nil {
+		c.Close()
+	}
+}
+
+func randomWait(wait time.Duration) {
+	if int64(wait) > 0 {
+		time.Sleep(time.Duration((rand.Int64N(int64(wait)))))
+	}
+}
+
+// isClosed reports whether err is caused by the connection being closed, which
+// happens when the other direction of the relay or the remote is done.
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -3,8 +3,10 @@ package onion
 import (
 	"context"
 	"crypto/rand"
+	"io"
 	"testing"
 
+	"github.com/FluffyKebab/pearly/crypto"
 	"github.com/FluffyKebab/pearly/node/basic"
 	"github.com/FluffyKebab/pearly/peer"
 	"github.com/FluffyKebab/pearly/protocolmux/multistream"
@@ -15,36 +17,108 @@ import (
 )
 
 func TestOnion(t *testing.T) {
-	peers := make([]peer.Peer, 0)
-	for i := 0; i < 10; i++ {
+	peers := startRelays(t, 10, false)
+	testCircuit(t, NewClient(multistream.NewMuxer(), newClientTransport(t)), peers)
+}
+
+func TestOnionEncryptedRequest(t *testing.T) {
+	peers := startRelays(t, 5, true)
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	client.EncryptRequest = true
+	testCircuit(t, client, peers)
+}
+
+func TestOnionRejectsUnencryptedRequest(t *testing.T) {
+	peers := startRelays(t, 2, true)
+	peers = append(peers, startFinalNode(t, nil))
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	_, failed, err := client.EstablishCircuit(context.Background(), peers)
+	require.Error(t, err)
+	require.Equal(t, 0, failed)
+}
+
+func TestOnionEncryptedRequestMissingPublicKey(t *testing.T) {
+	peers := startRelays(t, 2, false)
+	peers = append(peers, startFinalNode(t, nil))
+
+	client := NewClient(multistream.NewMuxer(), newClientTransport(t))
+	client.EncryptRequest = true
+	_, _, err := client.EstablishCircuit(context.Background(), peers)
+	require.ErrorIs(t, err, ErrMissingPublicKey)
+}
+
+// startRelays starts n onion relays. If withKeys is true every relay decrypts
+// requests with its own box key, which is the public key of its peer.
+func startRelays(t *testing.T, n int, withKeys bool) []peer.Peer {
+	t.Helper()
+
+	peers := make([]peer.Peer, 0, n)
+	for i := 0; i < n; i++ {
 		curPort, err := testutil.GetAvailablePort()
 		require.NoError(t, err)
 
-		n := basic.New(tcp.New(curPort), nil)
-		RegisterService(n).Run()
-		errChan, _ := n.Run(context.Background())
-		go func() {
-			err := <-errChan
-			require.NoError(t, err)
-		}()
+		p, _ := startRelay(t, tcp.New(curPort), withKeys)
+		peers = append(peers, p)
+	}
+	return peers
+}
 
-		peers = append(peers, peer.New(nil, "127.0.0.1:"+curPort))
+func startRelay(t *testing.T, tr transport.Transport, withKey bool) (peer.Peer, *Service) {
+	t.Helper()
+
+	n := basic.New(tr, nil)
+	service := RegisterService(n)
+	p := peer.New(nil, tr.ListenAddr())
+	if withKey {
+		key, err := crypto.GenerateBoxKey()
+		require.NoError(t, err)
+		service.PublicKeyDecrypter = key
+		p = peer.NewWithPublicKey(p.PublicAddr(), key.PublicKey())
 	}
+	service.Run()
+
+	errChan, _ := n.Run(context.Background())
+	go func() {
+		err := <-errChan
+		require.NoError(t, err)
+	}()
+	return p, service
+}
+
+func startFinalNode(t *testing.T, handler func(c transport.Conn) error) peer.Peer {
+	t.Helper()
 
 	curPort, err := testutil.GetAvailablePort()
 	require.NoError(t, err)
 
 	finalNode := basic.New(tcp.New(curPort), nil)
+	if handler != nil {
+		finalNode.SetConnHandler(handler)
+	}
 	finalNode.Run(context.Background())
-	peers = append(peers, peer.New(nil, "127.0.0.1:"+curPort))
+	return peer.New(nil, "127.0.0.1:"+curPort)
+}
+
+func newClientTransport(t *testing.T) transport.Transport {
+	t.Helper()
+
+	clientPort, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	return tcp.New(clientPort)
+}
+
+// testCircuit establishes a circuit through the relays to a node that echoes
+// one message.
+func testCircuit(t *testing.T, client Client, relays []peer.Peer) {
+	t.Helper()
 
 	msgSize := 1024 * 9
 	msgToSend := make([]byte, msgSize)
 	rand.Read(msgToSend)
 
-	finalNode.SetConnHandler(func(c transport.Conn) error {
-		t.Helper()
-
+	peers := append(relays, startFinalNode(t, func(c transport.Conn) error {
 		buf := make([]byte, msgSize)
 		numRead := 0
 		for numRead < msgSize {
@@ -56,14 +130,10 @@ func TestOnion(t *testing.T) {
 
 		msgSent := make([]byte, msgSize)
 		copy(msgSent, msgToSend)
-		_, err = c.Write([]byte(msgSent))
+		_, err := c.Write([]byte(msgSent))
 		require.NoError(t, err)
 		return nil
-	})
-
-	clientPort, err := testutil.GetAvailablePort()
-	require.NoError(t, err)
-	client := NewClient(multistream.NewMuxer(), tcp.New(clientPort))
+	}))
 
 	conn, _, err := client.EstablishCircuit(context.Background(), peers)
 	require.NoError(t, err)
@@ -74,7 +144,8 @@ func TestOnion(t *testing.T) {
 	require.NoError(t, err)
 
 	buf := make([]byte, msgSize)
-	n, err := conn.Read(buf)
+	_, err = io.ReadFull(conn, buf)
 	require.NoError(t, err)
-	require.Equal(t, msgToSend, buf[:n])
+	require.Equal(t, msgToSend, buf)
+	require.NoError(t, conn.Close())
 }
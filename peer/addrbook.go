@@ -0,0 +1,166 @@
+package peer
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AddrSource is where an address in the address book was learned from.
+type AddrSource int
+
+const (
+	SourceManual AddrSource = iota
+	SourceIdentify
+	SourceDHT
+)
+
+// PermanentAddrTTL is used for addresses that should never expire.
+const PermanentAddrTTL = time.Duration(math.MaxInt64)
+
+func (s AddrSource) String() string {
+	switch s {
+	case SourceManual:
+		return "manual"
+	case SourceIdentify:
+		return "identify"
+	case SourceDHT:
+		return "dht"
+	default:
+		return "unknown"
+	}
+}
+
+// AddrBook stores the addresses of peers keyed by their ID.
+type AddrBook interface {
+	// AddAddr adds an address of a peer that is valid for ttl. If the address
+	// is already known, the expiration is extended if the new ttl is longer.
+	AddAddr(id []byte, addr string, ttl time.Duration, source AddrSource)
+	RemoveAddr(id []byte, addr string)
+
+	// Addrs returns the addresses of a peer that have not expired, ordered by
+	// how successful previous dials to them have been. Addresses that are
+	// equally successful are ordered by source, with manual addresses first.
+	Addrs(id []byte) []string
+
+	// ReportDial records the result of dialing an address of a peer.
+	ReportDial(id []byte, addr string, err error)
+}
+
+type addrEntry struct {
+	addr        string
+	source      AddrSource
+	expires     time.Time
+	successes   int
+	failures    int
+	lastSuccess time.Time
+}
+
+type addrBook struct {
+	lock  *sync.Mutex
+	addrs map[string][]*addrEntry
+	now   func() time.Time
+}
+
+var _ AddrBook = &addrBook{}
+
+func NewAddrBook() AddrBook {
+	return &addrBook{
+		lock:  &sync.Mutex{},
+		addrs: make(map[string][]*addrEntry),
+		now:   time.Now,
+	}
+}
+
+func (b *addrBook) AddAddr(id []byte, addr string, ttl time.Duration, source AddrSource) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	expires := b.now().Add(ttl)
+	if entry := b.entry(id, addr); entry != nil {
+		if expires.After(entry.expires) {
+			entry.expires = expires
+		}
+		if source == SourceManual {
+			entry.source = source
+		}
+		return
+	}
+
+	b.addrs[string(id)] = append(b.addrs[string(id)], &addrEntry{
+		addr:    addr,
+		source:  source,
+		expires: expires,
+	})
+}
+
+func (b *addrBook) RemoveAddr(id []byte, addr string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.addrs[string(id)] = slices.DeleteFunc(b.addrs[string(id)], func(e *addrEntry) bool {
+		return e.addr == addr
+	})
+	if len(b.addrs[string(id)]) == 0 {
+		delete(b.addrs, string(id))
+	}
+}
+
+func (b *addrBook) Addrs(id []byte) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	b.addrs[string(id)] = slices.DeleteFunc(b.addrs[string(id)], func(e *addrEntry) bool {
+		return now.After(e.expires)
+	})
+	if len(b.addrs[string(id)]) == 0 {
+		delete(b.addrs, string(id))
+		return nil
+	}
+
+	entries := slices.Clone(b.addrs[string(id)])
+	slices.SortStableFunc(entries, func(a, b *addrEntry) int {
+		if scoreA, scoreB := a.successes-a.failures, b.successes-b.failures; scoreA != scoreB {
+			return scoreB - scoreA
+		}
+		if c := b.lastSuccess.Compare(a.lastSuccess); c != 0 {
+			return c
+		}
+		return int(a.source) - int(b.source)
+	})
+
+	res := make([]string, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e.addr)
+	}
+	return res
+}
+
+func (b *addrBook) ReportDial(id []byte, addr string, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	entry := b.entry(id, addr)
+	if entry == nil {
+		return
+	}
+
+	if err != nil {
+		entry.failures++
+		return
+	}
+	entry.successes++
+	entry.lastSuccess = b.now()
+}
+
+// entry must be called with the lock held.
+func (b *addrBook) entry(id []byte, addr string) *addrEntry {
+	for _, e := range b.addrs[string(id)] {
+		if e.addr == addr {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package peer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrBookOrder(t *testing.T) {
+	b := NewAddrBook()
+	id := []byte("peer")
+
+	b.AddAddr(id, "dht", time.Hour, SourceDHT)
+	b.AddAddr(id, "identify", time.Hour, SourceIdentify)
+	b.AddAddr(id, "manual", time.Hour, SourceManual)
+	require.Equal(t, []string{"manual", "identify", "dht"}, b.Addrs(id))
+
+	b.ReportDial(id, "manual", errors.New("failed"))
+	b.ReportDial(id, "dht", nil)
+	require.Equal(t, []string{"dht", "identify", "manual"}, b.Addrs(id))
+
+	b.RemoveAddr(id, "dht")
+	require.Equal(t, []string{"identify", "manual"}, b.Addrs(id))
+	require.Empty(t, b.Addrs([]byte("unknown")))
+}
+
+func TestAddrBookTTL(t *testing.T) {
+	now := time.Now()
+	b := NewAddrBook().(*addrBook)
+	b.now = func() time.Time { return now }
+	id := []byte("peer")
+
+	b.AddAddr(id, "short", time.Minute, SourceDHT)
+	b.AddAddr(id, "long", time.Hour, SourceDHT)
+	b.AddAddr(id, "permanent", PermanentAddrTTL, SourceManual)
+	require.Len(t, b.Addrs(id), 3)
+
+	// Adding an address again extends the ttl.
+	b.AddAddr(id, "short", 2*time.Minute, SourceDHT)
+
+	now = now.Add(90 * time.Second)
+	require.Equal(t, []string{"permanent", "short", "long"}, b.Addrs(id))
+
+	now = now.Add(time.Hour)
+	require.Equal(t, []string{"permanent"}, b.Addrs(id))
+}
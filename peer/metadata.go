@@ -0,0 +1,50 @@
+package peer
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrMetadataNotFound = errors.New("metadata not found")
+
+// MetadataBook stores metadata about peers keyed by their ID.
+type MetadataBook interface {
+	Get(id []byte, key string) (any, error)
+	Put(id []byte, key string, value any) error
+}
+
+type metadataBook struct {
+	lock *sync.RWMutex
+	data map[string]map[string]any
+}
+
+var _ MetadataBook = metadataBook{}
+
+func NewMetadataBook() MetadataBook {
+	return metadataBook{
+		lock: &sync.RWMutex{},
+		data: make(map[string]map[string]any),
+	}
+}
+
+func (b metadataBook) Get(id []byte, key string) (any, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	value, ok := b.data[string(id)][key]
+	if !ok {
+		return nil, ErrMetadataNotFound
+	}
+	return value, nil
+}
+
+func (b metadataBook) Put(id []byte, key string, value any) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.data[string(id)]; !ok {
+		b.data[string(id)] = make(map[string]any)
+	}
+	b.data[string(id)][key] = value
+	return nil
+}
@@ -48,6 +48,9 @@ func New(id []byte, addr string) Peer {
 	}
 }
 
+// NewWithPublicKey creates a peer with the ID derived from its public key,
+// marshaled with crypto.MarshalPublicKey. The ID is the SHA-256 hash of the
+// marshaled key, which is the same as crypto.PeerID.
 func NewWithPublicKey(addr string, pubKey []byte) Peer {
 	id := sha256.Sum256(pubKey)
 	return &peer{
@@ -0,0 +1,233 @@
+package identify
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/FluffyKebab/pearly/node"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+const (
+	ProtoID             = "/identify"
+	PushProtoID         = "/identify/push"
+	DefaultAgentVersion = "pearly"
+)
+
+// Keys used to store the information about a peer in the metadata book.
+const (
+	AgentVersionKey = "identify/agent-version"
+	ProtocolsKey    = "identify/protocols"
+	ListenAddrsKey  = "identify/listen-addrs"
+	ObservedAddrKey = "identify/observed-addr"
+)
+
+var ErrIDMismatch = errors.New("identified peer id does not match remote id")
+
+// Info is the information a node sends about itself.
+type Info struct {
+	ID           []byte
+	AgentVersion string
+	Protocols    []string
+	ListenAddrs  []string
+
+	// ObservedAddr is the address the sender sees the receiver connecting
+	// from or being reachable at.
+	ObservedAddr string
+}
+
+type Service struct {
+	node node.Node
+	book peer.MetadataBook
+
+	AgentVersion string
+	PushTimeout  time.Duration
+
+	// AddrBook is optional. If set, the listen addresses of identified peers
+	// are added to it with AddrTTL.
+	AddrBook peer.AddrBook
+	AddrTTL  time.Duration
+
+	lock       *sync.Mutex
+	identified map[string]peer.Peer
+}
+
+func Register(n node.Node, book peer.MetadataBook) *Service {
+	return &Service{
+		node:         n,
+		book:         book,
+		AgentVersion: DefaultAgentVersion,
+		PushTimeout:  10 * time.Second,
+		AddrTTL:      time.Hour,
+		lock:         &sync.Mutex{},
+		identified:   make(map[string]peer.Peer),
+	}
+}
+
+func (s *Service) Run() {
+	s.node.RegisterProtocol(ProtoID, func(c transport.Conn) error {
+		defer c.Close()
+
+		var remoteInfo Info
+		err := gob.NewDecoder(c).Decode(&remoteInfo)
+		if err != nil {
+			return fmt.Errorf("identify decoding: %w", err)
+		}
+
+		err = gob.NewEncoder(c).Encode(s.Info(remoteAddr(c)))
+		if err != nil {
+			return fmt.Errorf("identify sending info: %w", err)
+		}
+
+		err = s.store(c, remoteInfo, "")
+		return err
+	})
+
+	s.node.RegisterProtocol(PushProtoID, func(c transport.Conn) error {
+		defer c.Close()
+
+		var remoteInfo Info
+		err := gob.NewDecoder(c).Decode(&remoteInfo)
+		if err != nil {
+			return fmt.Errorf("identify push decoding: %w", err)
+		}
+
+		err = s.store(c, remoteInfo, "")
+		return err
+	})
+
+	s.node.NotifyProtocolsChanged(func([]string) {
+		go s.Push(context.Background())
+	})
+}
+
+// Identify exchanges information with the peer. The information received is
+// stored in the metadata book and both nodes will receive updates when the
+// protocols of the other node change.
+func (s *Service) Identify(ctx context.Context, p peer.Peer) (Info, error) {
+	c, err := s.node.DialPeerUsingProcol(ctx, ProtoID, p)
+	if err != nil {
+		return Info{}, err
+	}
+	defer c.Close()
+
+	err = gob.NewEncoder(c).Encode(s.Info(p.PublicAddr()))
+	if err != nil {
+		return Info{}, err
+	}
+
+	var remoteInfo Info
+	err = gob.NewDecoder(c).Decode(&remoteInfo)
+	if err != nil {
+		return Info{}, err
+	}
+
+	err = s.store(c, remoteInfo, p.PublicAddr())
+	if err != nil {
+		return Info{}, err
+	}
+
+	return remoteInfo, nil
+}
+
+// Push sends the current information of this node to all identified peers.
+func (s *Service) Push(ctx context.Context) {
+	ctx, cancelFunc := context.WithTimeout(ctx, s.PushTimeout)
+	defer cancelFunc()
+
+	s.lock.Lock()
+	peers := make([]peer.Peer, 0, len(s.identified))
+	for _, p := range s.identified {
+		peers = append(peers, p)
+	}
+	s.lock.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.push(ctx, p); err != nil {
+				s.node.SendError(fmt.Errorf("identify push: %w", err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Service) push(ctx context.Context, p peer.Peer) error {
+	c, err := s.node.DialPeerUsingProcol(ctx, PushProtoID, p)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return gob.NewEncoder(c).Encode(s.Info(p.PublicAddr()))
+}
+
+// Info returns the information this node sends to other nodes.
+func (s *Service) Info(observedAddr string) Info {
+	return Info{
+		ID:           s.node.ID(),
+		AgentVersion: s.AgentVersion,
+		Protocols:    s.node.Protocols(),
+		ListenAddrs:  []string{s.node.Transport().ListenAddr()},
+		ObservedAddr: observedAddr,
+	}
+}
+
+// store saves the info in the metadata book and remembers the peer so that it
+// receives pushes. If the connection knows the ID of the remote, it must match
+// the ID in the info.
+func (s *Service) store(c transport.Conn, info Info, addr string) error {
+	id := info.ID
+	if ider, ok := c.(transport.RemoteIDHaver); ok {
+		if !bytes.Equal(ider.RemoteID(), info.ID) {
+			return ErrIDMismatch
+		}
+		id = ider.RemoteID()
+	}
+
+	listenAddrs := info.ListenAddrs
+	if len(listenAddrs) == 0 && addr != "" {
+		listenAddrs = []string{addr}
+	}
+
+	for key, value := range map[string]any{
+		AgentVersionKey: info.AgentVersion,
+		ProtocolsKey:    info.Protocols,
+		ListenAddrsKey:  listenAddrs,
+		ObservedAddrKey: info.ObservedAddr,
+	} {
+		if err := s.book.Put(id, key, value); err != nil {
+			return err
+		}
+	}
+
+	if s.AddrBook != nil {
+		for _, addr := range listenAddrs {
+			s.AddrBook.AddAddr(id, addr, s.AddrTTL, peer.SourceIdentify)
+		}
+	}
+
+	if len(listenAddrs) != 0 {
+		s.lock.Lock()
+		s.identified[string(id)] = peer.New(id, listenAddrs[0])
+		s.lock.Unlock()
+	}
+
+	return nil
+}
+
+func remoteAddr(c transport.Conn) string {
+	if addrHaver, ok := c.(transport.RemoteAddrHaver); ok {
+		return addrHaver.RemoteAddr()
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package identify
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/node/basic"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/FluffyKebab/pearly/transport/encrypted"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+func createNode(t *testing.T, ctx context.Context) (*basic.Node, *Service, peer.MetadataBook, <-chan error) {
+	t.Helper()
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	transport, err := encrypted.NewTransport(tcp.New(port))
+	require.NoError(t, err)
+
+	n := basic.New(transport, transport.ID())
+	errChan, err := n.Run(ctx)
+	require.NoError(t, err)
+
+	book := peer.NewMetadataBook()
+	service := Register(n, book)
+	service.Run()
+
+	return n, service, book, errChan
+}
+
+func TestIdentify(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	node1, service1, book1, errChan1 := createNode(t, ctx)
+	node2, _, book2, errChan2 := createNode(t, ctx)
+	node2.RegisterProtocol("/ping", func(c transport.Conn) error { return nil })
+
+	addrBook := peer.NewAddrBook()
+	service1.AddrBook = addrBook
+
+	info, err := service1.Identify(ctx, peer.New(node2.ID(), node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+	require.Equal(t, node2.ID(), info.ID)
+	require.Equal(t, []string{"/identify", "/identify/push", "/ping"}, info.Protocols)
+
+	agentVersion, err := book1.Get(node2.ID(), AgentVersionKey)
+	require.NoError(t, err)
+	require.Equal(t, DefaultAgentVersion, agentVersion)
+
+	listenAddrs, err := book1.Get(node2.ID(), ListenAddrsKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{node2.Transport().ListenAddr()}, listenAddrs)
+
+	require.Equal(t, []string{node2.Transport().ListenAddr()}, addrBook.Addrs(node2.ID()))
+
+	observedAddr, err := book1.Get(node2.ID(), ObservedAddrKey)
+	require.NoError(t, err)
+	require.NotEmpty(t, observedAddr)
+
+	// The exchange goes both ways.
+	protocols, err := book2.Get(node1.ID(), ProtocolsKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/identify", "/identify/push"}, protocols)
+
+	select {
+	case err := <-testutil.CombineErrChan(errChan1, errChan2):
+		require.NoError(t, err)
+	default:
+	}
+}
+
+func TestIdentifyPush(t *testing.T) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	node1, service1, book1, _ := createNode(t, ctx)
+	node2, _, book2, _ := createNode(t, ctx)
+
+	_, err := service1.Identify(ctx, peer.New(node2.ID(), node2.Transport().ListenAddr()))
+	require.NoError(t, err)
+
+	// Both the node that started the exchange and the one that responded push
+	// updates when they register new protocols.
+	node2.RegisterProtocol("/new2", func(c transport.Conn) error { return nil })
+	node1.RegisterProtocol("/new1", func(c transport.Conn) error { return nil })
+
+	require.Eventually(t, func() bool {
+		protocols, err := book1.Get(node2.ID(), ProtocolsKey)
+		return err == nil && len(protocols.([]string)) == 3
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		protocols, err := book2.Get(node1.ID(), ProtocolsKey)
+		return err == nil && len(protocols.([]string)) == 3
+	}, 3*time.Second, 10*time.Millisecond)
+
+	protocols, err := book1.Get(node2.ID(), ProtocolsKey)
+	require.NoError(t, err)
+	require.Contains(t, protocols, "/new2")
+}
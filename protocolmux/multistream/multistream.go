@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 
 	"github.com/FluffyKebab/pearly/protocolmux"
 	"github.com/FluffyKebab/pearly/transport"
@@ -28,19 +29,31 @@ func (m Muxer) RegisterProtocol(protoID string, handler func(transport.Conn) err
 	})
 }
 
+func (m Muxer) RemoveProtocol(protoID string) {
+	m.mux.RemoveHandler(protoID)
+}
+
+// Protocols returns the sorted IDs of the registered protocols.
+func (m Muxer) Protocols() []string {
+	protoIDs := m.mux.Protocols()
+	slices.Sort(protoIDs)
+	return protoIDs
+}
+
 func (m Muxer) SelectProtocol(ctx context.Context, protoID string, c transport.Conn) error {
-	done := make(chan error)
-	go func() {
-		err := ms.SelectProtoOrFail(protoID, c)
-		done <- err
-	}()
-
-	select {
-	case err := <-done:
-		return err
-	case <-ctx.Done():
-		return fmt.Errorf("select protocol: %w", context.Canceled)
+	_, err := m.SelectOneOf(ctx, []string{protoID}, c)
+	return err
+}
+
+// SelectOneOf selects the first protocol in protoIDs supported by the remote.
+// The connection is closed if ctx is done before a protocol is selected.
+func (m Muxer) SelectOneOf(ctx context.Context, protoIDs []string, c transport.Conn) (string, error) {
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	protoID, err := ms.SelectOneOf(protoIDs, c)
+	if !stop() {
+		return "", fmt.Errorf("select protocol: %w", ctx.Err())
 	}
+	return protoID, err
 }
 
 func (m Muxer) HandleConn(c transport.Conn) error {
@@ -0,0 +1,25 @@
+package multistream
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectOneOfDeadline(t *testing.T) {
+	// The remote never answers, so the selection blocks until the deadline.
+	c, remote := net.Pipe()
+	defer remote.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := NewMuxer().SelectOneOf(ctx, []string{"/test"}, c)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = c.Write([]byte("closed"))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
@@ -0,0 +1,269 @@
+package native
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/FluffyKebab/pearly/protocolmux"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+// Messages are prefixed by their length as a uvarint and start with one of the
+// commands below. Both the dialer and the listener must use this muxer.
+const (
+	_cmdSelect   = 's'
+	_cmdList     = 'l'
+	_cmdAccept   = 'a'
+	_cmdReject   = 'n'
+	_cmdProtoIDs = 'p'
+
+	_maxMessageSize = 64 << 10
+)
+
+var (
+	ErrProtocolNotSupported = errors.New("protocol not supported")
+	ErrInvalidMessage       = errors.New("invalid negotiation message")
+)
+
+// Muxer negotiates protocols in a single round trip. A selected protocol ID
+// can end with a version constraint, like /kdmstore/^1.0, in which case the
+// highest registered version of the protocol matching the constraint is used.
+type Muxer struct {
+	lock     *sync.RWMutex
+	handlers map[string]func(transport.Conn) error
+}
+
+var _ protocolmux.Muxer = Muxer{}
+
+func NewMuxer() Muxer {
+	return Muxer{
+		lock:     &sync.RWMutex{},
+		handlers: make(map[string]func(transport.Conn) error),
+	}
+}
+
+func (m Muxer) RegisterProtocol(protoID string, handler func(transport.Conn) error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.handlers[protoID] = handler
+}
+
+func (m Muxer) RemoveProtocol(protoID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.handlers, protoID)
+}
+
+// Protocols returns the sorted IDs of the registered protocols.
+func (m Muxer) Protocols() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	protoIDs := make([]string, 0, len(m.handlers))
+	for protoID := range m.handlers {
+		protoIDs = append(protoIDs, protoID)
+	}
+	slices.Sort(protoIDs)
+	return protoIDs
+}
+
+func (m Muxer) SelectProtocol(ctx context.Context, protoID string, c transport.Conn) error {
+	_, err := m.Select(ctx, protoID, c)
+	return err
+}
+
+// Select selects the protocol and returns the ID of the protocol chosen by
+// the remote. If ctx is done before the negotiation is done, the connection
+// is closed.
+func (m Muxer) Select(ctx context.Context, protoID string, c transport.Conn) (string, error) {
+	var selected string
+	err := negotiate(ctx, c, func() error {
+		if err := writeMessage(c, _cmdSelect, protoID); err != nil {
+			return err
+		}
+
+		cmd, payload, err := readMessage(c)
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case _cmdAccept:
+			selected = payload
+			return nil
+		case _cmdReject:
+			return fmt.Errorf("%w: %s", ErrProtocolNotSupported, protoID)
+		default:
+			return ErrInvalidMessage
+		}
+	})
+	return selected, err
+}
+
+// SelectOneOf tries to select the protocols in order and returns the first
+// one the remote accepts. All protocols are tried on the same connection.
+func (m Muxer) SelectOneOf(ctx context.Context, protoIDs []string, c transport.Conn) (string, error) {
+	for _, protoID := range protoIDs {
+		selected, err := m.Select(ctx, protoID, c)
+		if err == nil {
+			return selected, nil
+		}
+		if !errors.Is(err, ErrProtocolNotSupported) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrProtocolNotSupported, strings.Join(protoIDs, ", "))
+}
+
+// ListProtocols asks the remote which protocols it supports. A protocol can
+// be selected on the connection afterwards.
+func (m Muxer) ListProtocols(ctx context.Context, c transport.Conn) ([]string, error) {
+	var protoIDs []string
+	err := negotiate(ctx, c, func() error {
+		if err := writeMessage(c, _cmdList, ""); err != nil {
+			return err
+		}
+
+		cmd, payload, err := readMessage(c)
+		if err != nil {
+			return err
+		}
+		if cmd != _cmdProtoIDs {
+			return ErrInvalidMessage
+		}
+
+		if payload != "" {
+			protoIDs = strings.Split(payload, "\n")
+		}
+		return nil
+	})
+	return protoIDs, err
+}
+
+// HandleConn answers list requests and selections until a protocol is
+// selected, and then calls the handler of the protocol.
+func (m Muxer) HandleConn(c transport.Conn) error {
+	for {
+		cmd, payload, err := readMessage(c)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		switch cmd {
+		case _cmdList:
+			err = writeMessage(c, _cmdProtoIDs, strings.Join(m.Protocols(), "\n"))
+		case _cmdSelect:
+			protoID, handler, ok := m.match(payload)
+			if !ok {
+				err = writeMessage(c, _cmdReject, "")
+				break
+			}
+
+			if err := writeMessage(c, _cmdAccept, protoID); err != nil {
+				return err
+			}
+			return handler(c)
+		default:
+			return ErrInvalidMessage
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// match returns the handler of the protocol with the exact ID, or else the
+// highest version of the protocol matching the version constraint.
+func (m Muxer) match(protoID string) (string, func(transport.Conn) error, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if handler, ok := m.handlers[protoID]; ok {
+		return protoID, handler, true
+	}
+
+	base, rawConstraint := splitProtoID(protoID)
+	c, err := parseConstraint(rawConstraint)
+	if err != nil {
+		return "", nil, false
+	}
+
+	var (
+		bestID      string
+		bestVersion version
+	)
+	for registered := range m.handlers {
+		registeredBase, rawVersion := splitProtoID(registered)
+		if registeredBase != base {
+			continue
+		}
+
+		v, err := parseVersion(rawVersion)
+		if err != nil || !c.matches(v) {
+			continue
+		}
+		if bestID == "" || v.compare(bestVersion) > 0 {
+			bestID, bestVersion = registered, v
+		}
+	}
+
+	if bestID == "" {
+		return "", nil, false
+	}
+	return bestID, m.handlers[bestID], true
+}
+
+// negotiate runs f and closes the connection if ctx is done first.
+func negotiate(ctx context.Context, c transport.Conn, f func() error) error {
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	err := f()
+	if !stop() {
+		return fmt.Errorf("select protocol: %w", ctx.Err())
+	}
+	return err
+}
+
+func writeMessage(w io.Writer, cmd byte, payload string) error {
+	msg := binary.AppendUvarint(nil, uint64(len(payload)+1))
+	msg = append(msg, cmd)
+	_, err := w.Write(append(msg, payload...))
+	return err
+}
+
+// readMessage reads one byte at the time so that no data after the message is
+// consumed.
+func readMessage(r io.Reader) (byte, string, error) {
+	br := byteReader{r}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, "", err
+	}
+	if size == 0 || size > _maxMessageSize {
+		return 0, "", ErrInvalidMessage
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, "", err
+	}
+	return msg[0], string(msg[1:]), nil
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	b := [1]byte{}
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
@@ -0,0 +1,142 @@
+package native
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConstraint(t *testing.T) {
+	testCases := []struct {
+		constraint string
+		version    string
+		matches    bool
+	}{
+		{"^1.0", "1.2.0", true},
+		{"^1.0", "2.0.0", false},
+		{"^1.3", "1.2.0", false},
+		{"^0.2", "0.2.5", true},
+		{"^0.2", "0.3.0", false},
+		{"~1.2", "1.2.9", true},
+		{"~1.2", "1.3.0", false},
+		{"1.2.0", "1.2.0", true},
+		{"1.2.0", "1.2.1", false},
+	}
+
+	for _, tc := range testCases {
+		c, err := parseConstraint(tc.constraint)
+		require.NoError(t, err)
+		v, err := parseVersion(tc.version)
+		require.NoError(t, err)
+		require.Equal(t, tc.matches, c.matches(v), "%s %s", tc.constraint, tc.version)
+	}
+
+	_, err := parseConstraint("^x")
+	require.ErrorIs(t, err, ErrInvalidVersion)
+}
+
+func TestMuxer(t *testing.T) {
+	listener := NewMuxer()
+	handled := make(chan string, 1)
+	for _, protoID := range []string{"/kdmstore/1.0.0", "/kdmstore/1.2.0", "/kdmstore/2.0.0", "/ping"} {
+		listener.RegisterProtocol(protoID, func(c transport.Conn) error {
+			handled <- protoID
+			_, err := c.Write([]byte("ok"))
+			return err
+		})
+	}
+
+	dialer := NewMuxer()
+	select1 := func(protoIDs ...string) (string, error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			listener.HandleConn(c2)
+			c2.Close()
+		}()
+
+		var (
+			selected string
+			err      error
+		)
+		for _, protoID := range protoIDs {
+			selected, err = dialer.Select(context.Background(), protoID, c1)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(c1, buf)
+		require.NoError(t, err)
+		require.Equal(t, selected, <-handled)
+		return selected, nil
+	}
+
+	selected, err := select1("/kdmstore/^1.0")
+	require.NoError(t, err)
+	require.Equal(t, "/kdmstore/1.2.0", selected)
+
+	selected, err = select1("/ping")
+	require.NoError(t, err)
+	require.Equal(t, "/ping", selected)
+
+	// A rejected selection can be followed by another on the same conn.
+	selected, err = select1("/kdmstore/^3.0", "/kdmstore/~2.0")
+	require.NoError(t, err)
+	require.Equal(t, "/kdmstore/2.0.0", selected)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go listener.HandleConn(c2)
+	selected, err = dialer.SelectOneOf(context.Background(), []string{"/missing", "/ping"}, c1)
+	require.NoError(t, err)
+	require.Equal(t, "/ping", selected)
+	require.Equal(t, "/ping", <-handled)
+
+	_, err = select1("/missing")
+	require.ErrorIs(t, err, ErrProtocolNotSupported)
+}
+
+func TestListProtocols(t *testing.T) {
+	listener := NewMuxer()
+	listener.RegisterProtocol("/b", func(c transport.Conn) error { return nil })
+	listener.RegisterProtocol("/a", func(c transport.Conn) error { return nil })
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go listener.HandleConn(c2)
+
+	protoIDs, err := NewMuxer().ListProtocols(context.Background(), c1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/a", "/b"}, protoIDs)
+
+	listener.RemoveProtocol("/a")
+	require.Equal(t, []string{"/b"}, listener.Protocols())
+	err = NewMuxer().SelectProtocol(context.Background(), "/a", c1)
+	require.ErrorIs(t, err, ErrProtocolNotSupported)
+	require.NoError(t, NewMuxer().SelectProtocol(context.Background(), "/b", c1))
+}
+
+func TestSelectCancel(t *testing.T) {
+	// No one answers on the other end of the pipe.
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelCtx()
+	err := NewMuxer().SelectProtocol(ctx, "/ping", c1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = c1.Write([]byte("closed"))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
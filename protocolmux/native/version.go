@@ -0,0 +1,94 @@
+package native
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidVersion = errors.New("invalid version")
+
+type version struct {
+	major, minor, patch int
+}
+
+// parseVersion parses versions of the form MAJOR.MINOR.PATCH. MINOR and PATCH
+// can be left out and default to zero.
+func parseVersion(s string) (version, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return version{}, ErrInvalidVersion
+	}
+
+	nums := [3]int{}
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 {
+			return version{}, ErrInvalidVersion
+		}
+		nums[i] = num
+	}
+	return version{nums[0], nums[1], nums[2]}, nil
+}
+
+func (v version) compare(o version) int {
+	if v.major != o.major {
+		return v.major - o.major
+	}
+	if v.minor != o.minor {
+		return v.minor - o.minor
+	}
+	return v.patch - o.patch
+}
+
+// constraint is a range of versions from min up to, but not including, max.
+type constraint struct {
+	min, max version
+}
+
+// parseConstraint parses ^VERSION, ~VERSION and VERSION. A caret allows
+// changes that do not modify the left-most non-zero number, a tilde allows
+// patch changes and a plain version only matches itself.
+func parseConstraint(s string) (constraint, error) {
+	switch {
+	case strings.HasPrefix(s, "^"):
+		v, err := parseVersion(s[1:])
+		if err != nil {
+			return constraint{}, err
+		}
+		switch {
+		case v.major > 0:
+			return constraint{v, version{v.major + 1, 0, 0}}, nil
+		case v.minor > 0:
+			return constraint{v, version{0, v.minor + 1, 0}}, nil
+		default:
+			return constraint{v, version{0, 0, v.patch + 1}}, nil
+		}
+	case strings.HasPrefix(s, "~"):
+		v, err := parseVersion(s[1:])
+		if err != nil {
+			return constraint{}, err
+		}
+		return constraint{v, version{v.major, v.minor + 1, 0}}, nil
+	default:
+		v, err := parseVersion(s)
+		if err != nil {
+			return constraint{}, err
+		}
+		return constraint{v, version{v.major, v.minor, v.patch + 1}}, nil
+	}
+}
+
+func (c constraint) matches(v version) bool {
+	return v.compare(c.min) >= 0 && v.compare(c.max) < 0
+}
+
+// splitProtoID splits a protocol ID into the base and the last path element,
+// which is the version or version constraint.
+func splitProtoID(protoID string) (string, string) {
+	i := strings.LastIndex(protoID, "/")
+	if i <= 0 {
+		return protoID, ""
+	}
+	return protoID[:i], protoID[i+1:]
+}
@@ -6,8 +6,18 @@ import (
 	"github.com/FluffyKebab/pearly/transport"
 )
 
+// Muxer negotiates which protocol is used on a connection. All methods must be
+// safe to call while connections are being handled.
 type Muxer interface {
+	// RegisterProtocol registers the handler of the protocol, atomically
+	// replacing the previous handler if the protocol is already registered.
 	RegisterProtocol(protoID string, handler func(transport.Conn) error)
+	RemoveProtocol(protoID string)
+	Protocols() []string
 	SelectProtocol(ctx context.Context, protoID string, c transport.Conn) error
+
+	// SelectOneOf selects the first protocol in protoIDs supported by the
+	// remote and returns it.
+	SelectOneOf(ctx context.Context, protoIDs []string, c transport.Conn) (string, error)
 	HandleConn(transport.Conn) error
 }
@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Code describes the kind of error returned by a call.
+type Code int
+
+const (
+	CodeUnknown Code = iota + 1
+	CodeInvalidArgument
+	CodeNotFound
+	CodeUnimplemented
+	CodeInternal
+	CodeDeadlineExceeded
+	CodeCanceled
+	CodeUnavailable
+)
+
+func (c Code) String() string {
+	switch c {
+	case CodeUnknown:
+		return "unknown"
+	case CodeInvalidArgument:
+		return "invalid argument"
+	case CodeNotFound:
+		return "not found"
+	case CodeUnimplemented:
+		return "unimplemented"
+	case CodeInternal:
+		return "internal"
+	case CodeDeadlineExceeded:
+		return "deadline exceeded"
+	case CodeCanceled:
+		return "canceled"
+	case CodeUnavailable:
+		return "unavailable"
+	default:
+		return fmt.Sprintf("code %d", int(c))
+	}
+}
+
+// Error is an error sent from the handler to the caller. Errors are equal
+// according to errors.Is if they have the same code, so the sentinel errors
+// below can be used to check the code of an error.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+var (
+	ErrInvalidArgument  = &Error{Code: CodeInvalidArgument}
+	ErrNotFound         = &Error{Code: CodeNotFound}
+	ErrUnimplemented    = &Error{Code: CodeUnimplemented}
+	ErrInternal         = &Error{Code: CodeInternal}
+	ErrDeadlineExceeded = &Error{Code: CodeDeadlineExceeded}
+	ErrCanceled         = &Error{Code: CodeCanceled}
+	ErrUnavailable      = &Error{Code: CodeUnavailable}
+)
+
+// Errorf returns an error with the code that is sent to the caller when
+// returned from a handler.
+func Errorf(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "rpc: " + e.Code.String()
+	}
+	return "rpc: " + e.Code.String() + ": " + e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	var t *Error
+	if !errors.As(target, &t) {
+		return false
+	}
+	return t.Code == e.Code
+}
+
+// toError converts an error returned by a handler to the error sent to the
+// caller.
+func toError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var rpcErr *Error
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, context.DeadlineExceeded):
+		return Errorf(CodeDeadlineExceeded, "%s", err.Error())
+	case errors.Is(err, context.Canceled):
+		return Errorf(CodeCanceled, "%s", err.Error())
+	default:
+		return Errorf(CodeUnknown, "%s", err.Error())
+	}
+}
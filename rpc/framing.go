@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxFrameSize is the maximum size of an encoded request or response.
+const MaxFrameSize = 4 << 20
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// writeFrame writes v gob encoded and prefixed with its length as a uvarint.
+func writeFrame(w io.Writer, v any) error {
+	body := &bytes.Buffer{}
+	if err := gob.NewEncoder(body).Encode(v); err != nil {
+		return err
+	}
+	if body.Len() > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, body.Len())
+	}
+
+	frame := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+body.Len()), uint64(body.Len()))
+	_, err := w.Write(append(frame, body.Bytes()...))
+	return err
+}
+
+func readFrame(r *bufio.Reader, v any) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if size > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(body)).Decode(v)
+}
+
+func encode(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func decode(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,231 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/FluffyKebab/pearly/node"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+const ProtoID = "/rpc"
+
+var ErrInvalidResponse = errors.New("invalid rpc response")
+
+// request is the first frame sent on a stream. Timeout is the time left
+// until the deadline of the caller, or zero if it has no deadline.
+type request struct {
+	Method  string
+	Timeout time.Duration
+	Body    []byte
+}
+
+// response is sent one or more times by the handler. The last response has
+// End set and contains the error returned by the handler.
+type response struct {
+	Body []byte
+	End  bool
+	Err  *Error
+}
+
+type handler func(ctx context.Context, body []byte, send func([]byte) error) error
+
+// Service handles calls to methods registered with Handle and HandleStream,
+// and calls methods on other nodes. Every call uses a new stream.
+type Service struct {
+	node node.Node
+
+	lock     *sync.RWMutex
+	handlers map[string]handler
+}
+
+func Register(n node.Node) *Service {
+	return &Service{
+		node:     n,
+		lock:     &sync.RWMutex{},
+		handlers: make(map[string]handler),
+	}
+}
+
+func (s *Service) Run() {
+	s.node.HandleProtocol(ProtoID, s.handle)
+}
+
+// Handle registers a handler for the method. The request and response types
+// must be encodable with encoding/gob. Errors returned by the handler are sent
+// to the caller, with the code of the error if it is an *Error.
+func Handle[Req, Res any](s *Service, method string, h func(ctx context.Context, req Req) (Res, error)) {
+	HandleStream(s, method, func(ctx context.Context, req Req, send func(Res) error) error {
+		res, err := h(ctx, req)
+		if err != nil {
+			return err
+		}
+		return send(res)
+	})
+}
+
+// HandleStream registers a handler for the method that can send any number
+// of responses before returning.
+func HandleStream[Req, Res any](s *Service, method string, h func(ctx context.Context, req Req, send func(Res) error) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handlers[method] = func(ctx context.Context, body []byte, send func([]byte) error) error {
+		var req Req
+		if err := decode(body, &req); err != nil {
+			return Errorf(CodeInvalidArgument, "decoding request: %s", err.Error())
+		}
+
+		return h(ctx, req, func(res Res) error {
+			data, err := encode(res)
+			if err != nil {
+				return err
+			}
+			return send(data)
+		})
+	}
+}
+
+// Caller is the remote node that made a call.
+type Caller struct {
+	ID   []byte
+	Addr string
+}
+
+type callerKey struct{}
+
+// CallerFromContext returns the caller of the call handled with ctx.
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+func (s *Service) handle(ctx context.Context, stream node.Stream) error {
+	defer stream.Close()
+
+	var req request
+	if err := readFrame(bufio.NewReader(stream), &req); err != nil {
+		return fmt.Errorf("rpc reading request: %w", err)
+	}
+
+	s.lock.RLock()
+	h, ok := s.handlers[req.Method]
+	s.lock.RUnlock()
+	if !ok {
+		return writeFrame(stream, response{End: true, Err: Errorf(CodeUnimplemented, "unknown method %s", req.Method)})
+	}
+
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+	ctx = context.WithValue(ctx, callerKey{}, Caller{ID: stream.RemoteID, Addr: stream.RemoteAddr})
+
+	err := h(ctx, req.Body, func(body []byte) error {
+		return writeFrame(stream, response{Body: body})
+	})
+	return writeFrame(stream, response{End: true, Err: toError(err)})
+}
+
+// Call calls the method on the peer and returns the first response. The
+// deadline of ctx is sent to the handler.
+func Call[Req, Res any](ctx context.Context, s *Service, p peer.Peer, method string, req Req) (Res, error) {
+	stream, err := CallStream[Req, Res](ctx, s, p, method, req)
+	if err != nil {
+		var res Res
+		return res, err
+	}
+	defer stream.Close()
+
+	res, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return res, fmt.Errorf("%w: no response", ErrInvalidResponse)
+	}
+	return res, err
+}
+
+// ResponseStream receives the responses of a call to a streaming method.
+type ResponseStream[Res any] struct {
+	ctx    context.Context
+	conn   transport.Conn
+	reader *bufio.Reader
+	stop   func() bool
+	done   bool
+}
+
+// CallStream calls the method on the peer and returns a stream of the
+// responses. The stream is closed when ctx is done.
+func CallStream[Req, Res any](ctx context.Context, s *Service, p peer.Peer, method string, req Req) (*ResponseStream[Res], error) {
+	body, err := encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("rpc encoding request: %w", err)
+	}
+
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return nil, ctx.Err()
+		}
+	}
+
+	c, err := s.node.DialPeerUsingProcol(ctx, ProtoID, p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFrame(c, request{Method: method, Timeout: timeout, Body: body})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &ResponseStream[Res]{
+		ctx:    ctx,
+		conn:   c,
+		reader: bufio.NewReader(c),
+		stop:   context.AfterFunc(ctx, func() { c.Close() }),
+	}, nil
+}
+
+// Recv returns the next response. io.EOF is returned when the handler has
+// returned without an error.
+func (s *ResponseStream[Res]) Recv() (Res, error) {
+	var res Res
+	if s.done {
+		return res, io.EOF
+	}
+
+	var resp response
+	if err := readFrame(s.reader, &resp); err != nil {
+		if s.ctx.Err() != nil {
+			return res, s.ctx.Err()
+		}
+		return res, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+
+	if resp.End {
+		s.done = true
+		if resp.Err != nil {
+			return res, resp.Err
+		}
+		return res, io.EOF
+	}
+
+	if err := decode(resp.Body, &res); err != nil {
+		return res, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	return res, nil
+}
+
+func (s *ResponseStream[Res]) Close() error {
+	s.stop()
+	return s.conn.Close()
+}
@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/node/basic"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+type echoRequest struct {
+	Message string
+	Count   int
+}
+
+type echoResponse struct {
+	Message string
+}
+
+func createService(t *testing.T) (*Service, peer.Peer) {
+	t.Helper()
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	n := basic.New(tcp.New(port), nil)
+	_, err = n.Run(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(func() { n.Close(context.Background()) })
+
+	s := Register(n)
+	s.Run()
+	return s, peer.New(nil, n.Transport().ListenAddr())
+}
+
+func TestCall(t *testing.T) {
+	client, _ := createService(t)
+	server, serverPeer := createService(t)
+
+	Handle(server, "Echo", func(ctx context.Context, req echoRequest) (echoResponse, error) {
+		if req.Message == "" {
+			return echoResponse{}, Errorf(CodeInvalidArgument, "empty message")
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			return echoResponse{}, errors.New("no deadline")
+		}
+		caller, ok := CallerFromContext(ctx)
+		if !ok || caller.Addr == "" {
+			return echoResponse{}, errors.New("no caller")
+		}
+		return echoResponse{Message: req.Message}, nil
+	})
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancelCtx()
+
+	res, err := Call[echoRequest, echoResponse](ctx, client, serverPeer, "Echo", echoRequest{Message: "hello"})
+	require.NoError(t, err)
+	require.Equal(t, "hello", res.Message)
+
+	_, err = Call[echoRequest, echoResponse](ctx, client, serverPeer, "Echo", echoRequest{})
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	require.Equal(t, "rpc: invalid argument: empty message", err.Error())
+
+	_, err = Call[echoRequest, echoResponse](ctx, client, serverPeer, "Missing", echoRequest{})
+	require.ErrorIs(t, err, ErrUnimplemented)
+}
+
+func TestCallStream(t *testing.T) {
+	client, _ := createService(t)
+	server, serverPeer := createService(t)
+
+	HandleStream(server, "Repeat", func(ctx context.Context, req echoRequest, send func(echoResponse) error) error {
+		for range req.Count {
+			if err := send(echoResponse{Message: req.Message}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	HandleStream(server, "Block", func(ctx context.Context, req echoRequest, send func(echoResponse) error) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	stream, err := CallStream[echoRequest, echoResponse](context.Background(), client, serverPeer, "Repeat", echoRequest{Message: "hi", Count: 3})
+	require.NoError(t, err)
+	defer stream.Close()
+	for range 3 {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "hi", res.Message)
+	}
+	_, err = stream.Recv()
+	require.ErrorIs(t, err, io.EOF)
+
+	// The deadline of the caller is used by the handler.
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelCtx()
+	_, err = Call[echoRequest, echoResponse](ctx, client, serverPeer, "Block", echoRequest{})
+	require.True(t, errors.Is(err, ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded))
+}
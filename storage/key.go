@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+var (
+	ErrInvalidKey      = errors.New("invalid key")
+	ErrUnknownHashCode = errors.New("unknown hash code")
+)
+
+// HashCode identifies the hash function used to create a key. The values are
+// the same as the ones used by multihash.
+type HashCode uint64
+
+const (
+	SHA256     HashCode = 0x12
+	SHA3_256   HashCode = 0x16
+	SHA512_256 HashCode = 0x1014
+)
+
+var _hashFuncs = map[HashCode]func() hash.Hash{
+	SHA256:     sha256.New,
+	SHA3_256:   func() hash.Hash { return sha3.New256() },
+	SHA512_256: sha512.New512_256,
+}
+
+// EncodeKey creates a self-describing key from a digest. The key consists of
+// the hash code and the length of the digest, both as unsigned varints,
+// followed by the digest.
+func EncodeKey(code HashCode, digest []byte) []byte {
+	key := binary.AppendUvarint(nil, uint64(code))
+	key = binary.AppendUvarint(key, uint64(len(digest)))
+	return append(key, digest...)
+}
+
+// DecodeKey splits a key created by EncodeKey into its hash code and digest.
+func DecodeKey(key []byte) (HashCode, []byte, error) {
+	code, n := binary.Uvarint(key)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("%w: missing hash code", ErrInvalidKey)
+	}
+	if _, ok := _hashFuncs[HashCode(code)]; !ok {
+		return 0, nil, fmt.Errorf("%w: %w: %#x", ErrInvalidKey, ErrUnknownHashCode, code)
+	}
+
+	length, m := binary.Uvarint(key[n:])
+	if m <= 0 {
+		return 0, nil, fmt.Errorf("%w: missing digest length", ErrInvalidKey)
+	}
+
+	digest := key[n+m:]
+	if uint64(len(digest)) != length {
+		return 0, nil, fmt.Errorf("%w: digest length is %v, expected %v", ErrInvalidKey, len(digest), length)
+	}
+
+	return HashCode(code), digest, nil
+}
+
+// MapKeyToIDSpace maps a key onto the space of node IDs with length idLen, so
+// that keys produced by diffrent hash functions can be compared with node IDs.
+// Self-describing keys are mapped to their digest if it has the same length as
+// the node IDs, raw keys with the same length as the node IDs are used as is
+// and all other self-describing keys are rehashed to the correct length.
+func MapKeyToIDSpace(key []byte, idLen int) ([]byte, error) {
+	_, digest, err := DecodeKey(key)
+	if err == nil && len(digest) == idLen {
+		return digest, nil
+	}
+	if len(key) == idLen {
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return expand(key, idLen), nil
+}
+
+func expand(key []byte, size int) []byte {
+	res := make([]byte, 0, size+sha256.Size)
+	var counter [4]byte
+	for i := uint32(0); len(res) < size; i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		hash := sha256.New()
+		hash.Write(counter[:])
+		hash.Write(key)
+		res = hash.Sum(res)
+	}
+
+	return res[:size]
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashers(t *testing.T) {
+	value := []byte("value to hash")
+
+	hash, err := NewSHA512_256Hasher().Hash(value)
+	require.NoError(t, err)
+	expected512 := sha512.Sum512_256(value)
+	require.Equal(t, expected512[:], hash)
+
+	hash, err = NewSHA3_256Hasher().Hash(value)
+	require.NoError(t, err)
+	expected3 := sha3.Sum256(value)
+	require.Equal(t, expected3[:], hash)
+}
+
+func TestKeyHasher(t *testing.T) {
+	value := []byte("value to hash")
+
+	h, err := NewKeyHasher(SHA512_256)
+	require.NoError(t, err)
+	key, err := h.Hash(value)
+	require.NoError(t, err)
+
+	// 0x1014 is encoded as two bytes followed by the length of the digest.
+	require.Equal(t, []byte{0x94, 0x20, 32}, key[:3])
+
+	code, digest, err := DecodeKey(key)
+	require.NoError(t, err)
+	require.Equal(t, SHA512_256, code)
+	expected := sha512.Sum512_256(value)
+	require.Equal(t, expected[:], digest)
+
+	_, err = NewKeyHasher(HashCode(0x99))
+	require.ErrorIs(t, err, ErrUnknownHashCode)
+}
+
+func TestDecodeInvalidKey(t *testing.T) {
+	_, _, err := DecodeKey(nil)
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	_, _, err = DecodeKey([]byte{0x12, 32, 1, 2, 3})
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	_, _, err = DecodeKey([]byte{0x99, 1, 1})
+	require.ErrorIs(t, err, ErrUnknownHashCode)
+}
+
+func TestMapKeyToIDSpace(t *testing.T) {
+	value := []byte("value to hash")
+	rawKey := sha256.Sum256(value)
+
+	// Raw keys and self-describing keys of the same digest map to the same ID.
+	mapped, err := MapKeyToIDSpace(rawKey[:], 32)
+	require.NoError(t, err)
+	require.Equal(t, rawKey[:], mapped)
+
+	mapped, err = MapKeyToIDSpace(EncodeKey(SHA256, rawKey[:]), 32)
+	require.NoError(t, err)
+	require.Equal(t, rawKey[:], mapped)
+
+	// Keys with diffrent lengths are mapped consistently.
+	key := EncodeKey(SHA3_256, rawKey[:])
+	mapped1, err := MapKeyToIDSpace(key, 20)
+	require.NoError(t, err)
+	require.Len(t, mapped1, 20)
+	mapped2, err := MapKeyToIDSpace(key, 20)
+	require.NoError(t, err)
+	require.Equal(t, mapped1, mapped2)
+
+	mapped, err = MapKeyToIDSpace(key, 64)
+	require.NoError(t, err)
+	require.Len(t, mapped, 64)
+
+	_, err = MapKeyToIDSpace([]byte{1, 2, 3}, 32)
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
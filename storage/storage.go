@@ -2,7 +2,10 @@ package storage
 
 import (
 	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
 	"errors"
+	"hash"
 )
 
 var ErrNotFound = errors.New("value not found")
@@ -55,3 +58,46 @@ func (h sha256Hasher) Hash(value []byte) ([]byte, error) {
 	_, err := hash.Write(value)
 	return hash.Sum(nil), err
 }
+
+type hasher struct {
+	code     HashCode
+	newHash  func() hash.Hash
+	withCode bool
+}
+
+var _ Hasher = hasher{}
+
+// NewSHA512_256Hasher returns a hasher that produces raw SHA-512/256 digests.
+func NewSHA512_256Hasher() Hasher {
+	return hasher{code: SHA512_256, newHash: sha512.New512_256}
+}
+
+// NewSHA3_256Hasher returns a hasher that produces raw SHA3-256 digests.
+func NewSHA3_256Hasher() Hasher {
+	return hasher{code: SHA3_256, newHash: func() hash.Hash { return sha3.New256() }}
+}
+
+// NewKeyHasher returns a hasher that produces self-describing keys, where the
+// digest is prefixed with the code of the hash function and its length. See
+// EncodeKey.
+func NewKeyHasher(code HashCode) (Hasher, error) {
+	newHash, ok := _hashFuncs[code]
+	if !ok {
+		return nil, ErrUnknownHashCode
+	}
+
+	return hasher{code: code, newHash: newHash, withCode: true}, nil
+}
+
+func (h hasher) Hash(value []byte) ([]byte, error) {
+	hash := h.newHash()
+	_, err := hash.Write(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.withCode {
+		return EncodeKey(h.code, hash.Sum(nil)), nil
+	}
+	return hash.Sum(nil), nil
+}
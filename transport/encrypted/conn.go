@@ -1,31 +1,33 @@
 package encrypted
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"encoding/gob"
 	"io"
-	mrand "math/rand"
 	"strings"
-	"sync"
 
+	"github.com/FluffyKebab/pearly/crypto"
 	"github.com/FluffyKebab/pearly/transport"
 )
 
-type Conn struct {
-	lock        *sync.Mutex
-	conn        transport.Conn
-	peerPubKey  *rsa.PublicKey
-	nodePrivKey *rsa.PrivateKey
-	decoder     *gob.Decoder
-	encoder     *gob.Encoder
+const (
+	// _maxRecordSize is the maximum size of the plaintext of a record, which
+	// is the frame size of crypto.AuthenticatedStream.
+	_maxRecordSize = 16 * 1024
+	_lengthSize    = 2
+)
+
+var (
+	ErrInvalidRecord  = crypto.ErrInvalidFrame
+	ErrNonceExhausted = crypto.ErrNonceExhausted
+)
 
-	ID             int
-	remoteID       []byte
-	unread         []byte
-	unreadReadPos  int
-	unreadWritePos int
-	remotePort     string
+// Conn encrypts and authenticates all traffic with a crypto.AuthenticatedStream
+// keyed with the session secret derived in the handshake. Records that are
+// reordered, replayed or modified are rejected.
+type Conn struct {
+	conn       transport.Conn
+	stream     *crypto.AuthenticatedStream
+	remoteID   []byte
+	remotePort string
 }
 
 var (
@@ -36,71 +38,34 @@ var (
 	_ io.ByteReader             = &Conn{}
 )
 
+// NewConn creates a connection encrypted with the session secret. Both ends
+// must use the same secret, and exactly one of them must be the initiator.
 func NewConn(
 	underlayingConn transport.Conn,
-	peerPubKey *rsa.PublicKey,
-	nodePrivateKey *rsa.PrivateKey,
-	gobDecoder *gob.Decoder,
-	gobEncoder *gob.Encoder,
+	sessionSecret []byte,
+	initiator bool,
 	peerID []byte,
 	remotePort string,
-) *Conn {
-	return &Conn{
-		lock:        &sync.Mutex{},
-		ID:          mrand.Int(),
-		remoteID:    peerID,
-		conn:        underlayingConn,
-		unread:      make([]byte, 1048),
-		peerPubKey:  peerPubKey,
-		nodePrivKey: nodePrivateKey,
-		decoder:     gobDecoder,
-		encoder:     gobEncoder,
-		remotePort:  remotePort,
-	}
-}
-
-func (c *Conn) Read(p []byte) (n int, err error) {
-	// If there are bytes left from a previous packet we return those first.
-	if c.unreadReadPos < c.unreadWritePos {
-		return c.readUnread(p)
-	}
-
-	// There are no more unread so we restart the buffer.
-	c.unreadReadPos = 0
-	c.unreadWritePos = 0
-
-	var pckt packet
-	err = c.decoder.Decode(&pckt)
+) (*Conn, error) {
+	stream, err := crypto.NewAuthenticatedStream(sessionSecret, initiator, underlayingConn)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	for _, msg := range pckt.Data {
-		plaintext, err := c.nodePrivKey.Decrypt(rand.Reader, msg, nil)
-		if err != nil {
-			return 0, err
-		}
-		c.writeUread(plaintext)
-	}
+	return &Conn{
+		conn:       underlayingConn,
+		stream:     stream,
+		remoteID:   peerID,
+		remotePort: remotePort,
+	}, nil
+}
 
-	return c.readUnread(p)
+func (c *Conn) Read(p []byte) (n int, err error) {
+	return c.stream.Read(p)
 }
 
 func (c *Conn) Write(p []byte) (n int, err error) {
-	bachedData := bactchData(p, c.peerPubKey.Size()-11)
-	packet := packet{Data: make([][]byte, 0, len(bachedData))}
-
-	for _, msg := range bachedData {
-		ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, c.peerPubKey, msg)
-		if err != nil {
-			return 0, err
-		}
-
-		packet.Data = append(packet.Data, ciphertext)
-	}
-
-	err = c.encoder.Encode(packet)
-	return len(p), err
+	return c.stream.Write(p)
 }
 
 func (c *Conn) RemoteAddr() string {
@@ -125,42 +90,6 @@ func (c *Conn) Close() error {
 
 func (c *Conn) ReadByte() (byte, error) {
 	buf := make([]byte, 1)
-	_, err := c.Read(buf)
+	_, err := io.ReadFull(c, buf)
 	return buf[0], err
 }
-
-func (c *Conn) readUnread(p []byte) (int, error) {
-	var n int
-	for n < len(p) && c.unreadReadPos < c.unreadWritePos {
-		p[n] = c.unread[c.unreadReadPos]
-		c.unreadReadPos++
-		n++
-	}
-
-	return n, nil
-}
-
-func (c *Conn) writeUread(p []byte) {
-	for i := 0; i < len(p); i++ {
-		if c.unreadWritePos >= len(c.unread) {
-			c.unread = append(c.unread, p[i])
-			continue
-		}
-
-		c.unread[c.unreadWritePos] = p[i]
-		c.unreadWritePos++
-	}
-}
-
-type packet struct {
-	Data [][]byte
-}
-
-func bactchData(data []byte, packetSize int) [][]byte {
-	res := make([][]byte, 0, len(data)/packetSize)
-	for i := 0; i < len(data); i += packetSize {
-		res = append(res, data[i:min(len(data), i+packetSize)])
-	}
-
-	return res
-}
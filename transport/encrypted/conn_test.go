@@ -1,152 +1,103 @@
 package encrypted
 
 import (
-	"encoding/gob"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
 	"testing"
 
+	"github.com/FluffyKebab/pearly/identity"
+	"github.com/FluffyKebab/pearly/transport/tcp"
 	"github.com/stretchr/testify/require"
 )
 
-type mockedConn struct {
-	buffer   []byte
-	pos      int
-	isClosed bool
+// tamperingConn flips a bit in the bytes of every write after the first skip
+// bytes, once tamper is set.
+type tamperingConn struct {
+	net.Conn
+	tamper bool
+	skip   int
 }
 
-func (c *mockedConn) Read(p []byte) (n int, err error) {
-	for i := 0; i < c.pos; i++ {
-		p[i] = c.buffer[i]
+func (c *tamperingConn) Write(p []byte) (int, error) {
+	if !c.tamper {
+		return c.Conn.Write(p)
 	}
 
-	return c.pos, nil
-}
-
-func (c *mockedConn) Write(p []byte) (n int, err error) {
-	for i := 0; i < len(p); i++ {
-		c.buffer[c.pos+i] = p[i]
+	buf := bytes.Clone(p)
+	for i := c.skip; i < len(buf); i++ {
+		buf[i] ^= 1
 	}
-	c.pos += len(p)
-
-	return len(p), nil
-}
-
-func (c *mockedConn) Close() error {
-	c.isClosed = true
-	return nil
+	return c.Conn.Write(buf)
 }
 
-func (c *mockedConn) RemoteAddr() string {
-	return ""
-}
+func createConnPair(t testing.TB, c1, c2 net.Conn) (*Conn, *Conn) {
+	t.Helper()
 
-func TestEncryptedConn(t *testing.T) {
-	node1privKey, node1pubKey, err := generateKeyPair()
+	transport1, err := NewTransport(tcp.New("1"))
 	require.NoError(t, err)
-	node2privKey, node2pubKey, err := generateKeyPair()
+	transport2, err := NewTransport(tcp.New("2"))
 	require.NoError(t, err)
 
-	conn1To2 := &mockedConn{
-		buffer: make([]byte, 1048),
-	}
-	conn2To1 := &mockedConn{
-		buffer: make([]byte, 1048),
+	type result struct {
+		conn *Conn
+		err  error
 	}
+	resChan := make(chan result)
+	go func() {
+		conn, err := transport2.upgradeConn(c2, false)
+		resChan <- result{conn, err}
+	}()
 
-	encryptedConn1to2 := NewConn(
-		conn1To2,
-		node2pubKey,
-		node1privKey,
-		gob.NewDecoder(conn1To2),
-		gob.NewEncoder(conn1To2),
-		nil,
-		"",
-	)
-	encryptedConn2to1 := NewConn(
-		conn2To1,
-		node1pubKey,
-		node2privKey,
-		gob.NewDecoder(conn2To1),
-		gob.NewEncoder(conn2To1),
-		nil,
-		"",
-	)
-
-	// Sending text.
-	msg := []byte("hello from node 1, to node 2")
-	_, err = encryptedConn1to2.Write(msg)
+	conn1, err := transport1.upgradeConn(c1, true)
 	require.NoError(t, err)
+	res := <-resChan
+	require.NoError(t, res.err)
 
-	// Simulate the data being sent form node 1 to 2.
-	conn2To1.buffer = conn1To2.buffer
-	conn2To1.pos = conn1To2.pos
-
-	msgRecived := make([]byte, 1048)
-	n, err := encryptedConn2to1.Read(msgRecived)
-	require.NoError(t, err)
-
-	require.Equal(t, msg, msgRecived[0:n])
-
-	// Sending a byte array.
-	conn1To2.buffer = make([]byte, 1048)
-	conn1To2.pos = 0
-	msg = []byte{13, 47, 107, 100, 109, 103, 101, 116, 118, 97, 108, 117, 101, 10}
-	_, err = encryptedConn1to2.Write(msg)
-	require.NoError(t, err)
+	require.Equal(t, transport2.ID(), conn1.RemoteID())
+	require.Equal(t, transport1.ID(), res.conn.RemoteID())
+	return conn1, res.conn
+}
 
-	// Simulate the data being sent form node 1 to 2.
-	conn2To1.buffer = conn1To2.buffer
-	conn2To1.pos = conn1To2.pos
+func TestEncryptedConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	conn1, conn2 := createConnPair(t, c1, c2)
+	defer conn1.Close()
+
+	for _, msg := range [][]byte{
+		[]byte("hello from node 1, to node 2"),
+		{13, 47, 107, 100, 109, 103, 101, 116, 118, 97, 108, 117, 101, 10},
+	} {
+		go conn1.Write(msg)
+
+		msgRecived := make([]byte, 1048)
+		n, err := conn2.Read(msgRecived)
+		require.NoError(t, err)
+		require.Equal(t, msg, msgRecived[0:n])
+	}
 
-	msgRecived = make([]byte, 1048)
-	n, err = encryptedConn2to1.Read(msgRecived)
+	// Both directions use different keys.
+	msg := []byte("hello from node 2, to node 1")
+	go conn2.Write(msg)
+	msgRecived := make([]byte, 1048)
+	n, err := conn1.Read(msgRecived)
 	require.NoError(t, err)
-
 	require.Equal(t, msg, msgRecived[0:n])
 }
 
 func TestEncryptedConnSmallBuffer(t *testing.T) {
-	node1privKey, node1pubKey, err := generateKeyPair()
-	require.NoError(t, err)
-	node2privKey, node2pubKey, err := generateKeyPair()
-	require.NoError(t, err)
-
-	conn1To2 := &mockedConn{
-		buffer: make([]byte, 1048),
-	}
-	conn2To1 := &mockedConn{
-		buffer: make([]byte, 1048),
-	}
-
-	encryptedConn1to2 := NewConn(
-		conn1To2,
-		node2pubKey,
-		node1privKey,
-		gob.NewDecoder(conn1To2),
-		gob.NewEncoder(conn1To2),
-		nil,
-		"",
-	)
-	encryptedConn2to1 := NewConn(
-		conn2To1,
-		node1pubKey,
-		node2privKey,
-		gob.NewDecoder(conn2To1),
-		gob.NewEncoder(conn2To1),
-		nil,
-		"",
-	)
+	c1, c2 := net.Pipe()
+	conn1, conn2 := createConnPair(t, c1, c2)
+	defer conn1.Close()
 
 	msg := []byte("hello from node 1, to node 2")
-	_, err = encryptedConn1to2.Write(msg)
-	require.NoError(t, err)
-
-	// Simulate the data being sent form node 1 to 2.
-	conn2To1.buffer = conn1To2.buffer
-	conn2To1.pos = conn1To2.pos
+	go conn1.Write(msg)
 
 	for i := 0; i < len(msg); i++ {
 		buf := make([]byte, 1)
-		n, err := encryptedConn2to1.Read(buf)
+		n, err := conn2.Read(buf)
 		require.NoError(t, err)
 		require.Equal(t, 1, n)
 		require.Equal(t, msg[i], buf[0])
@@ -154,60 +105,162 @@ func TestEncryptedConnSmallBuffer(t *testing.T) {
 }
 
 func TestEncryptedConnSmallThenLargeBuffer(t *testing.T) {
-	node1privKey, node1pubKey, err := generateKeyPair()
-	require.NoError(t, err)
-	node2privKey, node2pubKey, err := generateKeyPair()
-	require.NoError(t, err)
-
-	conn1To2 := &mockedConn{
-		buffer: make([]byte, 1048),
-	}
-	conn2To1 := &mockedConn{
-		buffer: make([]byte, 1048),
-	}
-
-	encryptedConn1to2 := NewConn(
-		conn1To2,
-		node2pubKey,
-		node1privKey,
-		gob.NewDecoder(conn1To2),
-		gob.NewEncoder(conn1To2),
-		nil,
-		"",
-	)
-	encryptedConn2to1 := NewConn(
-		conn2To1,
-		node1pubKey,
-		node2privKey,
-		gob.NewDecoder(conn2To1),
-		gob.NewEncoder(conn2To1),
-		nil,
-		"",
-	)
+	c1, c2 := net.Pipe()
+	conn1, conn2 := createConnPair(t, c1, c2)
+	defer conn1.Close()
 
 	msg := []byte("hello from node 1, to node 2")
-	_, err = encryptedConn1to2.Write(msg)
-	require.NoError(t, err)
-
-	// Simulate the data being sent form node 1 to 2.
-	conn2To1.buffer = conn1To2.buffer
-	conn2To1.pos = conn1To2.pos
+	go conn1.Write(msg)
 
 	buf := make([]byte, 1)
-	n, err := encryptedConn2to1.Read(buf)
+	n, err := conn2.Read(buf)
 	require.NoError(t, err)
 	require.Equal(t, 1, n)
 	require.Equal(t, msg[0], buf[0])
 
 	buf = make([]byte, 255)
-	n, err = encryptedConn2to1.Read(buf)
+	n, err = conn2.Read(buf)
 	require.NoError(t, err)
 	require.Equal(t, msg[1:], buf[:n])
 }
 
-func TestBachedData(t *testing.T) {
-	require.Equal(t,
-		[][]byte{{1, 1, 1}, {1, 1, 1}, {1}},
-		bactchData([]byte{1, 1, 1, 1, 1, 1, 1}, 3),
-	)
+func TestEncryptedConnLargeMessage(t *testing.T) {
+	c1, c2 := net.Pipe()
+	conn1, conn2 := createConnPair(t, c1, c2)
+
+	msg := make([]byte, 3*_maxRecordSize+17)
+	_, err := rand.Read(msg)
+	require.NoError(t, err)
+
+	go func() {
+		conn1.Write(msg)
+		conn1.Close()
+	}()
+
+	received, err := io.ReadAll(conn2)
+	require.NoError(t, err)
+	require.Equal(t, msg, received)
+}
+
+func TestEncryptedConnRejectsModifiedRecords(t *testing.T) {
+	c1, c2 := net.Pipe()
+	tampering := &tamperingConn{Conn: c1}
+	conn1, conn2 := createConnPair(t, tampering, c2)
+	defer conn1.Close()
+
+	// Only the ciphertext is modified, the length stays valid.
+	tampering.tamper = true
+	tampering.skip = _lengthSize
+	go conn1.Write([]byte("hello"))
+
+	_, err := conn2.Read(make([]byte, 10))
+	require.ErrorIs(t, err, ErrInvalidRecord)
+}
+
+func TestHandshakeRejectsWrongID(t *testing.T) {
+	transport1, err := NewTransport(tcp.New("1"))
+	require.NoError(t, err)
+	transport2, err := NewTransport(tcp.New("2"))
+	require.NoError(t, err)
+
+	transcript := []byte("transcript")
+	sig, err := transport2.sign(_responderInfo, transcript)
+	require.NoError(t, err)
+
+	msg := handshakeMessage{
+		ID:        transport2.ID(),
+		PublicKey: transport2.identity.PublicKey(),
+		Signature: sig,
+	}
+	require.NoError(t, verifyHandshakeSignature(msg, _responderInfo, transcript))
+	require.Error(t, verifyHandshakeSignature(msg, _initiatorInfo, transcript))
+
+	// The peer claims the ID of another node.
+	msg.ID = transport1.ID()
+	require.ErrorIs(t, verifyHandshakeSignature(msg, _responderInfo, transcript), ErrIDMismatch)
+}
+
+func TestTransportWithIdentity(t *testing.T) {
+	id, err := identity.Generate(identity.ECDSA)
+	require.NoError(t, err)
+	transport1, err := NewTransport(tcp.New("1"), WithIdentity(id))
+	require.NoError(t, err)
+	require.Equal(t, id.ID(), transport1.ID())
+	transport2, err := NewTransport(tcp.New("2"))
+	require.NoError(t, err)
+
+	c1, c2 := net.Pipe()
+	resChan := make(chan *Conn)
+	go func() {
+		conn, _ := transport2.upgradeConn(c2, false)
+		resChan <- conn
+	}()
+	conn1, err := transport1.upgradeConn(c1, true)
+	require.NoError(t, err)
+	defer conn1.Close()
+
+	conn2 := <-resChan
+	require.NotNil(t, conn2)
+	require.Equal(t, id.ID(), conn2.RemoteID())
+}
+
+func BenchmarkConn(b *testing.B) {
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"1KB", 1024},
+		{"64KB", 64 * 1024},
+	}
+
+	for _, s := range sizes {
+		b.Run("aes-gcm/"+s.name, func(b *testing.B) {
+			c1, c2 := net.Pipe()
+			conn1, conn2 := createConnPair(b, c1, c2)
+			benchmarkConn(b, conn1, conn2, s.size)
+		})
+		b.Run("rsa/"+s.name, func(b *testing.B) {
+			c1, c2 := net.Pipe()
+			conn1, conn2 := createRSAConnPair(b, c1, c2)
+			benchmarkConn(b, conn1, conn2, s.size)
+		})
+	}
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	transport1, err := NewTransport(tcp.New("1"))
+	require.NoError(b, err)
+	transport2, err := NewTransport(tcp.New("2"))
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c1, c2 := net.Pipe()
+		go transport2.upgradeConn(c2, false)
+		_, err := transport1.upgradeConn(c1, true)
+		require.NoError(b, err)
+		c1.Close()
+	}
+}
+
+func benchmarkConn(b *testing.B, w io.WriteCloser, r io.Reader, size int) {
+	msg := make([]byte, size)
+	done := make(chan error)
+	go func() {
+		_, err := io.CopyN(io.Discard, r, int64(size*b.N))
+		done <- err
+	}()
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil && !errors.Is(err, io.EOF) {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	w.Close()
 }
@@ -0,0 +1,102 @@
+package encrypted
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/gob"
+	"net"
+	"testing"
+
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/stretchr/testify/require"
+)
+
+// rsaConn is the previous implementation of Conn, where every chunk is
+// encrypted with the RSA key of the peer. It is only kept to compare the
+// performance of Conn against it.
+type rsaConn struct {
+	conn        transport.Conn
+	peerPubKey  *rsa.PublicKey
+	nodePrivKey *rsa.PrivateKey
+	decoder     *gob.Decoder
+	encoder     *gob.Encoder
+	unread      []byte
+}
+
+type rsaPacket struct {
+	Data [][]byte
+}
+
+// _bitSize is the size of the RSA keys in the comparison. The previous
+// implementation used 512 bit keys, which Go no longer accepts.
+const _bitSize = 2048
+
+func generateKeyPair() (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, _bitSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, &key.PublicKey, nil
+}
+
+func createRSAConnPair(t testing.TB, c1, c2 net.Conn) (*rsaConn, *rsaConn) {
+	t.Helper()
+
+	privKey1, pubKey1, err := generateKeyPair()
+	require.NoError(t, err)
+	privKey2, pubKey2, err := generateKeyPair()
+	require.NoError(t, err)
+
+	return newRSAConn(c1, pubKey2, privKey1), newRSAConn(c2, pubKey1, privKey2)
+}
+
+func newRSAConn(c transport.Conn, peerPubKey *rsa.PublicKey, nodePrivKey *rsa.PrivateKey) *rsaConn {
+	return &rsaConn{
+		conn:        c,
+		peerPubKey:  peerPubKey,
+		nodePrivKey: nodePrivKey,
+		decoder:     gob.NewDecoder(c),
+		encoder:     gob.NewEncoder(c),
+	}
+}
+
+func (c *rsaConn) Read(p []byte) (int, error) {
+	if len(c.unread) == 0 {
+		var pckt rsaPacket
+		if err := c.decoder.Decode(&pckt); err != nil {
+			return 0, err
+		}
+
+		for _, msg := range pckt.Data {
+			plaintext, err := c.nodePrivKey.Decrypt(rand.Reader, msg, nil)
+			if err != nil {
+				return 0, err
+			}
+			c.unread = append(c.unread, plaintext...)
+		}
+	}
+
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *rsaConn) Write(p []byte) (int, error) {
+	chunkSize := c.peerPubKey.Size() - 11
+	pckt := rsaPacket{Data: make([][]byte, 0, len(p)/chunkSize+1)}
+
+	for i := 0; i < len(p); i += chunkSize {
+		ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, c.peerPubKey, p[i:min(len(p), i+chunkSize)])
+		if err != nil {
+			return 0, err
+		}
+		pckt.Data = append(pckt.Data, ciphertext)
+	}
+
+	return len(p), c.encoder.Encode(pckt)
+}
+
+func (c *rsaConn) Close() error {
+	return c.conn.Close()
+}
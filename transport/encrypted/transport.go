@@ -1,81 +1,91 @@
 package encrypted
 
 import (
+	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
+	"fmt"
+	"time"
 
+	"github.com/FluffyKebab/pearly/identity"
 	"github.com/FluffyKebab/pearly/peer"
 	"github.com/FluffyKebab/pearly/transport"
 )
 
-const _bitSize = 512
+// DefaultHandshakeTimeout is the time an accepted connection has to finish the
+// handshake.
+const DefaultHandshakeTimeout = 10 * time.Second
 
 type Transport struct {
-	underlaying transport.Transport
-
-	id         []byte
-	privateKey *rsa.PrivateKey
-	publicKey  []byte
+	underlaying      transport.Transport
+	identity         *identity.Identity
+	handshakeTimeout time.Duration
 }
 
 var _ transport.Transport = Transport{}
 
-func NewTransport(underalying transport.Transport) (Transport, error) {
-	privKey, pubKey, err := generateKeyPair()
-	if err != nil {
-		return Transport{}, err
-	}
-	pubKeyBytes := x509.MarshalPKCS1PublicKey(pubKey)
-	nodeID := sha256.Sum256(pubKeyBytes)
+type Option func(*Transport)
 
-	return Transport{
-		underlaying: underalying,
-		id:          nodeID[:],
-		privateKey:  privKey,
-		publicKey:   pubKeyBytes,
-	}, nil
+// WithIdentity makes the transport authenticate with the identity instead of
+// a new key, so the ID of the node stays the same across restarts.
+func WithIdentity(id *identity.Identity) Option {
+	return func(t *Transport) {
+		t.identity = id
+	}
 }
 
-func (t Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
-	encryptedChanConn := make(chan transport.Conn)
-	errChan := make(chan error)
+// WithHandshakeTimeout sets the time an accepted connection has to finish the
+// handshake before it is closed.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.handshakeTimeout = d
+	}
+}
 
-	chanConn, underlayingErrChan, err := t.underlaying.Listen(ctx)
-	if err != nil {
-		return nil, nil, err
+// NewTransport creates a transport that encrypts the connections of
+// underalying. A new Ed25519 identity is generated unless WithIdentity is
+// used.
+func NewTransport(underalying transport.Transport, opts ...Option) (Transport, error) {
+	t := Transport{underlaying: underalying, handshakeTimeout: DefaultHandshakeTimeout}
+	for _, opt := range opts {
+		opt(&t)
 	}
 
-	go func() {
-		for {
-			select {
-			case c := <-chanConn:
-				encryptedChan, err := t.upgradeConn(c)
-				if err != nil {
-					errChan <- err
-					continue
-				}
-				encryptedChanConn <- encryptedChan
-			case err := <-underlayingErrChan:
-				errChan <- err
-			case <-ctx.Done():
-				return
-			}
+	if t.identity == nil {
+		id, err := identity.Generate(identity.Ed25519)
+		if err != nil {
+			return Transport{}, err
 		}
-	}()
+		t.identity = id
+	}
+	return t, nil
+}
 
-	return encryptedChanConn, errChan, nil
+func (t Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
+	return transport.ListenUpgraded(ctx, t.underlaying, t.handshakeTimeout, func(_ context.Context, c transport.Conn) (transport.Conn, error) {
+		return t.upgradeConn(c, false)
+	})
 }
 
+// Dial connects to the peer. The handshake is given up when ctx is done, and
+// if the ID of the peer is set the connection fails unless the peer
+// authenticates with the same ID.
 func (t Transport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
-	conn, err := t.underlaying.Dial(ctx, p)
+	c, err := t.underlaying.Dial(ctx, p)
 	if err != nil {
 		return nil, err
 	}
 
-	return t.upgradeConn(conn)
+	conn, err := transport.Upgrade(ctx, c, func(_ context.Context, c transport.Conn) (transport.Conn, error) {
+		return t.upgradeConn(c, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(p.ID()) != 0 && !bytes.Equal(p.ID(), conn.(*Conn).RemoteID()) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, ErrPeerIDMismatch)
+	}
+	return conn, nil
 }
 
 func (t Transport) ListenAddr() string {
@@ -83,14 +93,5 @@ func (t Transport) ListenAddr() string {
 }
 
 func (t Transport) ID() []byte {
-	return t.id
-}
-
-func generateKeyPair() (*rsa.PrivateKey, *rsa.PublicKey, error) {
-	key, err := rsa.GenerateKey(rand.Reader, _bitSize)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return key, &key.PublicKey, nil
+	return t.identity.ID()
 }
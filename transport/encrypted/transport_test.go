@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/gob"
 	"io"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -104,3 +105,62 @@ func TestEncryptedTCPSendAndReciveGOB(t *testing.T) {
 	}
 	conn.Close()
 }
+
+func TestDialHandshakeContext(t *testing.T) {
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	client, err := NewTransport(tcp.New(port))
+	require.NoError(t, err)
+
+	// The responder accepts the connection but never answers the handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(io.Discard, c)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = client.Dial(ctx, peer.New(nil, listener.Addr().String()))
+	require.ErrorIs(t, err, ErrHandshake)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDialChecksPeerID(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	client, err := NewTransport(tcp.New(port1))
+	require.NoError(t, err)
+	server, err := NewTransport(tcp.New(port2))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connChan, _, err := server.Listen(ctx)
+	require.NoError(t, err)
+	go func() {
+		for {
+			select {
+			case c := <-connChan:
+				c.Close()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	conn, err := client.Dial(ctx, peer.New(server.ID(), "localhost:"+port2))
+	require.NoError(t, err)
+	conn.Close()
+
+	_, err = client.Dial(ctx, peer.New(client.ID(), "localhost:"+port2))
+	require.ErrorIs(t, err, ErrPeerIDMismatch)
+}
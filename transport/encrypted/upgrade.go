@@ -2,49 +2,200 @@ package encrypted
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
 	"crypto/sha256"
-	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"strings"
+	"io"
 
+	"github.com/FluffyKebab/pearly/identity"
 	"github.com/FluffyKebab/pearly/transport"
 )
 
-type upgraderPayload struct {
+const (
+	_maxHandshakeMessageSize = 8 * 1024
+	_sessionKeySize          = 32
+
+	_protocolName  = "pearly/encrypted/1"
+	_initiatorInfo = "pearly/encrypted/1 initiator"
+	_responderInfo = "pearly/encrypted/1 responder"
+	_sessionInfo   = "pearly/encrypted/1 session"
+)
+
+var (
+	ErrHandshake      = errors.New("encrypted handshake failed")
+	ErrIDMismatch     = errors.New("peer public key does not match with their node ID")
+	ErrTooLarge       = errors.New("handshake message too large")
+	ErrPeerIDMismatch = errors.New("peer ID does not match the dialed ID")
+)
+
+// handshakeMessage is sent by both peers. The ephemeral key is used for one
+// connection only, and the signature proves that the peer has the private key
+// of its identity.
+type handshakeMessage struct {
 	ID            []byte
 	PublicKey     []byte
+	EphemeralKey  []byte
 	ListeningPort string
+	Signature     []byte
 }
 
-func (t Transport) upgradeConn(c transport.Conn) (*Conn, error) {
-	encoder := gob.NewEncoder(c)
-	decoder := gob.NewDecoder(c)
+// upgradeConn authenticates the peer and derives the session secret. The
+// initiator sends its ephemeral key first, the responder answers with its own
+// and a signature over both, and the initiator finishes with its signature. The
+// session secret is derived from the X25519 shared secret with HKDF, so past
+// traffic stays secret even if an identity key is leaked later.
+func (t Transport) upgradeConn(c transport.Conn, initiator bool) (*Conn, error) {
+	conn, err := t.handshake(c, initiator)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	return conn, nil
+}
 
-	err := encoder.Encode(upgraderPayload{
-		ID:            t.id,
-		PublicKey:     t.publicKey,
-		ListeningPort: strings.Split(t.ListenAddr(), ":")[1],
-	})
+func (t Transport) handshake(c transport.Conn, initiator bool) (*Conn, error) {
+	ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
 	if err != nil {
 		return nil, err
 	}
 
-	var peerData upgraderPayload
-	err = decoder.Decode(&peerData)
+	local := handshakeMessage{
+		ID:            t.ID(),
+		PublicKey:     t.identity.PublicKey(),
+		EphemeralKey:  ephemeralKey.PublicKey().Bytes(),
+		ListeningPort: transport.ListeningPort(t.ListenAddr()),
+	}
+
+	var remote handshakeMessage
+	var transcript []byte
+	if initiator {
+		if err := writeHandshakeMessage(c, local); err != nil {
+			return nil, err
+		}
+		if err := readHandshakeMessage(c, &remote); err != nil {
+			return nil, err
+		}
+
+		transcript = handshakeTranscript(local, remote)
+		if err := verifyHandshakeSignature(remote, _responderInfo, transcript); err != nil {
+			return nil, err
+		}
+
+		local.Signature, err = t.sign(_initiatorInfo, transcript)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHandshakeMessage(c, handshakeMessage{Signature: local.Signature}); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := readHandshakeMessage(c, &remote); err != nil {
+			return nil, err
+		}
+
+		transcript = handshakeTranscript(remote, local)
+		local.Signature, err = t.sign(_responderInfo, transcript)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHandshakeMessage(c, local); err != nil {
+			return nil, err
+		}
+
+		var finish handshakeMessage
+		if err := readHandshakeMessage(c, &finish); err != nil {
+			return nil, err
+		}
+		remote.Signature = finish.Signature
+		if err := verifyHandshakeSignature(remote, _initiatorInfo, transcript); err != nil {
+			return nil, err
+		}
+	}
+
+	remoteEphemeralKey, err := ecdh.X25519().NewPublicKey(remote.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeralKey.ECDH(remoteEphemeralKey)
 	if err != nil {
 		return nil, err
 	}
 
-	peerPubKey, err := x509.ParsePKCS1PublicKey(peerData.PublicKey)
+	sessionSecret, err := hkdf.Key(sha256.New, secret, transcript, _sessionInfo, _sessionKeySize)
 	if err != nil {
 		return nil, err
 	}
+	return NewConn(c, sessionSecret, initiator, remote.ID, remote.ListeningPort)
+}
+
+func (t Transport) sign(info string, transcript []byte) ([]byte, error) {
+	return t.identity.Sign(signatureMessage(info, transcript))
+}
+
+// verifyHandshakeSignature checks that the ID of the peer is the hash of its
+// public key, and that the signature is made with that key.
+func verifyHandshakeSignature(m handshakeMessage, info string, transcript []byte) error {
+	if !bytes.Equal(m.ID, identity.IDFromPublicKey(m.PublicKey)) {
+		return ErrIDMismatch
+	}
+	return identity.Verify(m.PublicKey, signatureMessage(info, transcript), m.Signature)
+}
+
+func signatureMessage(info string, transcript []byte) []byte {
+	return append([]byte(info), transcript...)
+}
 
-	acctuallID := sha256.Sum256(peerData.PublicKey)
-	if !bytes.Equal(peerData.ID, acctuallID[:]) {
-		return nil, fmt.Errorf("peer public key does not match with their node ID")
+// handshakeTranscript hashes everything but the signatures of the handshake
+// messages, so both signatures cover both ephemeral keys.
+func handshakeTranscript(initiator, responder handshakeMessage) []byte {
+	h := sha256.New()
+	h.Write([]byte(_protocolName))
+	for _, m := range []handshakeMessage{initiator, responder} {
+		for _, field := range [][]byte{m.ID, m.PublicKey, m.EphemeralKey, []byte(m.ListeningPort)} {
+			binary.Write(h, binary.BigEndian, uint32(len(field)))
+			h.Write(field)
+		}
 	}
+	return h.Sum(nil)
+}
 
-	return NewConn(c, peerPubKey, t.privateKey, decoder, encoder, peerData.ID, peerData.ListeningPort), nil
+// writeHandshakeMessage sends m prefixed by its length. The messages are
+// framed so that no bytes of the encrypted records are read by the gob decoder.
+func writeHandshakeMessage(w io.Writer, m handshakeMessage) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, _lengthSize))
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return err
+	}
+	if buf.Len()-_lengthSize > _maxHandshakeMessageSize {
+		return ErrTooLarge
+	}
+
+	msg := buf.Bytes()
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-_lengthSize))
+	_, err := w.Write(msg)
+	return err
+}
+
+func readHandshakeMessage(r io.Reader, m *handshakeMessage) error {
+	header := make([]byte, _lengthSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	size := int(binary.BigEndian.Uint16(header))
+	if size > _maxHandshakeMessageSize {
+		return ErrTooLarge
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(msg)).Decode(m)
 }
@@ -17,51 +17,50 @@ type Conn struct {
 	unreadChunkPos   int
 	unreadInChunkPos int
 
-	lock              *sync.Mutex
-	isWaiting         bool
-	waitingDataSender chan struct{}
+	lock *sync.Mutex
+
+	// dataAdded is signaled when data is added or the connection is closed.
+	dataAdded chan struct{}
 }
 
 func NewConn(connMuxer *ConnMuxer, id string) *Conn {
 	return &Conn{
-		connMuxer:         connMuxer,
-		id:                id,
-		unreadChunks:      make([][]byte, 0),
-		waitingDataSender: make(chan struct{}),
-		lock:              &sync.Mutex{},
+		connMuxer:    connMuxer,
+		id:           id,
+		unreadChunks: make([][]byte, 0),
+		dataAdded:    make(chan struct{}, 1),
+		lock:         &sync.Mutex{},
 	}
 }
 
 func (c *Conn) writeUnread(data []byte, closing bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.unreadChunks = append(c.unreadChunks, data)
-	c.closed = closing
+	if len(data) != 0 {
+		c.unreadChunks = append(c.unreadChunks, data)
+	}
+	c.closed = c.closed || closing
 
-	if c.isWaiting {
-		c.waitingDataSender <- struct{}{}
+	select {
+	case c.dataAdded <- struct{}{}:
+	default:
 	}
 }
 
 func (c *Conn) Read(p []byte) (n int, err error) {
-	if len(c.unreadChunks) == 0 && c.closed {
-		return 0, io.EOF
-	}
-
 	// If there is no data, wait until there is or the peer closed.
 	c.lock.Lock()
-	if len(c.unreadChunks) == c.unreadChunkPos {
-		c.isWaiting = true
-		c.lock.Unlock()
-
-		<-c.waitingDataSender
+	for len(c.unreadChunks) == c.unreadChunkPos {
 		if c.closed {
+			c.lock.Unlock()
 			return 0, io.EOF
 		}
-		c.isWaiting = false
-	} else {
+
 		c.lock.Unlock()
+		<-c.dataAdded
+		c.lock.Lock()
 	}
+	defer c.lock.Unlock()
 
 	for c.unreadChunkPos < len(c.unreadChunks) {
 		for c.unreadInChunkPos < len(c.unreadChunks[c.unreadChunkPos]) {
@@ -86,7 +85,10 @@ func (c *Conn) Read(p []byte) (n int, err error) {
 }
 
 func (c *Conn) Write(p []byte) (n int, err error) {
-	if c.closed {
+	c.lock.Lock()
+	closed := c.closed
+	c.lock.Unlock()
+	if closed {
 		return 0, net.ErrClosed
 	}
 
@@ -94,7 +96,7 @@ func (c *Conn) Write(p []byte) (n int, err error) {
 }
 
 func (c *Conn) RemoteAddr() string {
-	if addr, ok := c.connMuxer.underlyingConn.(transport.RemoteAddrHaver); ok {
+	if addr, ok := c.connMuxer.underlayingConn.(transport.RemoteAddrHaver); ok {
 		return addr.RemoteAddr()
 	}
 	return ""
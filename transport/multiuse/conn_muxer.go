@@ -3,17 +3,24 @@ package multiuse
 import (
 	"encoding/gob"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/FluffyKebab/pearly/transport"
 	"github.com/google/uuid"
 )
 
-var ErrInvalidConnID = errors.New("invalid connection id")
+var (
+	ErrInvalidConnID  = errors.New("invalid connection id")
+	ErrMuxerClosed    = errors.New("connection muxer is closed")
+	ErrConnectionDead = errors.New("no keepalive received from remote")
+)
 
 type connMuxerPayload struct {
-	ConnID  string
-	Data    []byte
-	Closing bool
+	ConnID    string
+	Data      []byte
+	Closing   bool
+	KeepAlive bool
 }
 
 type ConnMuxer struct {
@@ -21,8 +28,18 @@ type ConnMuxer struct {
 	peerID          []byte
 	encoder         *gob.Encoder
 	decoder         *gob.Decoder
-	conns           map[string]*Conn
-	done            chan struct{}
+	transport       *Transport
+
+	encoderLock *sync.Mutex
+
+	lock         *sync.Mutex
+	conns        map[string]*Conn
+	lastReceived time.Time
+	idleSince    time.Time
+
+	done      chan struct{}
+	closeOnce *sync.Once
+	err       error
 }
 
 func NewConnMuxer(
@@ -32,30 +49,39 @@ func NewConnMuxer(
 ) *ConnMuxer {
 	cm := &ConnMuxer{
 		underlayingConn: underlaying,
+		peerID:          peerID,
 		encoder:         gob.NewEncoder(underlaying),
 		decoder:         gob.NewDecoder(underlaying),
+		transport:       t,
+		encoderLock:     &sync.Mutex{},
+		lock:            &sync.Mutex{},
 		conns:           make(map[string]*Conn, 0),
+		lastReceived:    time.Now(),
+		idleSince:       time.Now(),
 		done:            make(chan struct{}),
+		closeOnce:       &sync.Once{},
 	}
 
 	go func() {
 		for {
-			select {
-			case <-cm.done:
-				return
-			default:
-			}
-
 			newConn, err := cm.handleNewPayload()
 			if err != nil {
-				t.errChan <- err
+				cm.closeWithErr(err)
+				if !errors.Is(err, ErrMuxerClosed) {
+					t.sendError(err)
+				}
+				return
 			}
 			if newConn != nil {
-				t.connChan <- newConn
+				t.sendConn(newConn)
 			}
 		}
 	}()
 
+	if t.keepALiveTime > 0 {
+		go cm.keepAlive()
+	}
+
 	return cm
 }
 
@@ -63,27 +89,48 @@ func (cm *ConnMuxer) handleNewPayload() (*Conn, error) {
 	var payload connMuxerPayload
 	err := cm.decoder.Decode(&payload)
 	if err != nil {
+		if cm.isClosed() {
+			return nil, ErrMuxerClosed
+		}
 		return nil, err
 	}
 
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.lastReceived = time.Now()
+	if payload.KeepAlive {
+		return nil, nil
+	}
+
 	// The connection allready exist.
 	if conn, ok := cm.conns[payload.ConnID]; ok {
 		if payload.Closing {
-			cm.conns[payload.ConnID] = nil
+			cm.removeConn(payload.ConnID)
 		}
 
-		conn.writeUread(payload.Data, payload.Closing)
+		conn.writeUnread(payload.Data, payload.Closing)
+		return nil, nil
+	}
+
+	// Data for a connection that was closed locally is dropped.
+	if payload.Closing {
 		return nil, nil
 	}
 
 	// Peer wants to open a new connection.
 	newConn := NewConn(cm, payload.ConnID)
 	cm.conns[payload.ConnID] = newConn
-	newConn.writeUread(payload.Data, false)
+	newConn.writeUnread(payload.Data, false)
 	return newConn, nil
 }
 
 func (cm *ConnMuxer) NewConn() (*Conn, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if cm.isClosed() {
+		return nil, ErrMuxerClosed
+	}
+
 	id := uuid.New().String()
 	newConn := NewConn(cm, id)
 	cm.conns[id] = newConn
@@ -92,29 +139,135 @@ func (cm *ConnMuxer) NewConn() (*Conn, error) {
 }
 
 func (cm *ConnMuxer) WriteToConnWithID(id string, data []byte) error {
-	if _, ok := cm.conns[id]; !ok {
+	cm.lock.Lock()
+	_, ok := cm.conns[id]
+	cm.lock.Unlock()
+	if !ok {
 		return ErrInvalidConnID
 	}
 
-	return cm.encoder.Encode(connMuxerPayload{
+	return cm.encode(connMuxerPayload{
 		ConnID: id,
 		Data:   data,
 	})
 }
 
 func (cm *ConnMuxer) CloseConnWithID(id string) error {
-	if _, ok := cm.conns[id]; !ok {
+	cm.lock.Lock()
+	_, ok := cm.conns[id]
+	cm.removeConn(id)
+	cm.lock.Unlock()
+	if !ok {
 		return ErrInvalidConnID
 	}
 
-	return cm.encoder.Encode(connMuxerPayload{
+	return cm.encode(connMuxerPayload{
 		ConnID:  id,
 		Closing: true,
 	})
 }
 
-// Close closes the underlaying connection of the muxer.
+// NumConns returns the number of open connections using the muxer.
+func (cm *ConnMuxer) NumConns() int {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return len(cm.conns)
+}
+
+// Done returns a channel that is closed when the muxer is closed.
+func (cm *ConnMuxer) Done() <-chan struct{} {
+	return cm.done
+}
+
+// Close closes the underlaying connection of the muxer and all the
+// connections using it.
 func (cm *ConnMuxer) Close() error {
-	<-cm.done
-	return cm.underlayingConn.Close()
+	cm.closeWithErr(ErrMuxerClosed)
+	return nil
+}
+
+func (cm *ConnMuxer) closeWithErr(err error) {
+	cm.closeOnce.Do(func() {
+		cm.lock.Lock()
+		cm.err = err
+		close(cm.done)
+		conns := cm.conns
+		cm.conns = make(map[string]*Conn)
+		cm.lock.Unlock()
+
+		cm.underlayingConn.Close()
+		for _, conn := range conns {
+			conn.writeUnread(nil, true)
+		}
+		cm.transport.removeMuxer(cm)
+	})
+}
+
+func (cm *ConnMuxer) isClosed() bool {
+	select {
+	case <-cm.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cm *ConnMuxer) encode(payload connMuxerPayload) error {
+	cm.encoderLock.Lock()
+	defer cm.encoderLock.Unlock()
+	if cm.isClosed() {
+		return ErrMuxerClosed
+	}
+
+	err := cm.encoder.Encode(payload)
+	if err != nil {
+		cm.closeWithErr(err)
+	}
+	return err
+}
+
+// removeConn must be called with the lock held.
+func (cm *ConnMuxer) removeConn(id string) {
+	delete(cm.conns, id)
+	if len(cm.conns) == 0 {
+		cm.idleSince = time.Now()
+	}
+}
+
+// keepAlive sends a keepalive every keepalive interval. The muxer is closed
+// if nothing has been received from the remote for three intervals, or if it
+// has had no connections for longer than the idle timeout.
+func (cm *ConnMuxer) keepAlive() {
+	interval := cm.transport.keepALiveTime
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-cm.done:
+			return
+		}
+
+		cm.lock.Lock()
+		dead := time.Since(cm.lastReceived) > 3*interval
+		idle := len(cm.conns) == 0 && cm.transport.idleTimeout > 0 &&
+			time.Since(cm.idleSince) > cm.transport.idleTimeout
+		cm.lock.Unlock()
+
+		switch {
+		case dead:
+			cm.closeWithErr(ErrConnectionDead)
+			cm.transport.sendError(ErrConnectionDead)
+			return
+		case idle:
+			cm.Close()
+			return
+		}
+
+		if err := cm.encode(connMuxerPayload{KeepAlive: true}); err != nil {
+			cm.transport.sendError(err)
+			return
+		}
+	}
 }
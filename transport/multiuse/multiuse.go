@@ -3,6 +3,7 @@ package multiuse
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/FluffyKebab/pearly/peer"
@@ -12,26 +13,59 @@ import (
 type Transport struct {
 	underlaying   transport.Transport
 	keepALiveTime time.Duration
-	openConns     map[string]*ConnMuxer
-	errChan       chan error
-	connChan      chan transport.Conn
+	idleTimeout   time.Duration
+
+	lock      *sync.Mutex
+	openConns map[string]*ConnMuxer
+	errChan   chan error
+	connChan  chan transport.Conn
+	listening bool
+	done      chan struct{}
 }
 
 var _ transport.Transport = &Transport{}
 
-func New(underlaying transport.Transport, timeInbetweenKeepAlive time.Duration) *Transport {
-	return &Transport{
+type Option func(*Transport)
+
+// WithIdleTimeout closes muxers that have had no open connections for the
+// duration. It is checked every keepalive interval.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.idleTimeout = d
+	}
+}
+
+// New creates a transport that reuses one underlaying connection per peer. A
+// keepalive is sent every timeInbetweenKeepAlive, and connections where
+// nothing is received for three intervals are closed. Zero disables
+// keepalives.
+func New(underlaying transport.Transport, timeInbetweenKeepAlive time.Duration, opts ...Option) *Transport {
+	t := &Transport{
 		underlaying:   underlaying,
 		keepALiveTime: timeInbetweenKeepAlive,
+		lock:          &sync.Mutex{},
 		openConns:     make(map[string]*ConnMuxer),
 		errChan:       make(chan error),
 		connChan:      make(chan transport.Conn),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
+	return t
 }
 
 func (t *Transport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
-	if connMuxer, ok := t.openConns[string(p.ID())]; ok {
-		return connMuxer.NewConn()
+	t.lock.Lock()
+	connMuxer, ok := t.openConns[string(p.ID())]
+	t.lock.Unlock()
+	if ok {
+		conn, err := connMuxer.NewConn()
+		if err == nil {
+			return conn, nil
+		}
+		// The muxer was closed after it was looked up, so a new one is dialed.
+		t.removeMuxer(connMuxer)
 	}
 
 	newConn, err := t.underlaying.Dial(ctx, p)
@@ -40,8 +74,9 @@ func (t *Transport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, erro
 	}
 
 	newConnMuxer := NewConnMuxer(newConn, p.ID(), t)
-
+	t.lock.Lock()
 	t.openConns[string(p.ID())] = newConnMuxer
+	t.lock.Unlock()
 	return newConnMuxer.NewConn()
 }
 
@@ -51,18 +86,27 @@ func (t *Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan e
 		return nil, nil, err
 	}
 
+	t.lock.Lock()
+	t.listening = true
+	t.lock.Unlock()
+
 	go func() {
 		for {
 			select {
 			case err := <-errChan:
-				t.errChan <- err
+				t.sendError(err)
 			case conn := <-underlayingConnChan:
 				if ider, ok := conn.(transport.RemoteIDHaver); ok {
-					t.openConns[string(ider.RemoteID())] = NewConnMuxer(conn, ider.RemoteID(), t)
+					connMuxer := NewConnMuxer(conn, ider.RemoteID(), t)
+					t.lock.Lock()
+					t.openConns[string(ider.RemoteID())] = connMuxer
+					t.lock.Unlock()
 					continue
 				}
-				t.errChan <- errors.New("underlaying transport of multiuse must create remote id having connections. Try using encrypted instead")
+				t.sendError(errors.New("underlaying transport of multiuse must create remote id having connections. Try using encrypted instead"))
 			case <-ctx.Done():
+				close(t.done)
+				t.closeMuxers()
 				return
 			}
 		}
@@ -74,3 +118,66 @@ func (t *Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan e
 func (t *Transport) ListenAddr() string {
 	return t.underlaying.ListenAddr()
 }
+
+// NumMuxers returns the number of open underlaying connections.
+func (t *Transport) NumMuxers() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.openConns)
+}
+
+func (t *Transport) removeMuxer(cm *ConnMuxer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.openConns[string(cm.peerID)] == cm {
+		delete(t.openConns, string(cm.peerID))
+	}
+}
+
+func (t *Transport) closeMuxers() {
+	t.lock.Lock()
+	muxers := make([]*ConnMuxer, 0, len(t.openConns))
+	for _, cm := range t.openConns {
+		muxers = append(muxers, cm)
+	}
+	t.lock.Unlock()
+
+	for _, cm := range muxers {
+		cm.Close()
+	}
+}
+
+// sendError sends the error to the error channel returned by Listen. Errors
+// are dropped if the transport is not listening.
+func (t *Transport) sendError(err error) {
+	if !t.isListening() {
+		return
+	}
+
+	select {
+	case t.errChan <- err:
+	case <-t.done:
+	}
+}
+
+// sendConn sends a connection opened by the remote to the connection channel
+// returned by Listen. The connection is closed if the transport is not
+// listening.
+func (t *Transport) sendConn(c transport.Conn) {
+	if !t.isListening() {
+		c.Close()
+		return
+	}
+
+	select {
+	case t.connChan <- c:
+	case <-t.done:
+		c.Close()
+	}
+}
+
+func (t *Transport) isListening() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.listening
+}
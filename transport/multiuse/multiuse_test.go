@@ -60,7 +60,88 @@ func TestMultiuseWithEncryptedTCP(t *testing.T) {
 	<-doneRecived
 }
 
+func TestDeadConnectionIsRedialed(t *testing.T) {
+	t.Parallel()
+
+	// The second transport never sends keepalives, so the first one detects
+	// the connection as dead.
+	t1 := createTransportWithKeepAlive(t, 10*time.Millisecond)
+	t2 := createTransportWithKeepAlive(t, 0)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	errChan1, err := listenDiscardingConns(ctx, t1)
+	require.NoError(t, err)
+	_, err = listenDiscardingConns(ctx, t2)
+	require.NoError(t, err)
+
+	_, err = t1.Dial(context.Background(), peer.New(nil, t2.ListenAddr()))
+	require.NoError(t, err)
+	require.Equal(t, 1, t1.NumMuxers())
+
+	require.ErrorIs(t, <-errChan1, ErrConnectionDead)
+	require.Equal(t, 0, t1.NumMuxers())
+
+	_, err = t1.Dial(context.Background(), peer.New(nil, t2.ListenAddr()))
+	require.NoError(t, err)
+	require.Equal(t, 1, t1.NumMuxers())
+}
+
+func TestIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	t1 := createTransportWithKeepAlive(t, 10*time.Millisecond, WithIdleTimeout(50*time.Millisecond))
+	t2 := createTransportWithKeepAlive(t, 10*time.Millisecond)
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	_, err := listenDiscardingConns(ctx, t1)
+	require.NoError(t, err)
+	_, err = listenDiscardingConns(ctx, t2)
+	require.NoError(t, err)
+
+	conn, err := t1.Dial(context.Background(), peer.New(nil, t2.ListenAddr()))
+	require.NoError(t, err)
+
+	// The muxer is kept while a connection is open.
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, t1.NumMuxers())
+
+	require.NoError(t, conn.Close())
+	deadline := time.Now().Add(3 * time.Second)
+	for t1.NumMuxers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle muxer was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func listenDiscardingConns(ctx context.Context, t *Transport) (<-chan error, error) {
+	connChan, errChan, err := t.Listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case c := <-connChan:
+				go io.Copy(io.Discard, c)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return errChan, nil
+}
+
 func createTransport(t *testing.T) *Transport {
+	t.Helper()
+	return createTransportWithKeepAlive(t, time.Second*15)
+}
+
+func createTransportWithKeepAlive(t *testing.T, keepAlive time.Duration, opts ...Option) *Transport {
 	t.Helper()
 	port, err := testutil.GetAvailablePort()
 	require.NoError(t, err)
@@ -68,5 +149,5 @@ func createTransport(t *testing.T) *Transport {
 	e, err := encrypted.NewTransport(tcp.New(port))
 	require.NoError(t, err)
 
-	return New(e, time.Second*15)
+	return New(e, keepAlive, opts...)
 }
@@ -0,0 +1,87 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	_protoVersion = 0
+	_headerSize   = 12
+)
+
+type frameType uint8
+
+const (
+	typeData frameType = iota
+	typeWindowUpdate
+	typePing
+	typeGoAway
+)
+
+type flags uint16
+
+const (
+	flagSYN flags = 1 << iota
+	flagACK
+	flagFIN
+	flagRST
+)
+
+// GoAway codes.
+const (
+	goAwayNormal uint32 = iota
+	goAwayProtocolError
+	goAwayInternalError
+)
+
+// header is the header of every frame:
+//
+//	version (1) | type (1) | flags (2) | stream id (4) | length (4)
+//
+// For data frames length is the size of the data following the header. For
+// window updates it is the window increment, for pings an opaque value and for
+// GoAway the reason code.
+type header [_headerSize]byte
+
+func newHeader(t frameType, f flags, streamID uint32, length uint32) header {
+	var h header
+	h[0] = _protoVersion
+	h[1] = byte(t)
+	binary.BigEndian.PutUint16(h[2:4], uint16(f))
+	binary.BigEndian.PutUint32(h[4:8], streamID)
+	binary.BigEndian.PutUint32(h[8:12], length)
+	return h
+}
+
+func (h header) version() uint8 {
+	return h[0]
+}
+
+func (h header) frameType() frameType {
+	return frameType(h[1])
+}
+
+func (h header) flags() flags {
+	return flags(binary.BigEndian.Uint16(h[2:4]))
+}
+
+func (h header) streamID() uint32 {
+	return binary.BigEndian.Uint32(h[4:8])
+}
+
+func (h header) length() uint32 {
+	return binary.BigEndian.Uint32(h[8:12])
+}
+
+func (h header) String() string {
+	return fmt.Sprintf("version: %d, type: %d, flags: %d, stream: %d, length: %d",
+		h.version(), h.frameType(), h.flags(), h.streamID(), h.length())
+}
+
+func readHeader(r io.Reader) (header, error) {
+	var h header
+	_, err := io.ReadFull(r, h[:])
+	return h, err
+}
@@ -0,0 +1,455 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+const (
+	_defaultWindowSize        = 256 * 1024
+	_defaultAcceptBacklog     = 256
+	_defaultKeepAliveInterval = 30 * time.Second
+	_defaultKeepAliveTimeout  = 10 * time.Second
+
+	_maxFrameSize = 64 * 1024
+)
+
+var (
+	ErrSessionClosed    = errors.New("session is closed")
+	ErrRemoteGoAway     = errors.New("remote does not accept new streams")
+	ErrProtocol         = errors.New("mux protocol error")
+	ErrWindowExceeded   = errors.New("remote exceeded the receive window")
+	ErrKeepAliveTimeout = errors.New("keepalive timed out")
+)
+
+type config struct {
+	windowSize        uint32
+	acceptBacklog     int
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+}
+
+type Option func(*config)
+
+// WithKeepAlive sets how often the session is pinged and how long to wait
+// for the response before the session is closed. An interval of zero
+// disables keepalives.
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return func(c *config) {
+		c.keepAliveInterval = interval
+		c.keepAliveTimeout = timeout
+	}
+}
+
+// WithAcceptBacklog sets the number of inbound streams that can wait to be
+// accepted. Streams opened by the remote when the backlog is full are reset.
+func WithAcceptBacklog(num int) Option {
+	return func(c *config) {
+		c.acceptBacklog = num
+	}
+}
+
+func defaultConfig() *config {
+	return &config{
+		windowSize:        _defaultWindowSize,
+		acceptBacklog:     _defaultAcceptBacklog,
+		keepAliveInterval: _defaultKeepAliveInterval,
+		keepAliveTimeout:  _defaultKeepAliveTimeout,
+	}
+}
+
+// Session multiplexes streams over a single connection. Streams opened by the
+// client have odd IDs and streams opened by the server even IDs.
+type Session struct {
+	conn   transport.Conn
+	config *config
+
+	nextID   *atomic.Uint32
+	lock     *sync.Mutex
+	streams  map[uint32]*Stream
+	accept   chan *Stream
+	goAway   bool
+	remoteGA bool
+
+	pingID *atomic.Uint32
+	pings  map[uint32]chan struct{}
+
+	writeLock *sync.Mutex
+
+	done      chan struct{}
+	closeOnce *sync.Once
+	err       error
+}
+
+// Client creates the session of the side that dialed the connection.
+func Client(conn transport.Conn, opts ...Option) *Session {
+	return newSession(conn, 1, opts)
+}
+
+// Server creates the session of the side that accepted the connection.
+func Server(conn transport.Conn, opts ...Option) *Session {
+	return newSession(conn, 2, opts)
+}
+
+func newSession(conn transport.Conn, firstID uint32, opts []Option) *Session {
+	c := defaultConfig()
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	s := &Session{
+		conn:      conn,
+		config:    c,
+		nextID:    &atomic.Uint32{},
+		lock:      &sync.Mutex{},
+		streams:   make(map[uint32]*Stream),
+		accept:    make(chan *Stream, c.acceptBacklog),
+		pingID:    &atomic.Uint32{},
+		pings:     make(map[uint32]chan struct{}),
+		writeLock: &sync.Mutex{},
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	s.nextID.Store(firstID)
+
+	go s.readLoop()
+	if c.keepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+// Open opens a new stream.
+func (s *Session) Open(ctx context.Context) (*Stream, error) {
+	s.lock.Lock()
+	if s.isClosed() {
+		s.lock.Unlock()
+		return nil, s.closeErr()
+	}
+	if s.remoteGA {
+		s.lock.Unlock()
+		return nil, ErrRemoteGoAway
+	}
+
+	id := s.nextID.Add(2) - 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	err := s.sendFrame(newHeader(typeWindowUpdate, flagSYN, id, 0), nil)
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the remote to open a stream.
+func (s *Session) Accept(ctx context.Context) (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ping sends a ping to the remote and returns the round trip time.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	id := s.pingID.Add(1)
+	pong := make(chan struct{})
+
+	s.lock.Lock()
+	s.pings[id] = pong
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.pings, id)
+		s.lock.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.sendFrame(newHeader(typePing, flagSYN, 0, id), nil); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-s.done:
+		return 0, s.closeErr()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// GoAway tells the remote that no new streams will be accepted. Existing
+// streams keep working.
+func (s *Session) GoAway() error {
+	s.lock.Lock()
+	s.goAway = true
+	s.lock.Unlock()
+	return s.sendFrame(newHeader(typeGoAway, 0, 0, goAwayNormal), nil)
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+// Done returns a channel that is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session was closed, or nil if it is open.
+func (s *Session) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.isClosed() {
+		return nil
+	}
+	return s.err
+}
+
+// Conn returns the underlying connection.
+func (s *Session) Conn() transport.Conn {
+	return s.conn
+}
+
+// Close sends GoAway, closes the underlying connection and resets all
+// streams.
+func (s *Session) Close() error {
+	if s.isClosed() {
+		return nil
+	}
+	s.sendFrame(newHeader(typeGoAway, 0, 0, goAwayNormal), nil)
+	s.closeWithErr(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithErr(err error) {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		close(s.done)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.lock.Unlock()
+
+		s.conn.Close()
+		for _, stream := range streams {
+			stream.lock.Lock()
+			if stream.state != streamClosed {
+				stream.state = streamReset
+			}
+			stream.lock.Unlock()
+			stream.notifyAll()
+		}
+	})
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) closeErr() error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return ErrSessionClosed
+}
+
+func (s *Session) sendFrame(h header, body []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.isClosed() {
+		return s.closeErr()
+	}
+
+	if _, err := s.conn.Write(append(h[:], body...)); err != nil {
+		s.closeWithErr(fmt.Errorf("writing frame: %w", err))
+		return err
+	}
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) readLoop() {
+	for {
+		h, err := readHeader(s.conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrSessionClosed
+			}
+			s.closeWithErr(err)
+			return
+		}
+
+		if err := s.handleFrame(h); err != nil {
+			if errors.Is(err, ErrProtocol) || errors.Is(err, ErrWindowExceeded) {
+				s.sendFrame(newHeader(typeGoAway, 0, 0, goAwayProtocolError), nil)
+			}
+			s.closeWithErr(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(h header) error {
+	if h.version() != _protoVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrProtocol, h.version())
+	}
+
+	switch h.frameType() {
+	case typeData, typeWindowUpdate:
+		return s.handleStreamFrame(h)
+	case typePing:
+		return s.handlePing(h)
+	case typeGoAway:
+		s.lock.Lock()
+		s.remoteGA = true
+		s.lock.Unlock()
+		if h.length() != goAwayNormal {
+			return fmt.Errorf("%w: remote sent go away with code %d", ErrProtocol, h.length())
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown frame type %d", ErrProtocol, h.frameType())
+	}
+}
+
+func (s *Session) handleStreamFrame(h header) error {
+	var data []byte
+	if h.frameType() == typeData {
+		if h.length() > _maxFrameSize {
+			return fmt.Errorf("%w: frame of %d bytes", ErrProtocol, h.length())
+		}
+		data = make([]byte, h.length())
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return err
+		}
+	}
+
+	stream, err := s.streamForFrame(h)
+	if err != nil || stream == nil {
+		return err
+	}
+
+	if h.frameType() == typeWindowUpdate {
+		stream.increaseSendWindow(h.length())
+	} else if err := stream.receiveData(data); err != nil {
+		return err
+	}
+
+	if stream.receiveFlags(h.flags()) {
+		s.removeStream(h.streamID())
+	}
+	return nil
+}
+
+// streamForFrame returns the stream the frame belongs to, creating it if the
+// frame opens a new stream. Nil is returned for frames of unknown streams,
+// which can arrive after a stream was closed locally.
+func (s *Session) streamForFrame(h header) (*Stream, error) {
+	id := h.streamID()
+
+	s.lock.Lock()
+	if h.flags()&flagSYN == 0 {
+		stream := s.streams[id]
+		s.lock.Unlock()
+		return stream, nil
+	}
+
+	if _, ok := s.streams[id]; ok || id == 0 || id%2 == s.nextID.Load()%2 {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("%w: invalid stream id %d", ErrProtocol, id)
+	}
+	if s.goAway {
+		s.lock.Unlock()
+		go s.sendFrame(newHeader(typeWindowUpdate, flagRST, id, 0), nil)
+		return nil, nil
+	}
+
+	stream := newStream(s, id)
+	select {
+	case s.accept <- stream:
+		s.streams[id] = stream
+		s.lock.Unlock()
+	default:
+		s.lock.Unlock()
+		go s.sendFrame(newHeader(typeWindowUpdate, flagRST, id, 0), nil)
+		return nil, nil
+	}
+
+	// Frames are sent from other goroutines than the read loop, so that the
+	// read loop never blocks on a remote that is not reading.
+	go s.sendFrame(newHeader(typeWindowUpdate, flagACK, id, 0), nil)
+	return stream, nil
+}
+
+func (s *Session) handlePing(h header) error {
+	if h.flags()&flagSYN != 0 {
+		go s.sendFrame(newHeader(typePing, flagACK, 0, h.length()), nil)
+		return nil
+	}
+
+	s.lock.Lock()
+	pong, ok := s.pings[h.length()]
+	delete(s.pings, h.length())
+	s.lock.Unlock()
+	if ok {
+		close(pong)
+	}
+	return nil
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), s.config.keepAliveTimeout)
+			_, err := s.Ping(ctx)
+			cancel()
+			if err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					err = ErrKeepAliveTimeout
+				}
+				s.closeWithErr(err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createSessions(t *testing.T, opts ...Option) (*Session, *Session) {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	client := Client(c1, opts...)
+	server := Server(c2, opts...)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStream(t *testing.T) {
+	client, server := createSessions(t)
+
+	clientStream, err := client.Open(context.Background())
+	require.NoError(t, err)
+	_, err = clientStream.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, clientStream.CloseWrite())
+
+	serverStream, err := server.Accept(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, clientStream.ID(), serverStream.ID())
+
+	data, err := io.ReadAll(serverStream)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	// The stream is half-closed, so the server can still write.
+	_, err = serverStream.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, serverStream.Close())
+
+	data, err = io.ReadAll(clientStream)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(data))
+
+	_, err = clientStream.Write([]byte("closed"))
+	require.ErrorIs(t, err, ErrStreamClosed)
+	require.Equal(t, 0, client.NumStreams())
+}
+
+func TestFlowControl(t *testing.T) {
+	client, server := createSessions(t)
+
+	clientStream, err := client.Open(context.Background())
+	require.NoError(t, err)
+
+	data := make([]byte, 4*_defaultWindowSize)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	written := make(chan struct{})
+	go func() {
+		clientStream.Write(data)
+		clientStream.CloseWrite()
+		close(written)
+	}()
+
+	// The writer blocks when the window is used up.
+	serverStream, err := server.Accept(context.Background())
+	require.NoError(t, err)
+	select {
+	case <-written:
+		t.Fatal("write did not block without a reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	received, err := io.ReadAll(serverStream)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, received))
+	<-written
+}
+
+func TestReset(t *testing.T) {
+	client, server := createSessions(t)
+
+	clientStream, err := client.Open(context.Background())
+	require.NoError(t, err)
+	serverStream, err := server.Accept(context.Background())
+	require.NoError(t, err)
+
+	require.NoError(t, clientStream.Reset())
+	_, err = serverStream.Read(make([]byte, 1))
+	require.ErrorIs(t, err, ErrStreamReset)
+	_, err = clientStream.Write([]byte("reset"))
+	require.ErrorIs(t, err, ErrStreamReset)
+}
+
+func TestGoAway(t *testing.T) {
+	client, server := createSessions(t)
+
+	_, err := client.Ping(context.Background())
+	require.NoError(t, err)
+
+	require.NoError(t, server.GoAway())
+	// The ping is answered after the go away frame is handled.
+	_, err = client.Ping(context.Background())
+	require.NoError(t, err)
+
+	_, err = client.Open(context.Background())
+	require.ErrorIs(t, err, ErrRemoteGoAway)
+}
+
+func TestKeepAlive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// The remote reads the pings but never answers.
+	go io.Copy(io.Discard, c2)
+
+	session := Client(c1, WithKeepAlive(10*time.Millisecond, 50*time.Millisecond))
+	select {
+	case <-session.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("dead connection was not detected")
+	}
+	require.ErrorIs(t, session.Err(), ErrKeepAliveTimeout)
+}
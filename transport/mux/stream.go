@@ -0,0 +1,261 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrStreamClosed = errors.New("stream is closed")
+	ErrStreamReset  = errors.New("stream was reset")
+)
+
+type streamState int
+
+const (
+	streamOpen streamState = iota
+	streamLocalClosed
+	streamRemoteClosed
+	streamClosed
+	streamReset
+)
+
+// Stream is a bidirectional stream of a session. Writes block when the send
+// window of the stream is used up until the remote has read the data.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	lock         *sync.Mutex
+	state        streamState
+	readClosed   bool
+	recvBuf      *bytes.Buffer
+	recvWindow   uint32
+	sendWindow   uint32
+	readNotify   chan struct{}
+	windowNotify chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:           id,
+		session:      s,
+		lock:         &sync.Mutex{},
+		recvBuf:      &bytes.Buffer{},
+		recvWindow:   s.config.windowSize,
+		sendWindow:   s.config.windowSize,
+		readNotify:   make(chan struct{}, 1),
+		windowNotify: make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.readClosed {
+			s.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if s.recvBuf.Len() > 0 {
+			n, _ := s.recvBuf.Read(p)
+			delta := s.windowIncrement()
+			s.lock.Unlock()
+
+			if delta > 0 {
+				s.session.sendFrame(newHeader(typeWindowUpdate, 0, s.id, delta), nil)
+			}
+			return n, nil
+		}
+
+		switch s.state {
+		case streamRemoteClosed, streamClosed:
+			s.lock.Unlock()
+			return 0, io.EOF
+		case streamReset:
+			s.lock.Unlock()
+			return 0, ErrStreamReset
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.readNotify:
+		case <-s.session.done:
+			return 0, s.session.closeErr()
+		}
+	}
+}
+
+// windowIncrement returns how much the receive window should be increased
+// and updates it. Updates are only sent when at least half the window is
+// used, to avoid sending an update for every read. Must be called with the
+// lock held.
+func (s *Stream) windowIncrement() uint32 {
+	max := s.session.config.windowSize
+	delta := max - uint32(s.recvBuf.Len()) - s.recvWindow
+	if delta < max/2 {
+		return 0
+	}
+	s.recvWindow += delta
+	return delta
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.lock.Lock()
+		switch s.state {
+		case streamLocalClosed, streamClosed:
+			s.lock.Unlock()
+			return written, ErrStreamClosed
+		case streamReset:
+			s.lock.Unlock()
+			return written, ErrStreamReset
+		}
+
+		if s.sendWindow == 0 {
+			s.lock.Unlock()
+			select {
+			case <-s.windowNotify:
+			case <-s.session.done:
+				return written, s.session.closeErr()
+			}
+			continue
+		}
+
+		n := min(uint32(len(p)-written), s.sendWindow, _maxFrameSize)
+		s.sendWindow -= n
+		s.lock.Unlock()
+
+		err := s.session.sendFrame(newHeader(typeData, 0, s.id, n), p[written:written+int(n)])
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream. The remote reads io.EOF after the data
+// already written, but data can still be read from the stream.
+func (s *Stream) CloseWrite() error {
+	s.lock.Lock()
+	switch s.state {
+	case streamOpen:
+		s.state = streamLocalClosed
+	case streamRemoteClosed:
+		s.state = streamClosed
+	default:
+		s.lock.Unlock()
+		return nil
+	}
+	closed := s.state == streamClosed
+	s.lock.Unlock()
+
+	err := s.session.sendFrame(newHeader(typeWindowUpdate, flagFIN, s.id, 0), nil)
+	if closed {
+		s.session.removeStream(s.id)
+	}
+	return err
+}
+
+// Close closes both directions of the stream. Data received after Close is
+// discarded.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	s.readClosed = true
+	s.recvBuf.Reset()
+	s.lock.Unlock()
+	notify(s.readNotify)
+
+	return s.CloseWrite()
+}
+
+// Reset closes the stream immediately. Both sides get ErrStreamReset from
+// pending and later reads and writes.
+func (s *Stream) Reset() error {
+	s.lock.Lock()
+	if s.state == streamClosed || s.state == streamReset {
+		s.lock.Unlock()
+		return nil
+	}
+	s.state = streamReset
+	s.lock.Unlock()
+	s.notifyAll()
+
+	s.session.removeStream(s.id)
+	return s.session.sendFrame(newHeader(typeWindowUpdate, flagRST, s.id, 0), nil)
+}
+
+// receiveData is called by the session with data read from the connection.
+func (s *Stream) receiveData(data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if uint32(len(data)) > s.recvWindow {
+		return ErrWindowExceeded
+	}
+	s.recvWindow -= uint32(len(data))
+
+	if s.readClosed {
+		// The data is discarded, but the remote must be allowed to send more.
+		s.recvWindow += uint32(len(data))
+		if len(data) > 0 {
+			go s.session.sendFrame(newHeader(typeWindowUpdate, 0, s.id, uint32(len(data))), nil)
+		}
+		return nil
+	}
+
+	s.recvBuf.Write(data)
+	notify(s.readNotify)
+	return nil
+}
+
+// receiveFlags handles the flags of a frame and reports whether the stream
+// is done and should be removed from the session.
+func (s *Stream) receiveFlags(f flags) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if f&flagRST != 0 {
+		s.state = streamReset
+		s.notifyAll()
+		return true
+	}
+
+	if f&flagFIN != 0 {
+		switch s.state {
+		case streamOpen:
+			s.state = streamRemoteClosed
+		case streamLocalClosed:
+			s.state = streamClosed
+		}
+		notify(s.readNotify)
+		return s.state == streamClosed
+	}
+	return false
+}
+
+func (s *Stream) increaseSendWindow(delta uint32) {
+	s.lock.Lock()
+	s.sendWindow += delta
+	s.lock.Unlock()
+	notify(s.windowNotify)
+}
+
+func (s *Stream) notifyAll() {
+	notify(s.readNotify)
+	notify(s.windowNotify)
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
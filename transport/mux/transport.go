@@ -0,0 +1,212 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+// Transport opens streams over one session per peer of the underlying
+// transport. Dialing a peer with an open session opens a new stream instead of
+// a new connection. Streams keep the RemoteAddr and RemoteID of the underlying
+// connection.
+type Transport struct {
+	underlying transport.Transport
+	opts       []Option
+
+	lock     *sync.Mutex
+	sessions map[string]*Session
+	all      map[*Session]struct{}
+	connChan chan transport.Conn
+	errChan  chan error
+	ctx      context.Context
+}
+
+var _ transport.Transport = &Transport{}
+
+func New(underlying transport.Transport, opts ...Option) *Transport {
+	return &Transport{
+		underlying: underlying,
+		opts:       opts,
+		lock:       &sync.Mutex{},
+		sessions:   make(map[string]*Session),
+		all:        make(map[*Session]struct{}),
+		connChan:   make(chan transport.Conn),
+		errChan:    make(chan error),
+	}
+}
+
+func (t *Transport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
+	key := sessionKey(p.ID(), p.PublicAddr())
+
+	t.lock.Lock()
+	session, ok := t.sessions[key]
+	t.lock.Unlock()
+	if ok {
+		stream, err := session.Open(ctx)
+		if err == nil {
+			return transport.WrapConn(session.Conn(), stream), nil
+		}
+		// Sessions that are closed, whatever the reason, or that the remote
+		// no longer accepts streams on are replaced by a new session.
+		if session.Err() == nil && !errors.Is(err, ErrRemoteGoAway) {
+			return nil, err
+		}
+		t.removeSession(key, session)
+	}
+
+	c, err := t.underlying.Dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	session = Client(c, t.opts...)
+	t.addSession(key, session)
+
+	stream, err := session.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return transport.WrapConn(c, stream), nil
+}
+
+// Listen returns the streams opened by remotes, both on connections accepted
+// by the underlying transport and on connections dialed by this transport.
+func (t *Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
+	connChan, errChan, err := t.underlying.Listen(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.lock.Lock()
+	t.ctx = ctx
+	sessions := make([]*Session, 0, len(t.all))
+	for session := range t.all {
+		sessions = append(sessions, session)
+	}
+	t.lock.Unlock()
+	for _, session := range sessions {
+		go t.acceptStreams(ctx, session)
+	}
+
+	go func() {
+		for {
+			select {
+			case err, ok := <-errChan:
+				if !ok {
+					return
+				}
+				select {
+				case t.errChan <- err:
+				case <-ctx.Done():
+					return
+				}
+			case c, ok := <-connChan:
+				if !ok {
+					return
+				}
+				key := sessionKey(remoteID(c), remoteAddr(c))
+				t.addSession(key, Server(c, t.opts...))
+			case <-ctx.Done():
+				t.closeSessions()
+				return
+			}
+		}
+	}()
+
+	return t.connChan, t.errChan, nil
+}
+
+func (t *Transport) ListenAddr() string {
+	return t.underlying.ListenAddr()
+}
+
+// NumSessions returns the number of open sessions.
+func (t *Transport) NumSessions() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.all)
+}
+
+func (t *Transport) addSession(key string, session *Session) {
+	t.lock.Lock()
+	// If both peers dial each other at the same time, the first session is
+	// used for dialing and the second one is only used for accepting streams.
+	if _, ok := t.sessions[key]; !ok {
+		t.sessions[key] = session
+	}
+	t.all[session] = struct{}{}
+	ctx := t.ctx
+	t.lock.Unlock()
+
+	if ctx != nil {
+		go t.acceptStreams(ctx, session)
+	}
+	go func() {
+		<-session.Done()
+		t.removeSession(key, session)
+	}()
+}
+
+func (t *Transport) removeSession(key string, session *Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.sessions[key] == session {
+		delete(t.sessions, key)
+	}
+	delete(t.all, session)
+}
+
+func (t *Transport) acceptStreams(ctx context.Context, session *Session) {
+	for {
+		stream, err := session.Accept(ctx)
+		if err != nil {
+			return
+		}
+
+		select {
+		case t.connChan <- transport.WrapConn(session.Conn(), stream):
+		case <-ctx.Done():
+			stream.Reset()
+			return
+		}
+	}
+}
+
+func (t *Transport) closeSessions() {
+	t.lock.Lock()
+	sessions := t.all
+	t.sessions = make(map[string]*Session)
+	t.all = make(map[*Session]struct{})
+	t.lock.Unlock()
+
+	for session := range sessions {
+		session.Close()
+	}
+}
+
+// sessionKey identifies the peer of a session by its ID if it is known, and
+// otherwise by its address.
+func sessionKey(id []byte, addr string) string {
+	if len(id) != 0 {
+		return "id:" + string(id)
+	}
+	return "addr:" + addr
+}
+
+func remoteID(c transport.Conn) []byte {
+	if ider, ok := c.(transport.RemoteIDHaver); ok {
+		return ider.RemoteID()
+	}
+	return nil
+}
+
+func remoteAddr(c transport.Conn) string {
+	if addrHaver, ok := c.(transport.RemoteAddrHaver); ok {
+		return addrHaver.RemoteAddr()
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package mux
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	createTransport := func() *Transport {
+		port, err := testutil.GetAvailablePort()
+		require.NoError(t, err)
+		return New(tcp.New(port))
+	}
+	t1 := createTransport()
+	t2 := createTransport()
+
+	_, _, err := t1.Listen(ctx)
+	require.NoError(t, err)
+	connChan, _, err := t2.Listen(ctx)
+	require.NoError(t, err)
+
+	numStreams := 5
+	go func() {
+		for range numStreams {
+			c := <-connChan
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	for range numStreams {
+		c, err := t1.Dial(ctx, peer.New(nil, t2.ListenAddr()))
+		require.NoError(t, err)
+		require.NotEmpty(t, c.(transport.RemoteAddrHaver).RemoteAddr())
+
+		_, err = c.Write([]byte("echo"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		require.NoError(t, err)
+		require.Equal(t, "echo", string(buf))
+		require.NoError(t, c.Close())
+	}
+
+	require.Equal(t, 1, t1.NumSessions())
+	require.Equal(t, 1, t2.NumSessions())
+}
+
+func TestTransportReplacesDeadSession(t *testing.T) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	t1 := New(tcp.New(port1))
+	t2 := New(tcp.New(port2))
+	connChan, _, err := t2.Listen(ctx)
+	require.NoError(t, err)
+	go func() {
+		for c := range connChan {
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	p := peer.New(nil, t2.ListenAddr())
+	c, err := t1.Dial(ctx, p)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	// The session dies with an error other than ErrSessionClosed.
+	t1.lock.Lock()
+	session := t1.sessions[sessionKey(nil, t2.ListenAddr())]
+	t1.lock.Unlock()
+	session.closeWithErr(ErrKeepAliveTimeout)
+
+	c, err = t1.Dial(ctx, p)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("echo"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "echo", string(buf))
+}
@@ -0,0 +1,155 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+const (
+	_lengthSize = 2
+	// _maxPlaintextSize is the maximum size of the plaintext of a transport
+	// message.
+	_maxPlaintextSize = _maxMessageSize - _tagSize
+)
+
+// Conn sends data as Noise transport messages, each prefixed by its length as
+// a big-endian uint16.
+type Conn struct {
+	conn       transport.Conn
+	remoteID   []byte
+	remotePort string
+
+	readLock   *sync.Mutex
+	recv       *cipherState
+	unread     []byte
+	readBuffer []byte
+
+	writeLock   *sync.Mutex
+	send        *cipherState
+	writeBuffer []byte
+}
+
+var (
+	_ transport.Conn            = &Conn{}
+	_ transport.RemoteAddrHaver = &Conn{}
+	_ transport.RemoteIDHaver   = &Conn{}
+	_ io.ByteReader             = &Conn{}
+)
+
+func newConn(c transport.Conn, send, recv *cipherState, remoteID []byte, remotePort string) *Conn {
+	return &Conn{
+		conn:       c,
+		remoteID:   remoteID,
+		remotePort: remotePort,
+		readLock:   &sync.Mutex{},
+		recv:       recv,
+		writeLock:  &sync.Mutex{},
+		send:       send,
+	}
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for len(c.unread) == 0 {
+		msg, err := readMessage(c.conn, &c.readBuffer)
+		if err != nil {
+			return 0, err
+		}
+
+		c.unread, err = c.recv.decrypt(msg[:0], nil, msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+_maxPlaintextSize)]
+
+		msg, err := c.send.encrypt(c.writeBuffer[:0], nil, chunk)
+		if err != nil {
+			return n, err
+		}
+		c.writeBuffer = msg
+		if err := writeMessage(c.conn, msg); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (c *Conn) RemoteAddr() string {
+	if remoteHaver, ok := c.conn.(transport.RemoteAddrHaver); ok {
+		remoteAddr := remoteHaver.RemoteAddr()
+		splitRemoteAddr := strings.Split(remoteAddr, ":")
+		if len(splitRemoteAddr) != 2 {
+			return remoteAddr
+		}
+		return strings.Join([]string{splitRemoteAddr[0], c.remotePort}, ":")
+	}
+	return ""
+}
+
+func (c *Conn) RemoteID() []byte {
+	return c.remoteID
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) ReadByte() (byte, error) {
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(c, buf)
+	return buf[0], err
+}
+
+// writeMessage writes msg prefixed by its length.
+func writeMessage(w io.Writer, msg []byte) error {
+	if len(msg) > _maxMessageSize {
+		return ErrMessageTooLarge
+	}
+
+	buf := make([]byte, _lengthSize, _lengthSize+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// readMessage reads a message written by writeMessage into buf, which is grown
+// if needed.
+func readMessage(r io.Reader, buf *[]byte) ([]byte, error) {
+	header := make([]byte, _lengthSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header))
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	msg := (*buf)[:size]
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
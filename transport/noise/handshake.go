@@ -0,0 +1,450 @@
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher is the cipher function of the handshake. Both peers must use the
+// same cipher.
+type Cipher int
+
+const (
+	// ChaChaPoly is the default cipher, and the one used by libp2p.
+	ChaChaPoly Cipher = iota
+	// AESGCM is faster on hardware with AES instructions.
+	AESGCM
+)
+
+func (c Cipher) String() string {
+	switch c {
+	case ChaChaPoly:
+		return "ChaChaPoly"
+	case AESGCM:
+		return "AESGCM"
+	default:
+		return "unknown"
+	}
+}
+
+// ProtocolName returns the Noise protocol name of the handshake using the
+// cipher.
+func ProtocolName(c Cipher) string {
+	return "Noise_XX_25519_" + c.String() + "_SHA256"
+}
+
+const (
+	_keySize  = 32
+	_hashSize = sha256.Size
+	_tagSize  = 16
+	// _maxMessageSize is the maximum size of a Noise message.
+	_maxMessageSize = math.MaxUint16
+)
+
+var (
+	ErrInvalidMessage    = errors.New("invalid noise message")
+	ErrNonceExhausted    = errors.New("all nonces of the cipher key are used")
+	ErrMessageTooLarge   = errors.New("noise message too large")
+	ErrUnexpectedMessage = errors.New("unexpected noise handshake message")
+	ErrUnsupportedCipher = errors.New("unsupported noise cipher")
+)
+
+// cipherState is the CipherState of the Noise spec.
+type cipherState struct {
+	cipher Cipher
+	aead   cipher.AEAD
+	nonce  uint64
+}
+
+func newCipherState(c Cipher, key []byte) (*cipherState, error) {
+	var aead cipher.AEAD
+	switch c {
+	case ChaChaPoly:
+		var err error
+		aead, err = chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+	case AESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnsupportedCipher
+	}
+	return &cipherState{cipher: c, aead: aead}, nil
+}
+
+func (c *cipherState) hasKey() bool {
+	return c != nil && c.aead != nil
+}
+
+// nextNonce returns 32 bits of zeros followed by the counter, which is
+// little-endian for ChaChaPoly and big-endian for AESGCM. The maximum value is
+// reserved by the spec.
+func (c *cipherState) nextNonce() ([]byte, error) {
+	if c.nonce == math.MaxUint64 {
+		return nil, ErrNonceExhausted
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if c.cipher == ChaChaPoly {
+		binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	} else {
+		binary.BigEndian.PutUint64(nonce[4:], c.nonce)
+	}
+	c.nonce++
+	return nonce, nil
+}
+
+func (c *cipherState) encrypt(dst, ad, plaintext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+func (c *cipherState) decrypt(dst, ad, ciphertext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := c.aead.Open(dst, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	return plaintext, nil
+}
+
+// symmetricState is the SymmetricState of the Noise spec.
+type symmetricState struct {
+	cipherFunc Cipher
+	cipher     *cipherState
+	ck         []byte
+	h          []byte
+}
+
+func newSymmetricState(c Cipher) *symmetricState {
+	protocolName := ProtocolName(c)
+	h := make([]byte, _hashSize)
+	if len(protocolName) <= _hashSize {
+		copy(h, protocolName)
+	} else {
+		sum := sha256.Sum256([]byte(protocolName))
+		h = sum[:]
+	}
+
+	return &symmetricState{
+		cipherFunc: c,
+		ck:         append([]byte{}, h...),
+		h:          h,
+	}
+}
+
+func (s *symmetricState) mixKey(inputKeyMaterial []byte) error {
+	ck, key, err := noiseHKDF(s.ck, inputKeyMaterial)
+	if err != nil {
+		return err
+	}
+
+	s.ck = ck
+	s.cipher, err = newCipherState(s.cipherFunc, key)
+	return err
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+func (s *symmetricState) encryptAndHash(dst, plaintext []byte) ([]byte, error) {
+	if !s.cipher.hasKey() {
+		s.mixHash(plaintext)
+		return append(dst, plaintext...), nil
+	}
+
+	out, err := s.cipher.encrypt(dst, s.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(out[len(dst):])
+	return out, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if !s.cipher.hasKey() {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+
+	plaintext, err := s.cipher.decrypt(nil, s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the cipher states used by the initiator and responder to send.
+func (s *symmetricState) split() (*cipherState, *cipherState, error) {
+	key1, key2, err := noiseHKDF(s.ck, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c1, err := newCipherState(s.cipherFunc, key1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newCipherState(s.cipherFunc, key2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+// noiseHKDF returns the two first outputs of the HKDF function of the spec,
+// which is HKDF with the chaining key as salt and empty info.
+func noiseHKDF(chainingKey, inputKeyMaterial []byte) ([]byte, []byte, error) {
+	prk, err := hkdf.Extract(sha256.New, inputKeyMaterial, chainingKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := hkdf.Expand(sha256.New, prk, "", 2*_hashSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:_hashSize], out[_hashSize:], nil
+}
+
+// handshakeState runs the XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+type handshakeState struct {
+	symmetric *symmetricState
+	initiator bool
+	step      int
+
+	s  *ecdh.PrivateKey
+	e  *ecdh.PrivateKey
+	rs *ecdh.PublicKey
+	re *ecdh.PublicKey
+}
+
+// newHandshakeState creates the state of one side of the handshake. If
+// ephemeral is nil, a new ephemeral key is generated.
+func newHandshakeState(
+	c Cipher,
+	initiator bool,
+	prologue []byte,
+	static, ephemeral *ecdh.PrivateKey,
+) (*handshakeState, error) {
+	if c != ChaChaPoly && c != AESGCM {
+		return nil, ErrUnsupportedCipher
+	}
+	if ephemeral == nil {
+		var err error
+		ephemeral, err = generateKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	symmetric := newSymmetricState(c)
+	symmetric.mixHash(prologue)
+	return &handshakeState{
+		symmetric: symmetric,
+		initiator: initiator,
+		s:         static,
+		e:         ephemeral,
+	}, nil
+}
+
+// writeMessage returns the next handshake message, with payload encrypted if
+// a key has been established.
+func (hs *handshakeState) writeMessage(payload []byte) ([]byte, error) {
+	if hs.initiatorSends() != hs.initiator {
+		return nil, ErrUnexpectedMessage
+	}
+
+	msg := make([]byte, 0, 2*(_keySize+_tagSize)+len(payload))
+	var err error
+	switch hs.step {
+	case 0:
+		msg = hs.writeEphemeral(msg)
+	case 1:
+		msg = hs.writeEphemeral(msg)
+		if err = hs.dh(hs.e, hs.re); err != nil {
+			return nil, err
+		}
+		if msg, err = hs.symmetric.encryptAndHash(msg, hs.s.PublicKey().Bytes()); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.s, hs.re); err != nil {
+			return nil, err
+		}
+	case 2:
+		if msg, err = hs.symmetric.encryptAndHash(msg, hs.s.PublicKey().Bytes()); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.s, hs.re); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnexpectedMessage
+	}
+
+	msg, err = hs.symmetric.encryptAndHash(msg, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > _maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	hs.step++
+	return msg, nil
+}
+
+// readMessage processes the next handshake message and returns its payload.
+func (hs *handshakeState) readMessage(msg []byte) ([]byte, error) {
+	if hs.initiatorSends() == hs.initiator {
+		return nil, ErrUnexpectedMessage
+	}
+
+	var err error
+	switch hs.step {
+	case 0:
+		if msg, err = hs.readEphemeral(msg); err != nil {
+			return nil, err
+		}
+	case 1:
+		if msg, err = hs.readEphemeral(msg); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.e, hs.re); err != nil {
+			return nil, err
+		}
+		if msg, err = hs.readStatic(msg); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.e, hs.rs); err != nil {
+			return nil, err
+		}
+	case 2:
+		if msg, err = hs.readStatic(msg); err != nil {
+			return nil, err
+		}
+		if err = hs.dh(hs.e, hs.rs); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnexpectedMessage
+	}
+
+	payload, err := hs.symmetric.decryptAndHash(msg)
+	if err != nil {
+		return nil, err
+	}
+	hs.step++
+	return payload, nil
+}
+
+// done reports whether all the messages of the handshake are processed.
+func (hs *handshakeState) done() bool {
+	return hs.step == 3
+}
+
+// initiatorSends reports whether the initiator sends the current message.
+func (hs *handshakeState) initiatorSends() bool {
+	return hs.step%2 == 0
+}
+
+func (hs *handshakeState) writeEphemeral(msg []byte) []byte {
+	pub := hs.e.PublicKey().Bytes()
+	hs.symmetric.mixHash(pub)
+	return append(msg, pub...)
+}
+
+func (hs *handshakeState) readEphemeral(msg []byte) ([]byte, error) {
+	if len(msg) < _keySize {
+		return nil, ErrInvalidMessage
+	}
+
+	re, err := ecdh.X25519().NewPublicKey(msg[:_keySize])
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	hs.re = re
+	hs.symmetric.mixHash(msg[:_keySize])
+	return msg[_keySize:], nil
+}
+
+func (hs *handshakeState) readStatic(msg []byte) ([]byte, error) {
+	size := _keySize
+	if hs.symmetric.cipher.hasKey() {
+		size += _tagSize
+	}
+	if len(msg) < size {
+		return nil, ErrInvalidMessage
+	}
+
+	static, err := hs.symmetric.decryptAndHash(msg[:size])
+	if err != nil {
+		return nil, err
+	}
+	rs, err := ecdh.X25519().NewPublicKey(static)
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	hs.rs = rs
+	return msg[size:], nil
+}
+
+// split returns the cipher states used to send and receive transport messages
+// after the handshake.
+func (hs *handshakeState) split() (send *cipherState, recv *cipherState, err error) {
+	if !hs.done() {
+		return nil, nil, ErrUnexpectedMessage
+	}
+
+	c1, c2, err := hs.symmetric.split()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hs.initiator {
+		return c1, c2, nil
+	}
+	return c2, c1, nil
+}
+
+func generateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func (hs *handshakeState) dh(private *ecdh.PrivateKey, public *ecdh.PublicKey) error {
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return ErrInvalidMessage
+	}
+	return hs.symmetric.mixKey(secret)
+}
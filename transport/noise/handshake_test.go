@@ -0,0 +1,164 @@
+package noise
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testVector is a vector in the format of the test vectors of the Noise spec.
+type testVector struct {
+	handshake     string
+	initStatic    []byte
+	respStatic    []byte
+	initEphemeral []byte
+	respEphemeral []byte
+	prologue      []byte
+	payloads      [][]byte
+	ciphertexts   [][]byte
+}
+
+// readTestVectors reads the vectors in testdata/vectors.txt, which are
+// separated by empty lines.
+func readTestVectors(t *testing.T) []testVector {
+	data, err := os.ReadFile("testdata/vectors.txt")
+	require.NoError(t, err)
+
+	vectors := make([]testVector, 0)
+	for _, block := range strings.Split(string(data), "\n\n") {
+		var v testVector
+		for _, line := range strings.Split(strings.TrimSpace(block), "\n") {
+			key, value, ok := strings.Cut(line, "=")
+			if strings.HasPrefix(line, "#") || !ok {
+				continue
+			}
+			if key == "handshake" {
+				v.handshake = value
+				continue
+			}
+
+			b := decodeHex(t, value)
+			switch {
+			case key == "init_static":
+				v.initStatic = b
+			case key == "resp_static":
+				v.respStatic = b
+			case key == "gen_init_ephemeral":
+				v.initEphemeral = b
+			case key == "gen_resp_ephemeral":
+				v.respEphemeral = b
+			case key == "prologue":
+				v.prologue = b
+			case strings.HasSuffix(key, "_payload"):
+				v.payloads = append(v.payloads, b)
+			case strings.HasSuffix(key, "_ciphertext"):
+				v.ciphertexts = append(v.ciphertexts, b)
+			}
+		}
+		if v.handshake != "" {
+			vectors = append(vectors, v)
+		}
+	}
+	return vectors
+}
+
+func TestHandshakeVectors(t *testing.T) {
+	vectors := readTestVectors(t)
+	require.Len(t, vectors, 8)
+
+	for i, v := range vectors {
+		t.Run(fmt.Sprintf("%s/%d", v.handshake, i), func(t *testing.T) {
+			c := ChaChaPoly
+			if v.handshake == ProtocolName(AESGCM) {
+				c = AESGCM
+			}
+			require.Equal(t, ProtocolName(c), v.handshake)
+
+			initiator, err := newHandshakeState(c, true, v.prologue, privateKey(t, v.initStatic), privateKey(t, v.initEphemeral))
+			require.NoError(t, err)
+			responder, err := newHandshakeState(c, false, v.prologue, privateKey(t, v.respStatic), privateKey(t, v.respEphemeral))
+			require.NoError(t, err)
+
+			senders := []*handshakeState{initiator, responder, initiator}
+			receivers := []*handshakeState{responder, initiator, responder}
+			for i := 0; i < 3; i++ {
+				msg, err := senders[i].writeMessage(v.payloads[i])
+				require.NoError(t, err)
+				require.Equal(t, hex.EncodeToString(v.ciphertexts[i]), hex.EncodeToString(msg))
+
+				payload, err := receivers[i].readMessage(msg)
+				require.NoError(t, err)
+				require.Equal(t, hex.EncodeToString(v.payloads[i]), hex.EncodeToString(payload))
+			}
+			require.True(t, initiator.done())
+			require.True(t, responder.done())
+
+			initSend, initRecv, err := initiator.split()
+			require.NoError(t, err)
+			respSend, respRecv, err := responder.split()
+			require.NoError(t, err)
+
+			for i, c := range []struct{ send, recv *cipherState }{
+				{initSend, respRecv},
+				{respSend, initRecv},
+			} {
+				msg, err := c.send.encrypt(nil, nil, v.payloads[3+i])
+				require.NoError(t, err)
+				require.Equal(t, hex.EncodeToString(v.ciphertexts[3+i]), hex.EncodeToString(msg))
+
+				payload, err := c.recv.decrypt(nil, nil, msg)
+				require.NoError(t, err)
+				require.Equal(t, hex.EncodeToString(v.payloads[3+i]), hex.EncodeToString(payload))
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsModifiedMessage(t *testing.T) {
+	initiator, err := newHandshakeState(ChaChaPoly, true, nil, generateStaticKey(t), nil)
+	require.NoError(t, err)
+	responder, err := newHandshakeState(ChaChaPoly, false, nil, generateStaticKey(t), nil)
+	require.NoError(t, err)
+
+	msg, err := initiator.writeMessage(nil)
+	require.NoError(t, err)
+	_, err = responder.readMessage(msg)
+	require.NoError(t, err)
+
+	msg, err = responder.writeMessage([]byte("payload"))
+	require.NoError(t, err)
+	msg[len(msg)-1] ^= 1
+	_, err = initiator.readMessage(msg)
+	require.ErrorIs(t, err, ErrInvalidMessage)
+}
+
+func TestHandshakeRejectsMessageOutOfOrder(t *testing.T) {
+	responder, err := newHandshakeState(ChaChaPoly, false, nil, generateStaticKey(t), nil)
+	require.NoError(t, err)
+
+	_, err = responder.writeMessage(nil)
+	require.ErrorIs(t, err, ErrUnexpectedMessage)
+}
+
+func privateKey(t *testing.T, b []byte) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	require.NoError(t, err)
+	return key
+}
+
+func generateStaticKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := generateKey()
+	require.NoError(t, err)
+	return key
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
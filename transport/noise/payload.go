@@ -0,0 +1,229 @@
+package noise
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/FluffyKebab/pearly/crypto"
+)
+
+// The handshake payload is the NoiseHandshakePayload protobuf message of the
+// libp2p Noise spec, so it can be read by other implementations:
+//
+//	message NoiseExtensions {
+//		repeated bytes webtransport_certhashes = 1;
+//		repeated string stream_muxers = 2;
+//	}
+//
+//	message NoiseHandshakePayload {
+//		optional bytes identity_key = 1;
+//		optional bytes identity_sig = 2;
+//		optional NoiseExtensions extensions = 4;
+//	}
+//
+// The identity key is the libp2p PublicKey message, with the key type in field
+// 1 and the key in field 2. The listening port is sent in field 1000 of the
+// extensions, which other implementations ignore.
+const (
+	_payloadIdentityKey = 1
+	_payloadSignature   = 2
+	_payloadExtensions  = 4
+
+	_extensionListeningPort = 1000
+
+	_publicKeyType = 1
+	_publicKeyData = 2
+)
+
+// The key types of the libp2p PublicKey message.
+const (
+	_libp2pKeyRSA     = 0
+	_libp2pKeyEd25519 = 1
+	_libp2pKeyECDSA   = 3
+)
+
+const (
+	_wireVarint  = 0
+	_wireFixed64 = 1
+	_wireBytes   = 2
+	_wireFixed32 = 5
+)
+
+// handshakePayload is sent by both peers in the handshake messages containing
+// their static key.
+type handshakePayload struct {
+	IdentityKey   crypto.PublicKey
+	Signature     []byte
+	ListeningPort string
+}
+
+func (p handshakePayload) marshal() ([]byte, error) {
+	key, err := marshalIdentityKey(p.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data := appendBytesField(nil, _payloadIdentityKey, key)
+	data = appendBytesField(data, _payloadSignature, p.Signature)
+	if p.ListeningPort != "" {
+		extensions := appendBytesField(nil, _extensionListeningPort, []byte(p.ListeningPort))
+		data = appendBytesField(data, _payloadExtensions, extensions)
+	}
+	return data, nil
+}
+
+func unmarshalHandshakePayload(data []byte) (handshakePayload, error) {
+	fields, err := parseFields(data)
+	if err != nil {
+		return handshakePayload{}, err
+	}
+
+	var payload handshakePayload
+	for _, f := range fields {
+		switch f.number {
+		case _payloadIdentityKey:
+			payload.IdentityKey, err = unmarshalIdentityKey(f.bytes)
+			if err != nil {
+				return handshakePayload{}, err
+			}
+		case _payloadSignature:
+			payload.Signature = f.bytes
+		case _payloadExtensions:
+			extensions, err := parseFields(f.bytes)
+			if err != nil {
+				return handshakePayload{}, err
+			}
+			for _, e := range extensions {
+				if e.number == _extensionListeningPort {
+					payload.ListeningPort = string(e.bytes)
+				}
+			}
+		}
+	}
+
+	if payload.IdentityKey == nil {
+		return handshakePayload{}, fmt.Errorf("%w: no identity key", ErrInvalidPayload)
+	}
+	return payload, nil
+}
+
+// marshalIdentityKey returns the libp2p PublicKey message of the key. Ed25519
+// keys are sent raw and ECDSA and RSA keys in PKIX form.
+func marshalIdentityKey(key crypto.PublicKey) ([]byte, error) {
+	var keyType uint64
+	var body []byte
+	switch key.Type() {
+	case crypto.KeyTypeEd25519:
+		keyType = _libp2pKeyEd25519
+		body = key.Std().(ed25519.PublicKey)
+	case crypto.KeyTypeECDSA, crypto.KeyTypeRSA:
+		keyType = _libp2pKeyECDSA
+		if key.Type() == crypto.KeyTypeRSA {
+			keyType = _libp2pKeyRSA
+		}
+		var err error
+		body, err = x509.MarshalPKIXPublicKey(key.Std())
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, crypto.ErrUnsupportedKey
+	}
+
+	data := appendVarintField(nil, _publicKeyType, keyType)
+	return appendBytesField(data, _publicKeyData, body), nil
+}
+
+func unmarshalIdentityKey(data []byte) (crypto.PublicKey, error) {
+	fields, err := parseFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	keyType, body := uint64(0), []byte(nil)
+	for _, f := range fields {
+		switch f.number {
+		case _publicKeyType:
+			keyType = f.varint
+		case _publicKeyData:
+			body = f.bytes
+		}
+	}
+
+	switch keyType {
+	case _libp2pKeyEd25519:
+		return crypto.PublicKeyFromStd(ed25519.PublicKey(body))
+	case _libp2pKeyECDSA, _libp2pKeyRSA:
+		key, err := x509.ParsePKIXPublicKey(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+		}
+		return crypto.PublicKeyFromStd(key)
+	default:
+		return nil, crypto.ErrUnsupportedKey
+	}
+}
+
+// protoField is a field of a protobuf message. Varint is set for varint
+// fields and bytes for length-delimited fields.
+type protoField struct {
+	number uint64
+	varint uint64
+	bytes  []byte
+}
+
+// parseFields returns the fields of a protobuf message in the order they are
+// encoded.
+func parseFields(data []byte) ([]protoField, error) {
+	fields := make([]protoField, 0)
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrInvalidPayload
+		}
+		data = data[n:]
+
+		f := protoField{number: tag >> 3}
+		switch tag & 7 {
+		case _wireVarint:
+			f.varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, ErrInvalidPayload
+			}
+			data = data[n:]
+		case _wireFixed64, _wireFixed32:
+			size := 8
+			if tag&7 == _wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return nil, ErrInvalidPayload
+			}
+			data = data[size:]
+		case _wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return nil, ErrInvalidPayload
+			}
+			f.bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return nil, ErrInvalidPayload
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func appendVarintField(b []byte, number uint64, v uint64) []byte {
+	b = binary.AppendUvarint(b, number<<3|_wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, number uint64, v []byte) []byte {
+	b = binary.AppendUvarint(b, number<<3|_wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
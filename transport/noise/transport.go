@@ -0,0 +1,233 @@
+package noise
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/FluffyKebab/pearly/crypto"
+	"github.com/FluffyKebab/pearly/identity"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+// _staticKeySignaturePrefix is prepended to the static key before it is
+// signed with the identity key. It is the prefix of the libp2p Noise spec.
+const _staticKeySignaturePrefix = "noise-libp2p-static-key:"
+
+// DefaultHandshakeTimeout is the time an accepted connection has to finish the
+// handshake.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrHandshake        = errors.New("noise handshake failed")
+	ErrInvalidSignature = errors.New("static key is not signed by the identity key of the peer")
+	ErrInvalidPayload   = errors.New("invalid noise handshake payload")
+	ErrPeerIDMismatch   = errors.New("peer ID does not match the dialed ID")
+)
+
+// Transport secures the connections of the underlying transport with the
+// Noise XX handshake. The static Noise key is bound to the identity of the
+// node by signing it with the identity key, and the signature is sent in the
+// encrypted handshake payload. The ID of a node is the ID of its identity.
+//
+// The handshake and payload follow the libp2p Noise spec, so peers using
+// ChaChaPoly and Ed25519 or ECDSA identities can connect to libp2p nodes. RSA
+// identities sign with PSS while libp2p uses PKCS #1 v1.5.
+type Transport struct {
+	underlaying      transport.Transport
+	identity         *identity.Identity
+	staticKey        *ecdh.PrivateKey
+	cipher           Cipher
+	handshakeTimeout time.Duration
+}
+
+var _ transport.Transport = Transport{}
+
+type Option func(*Transport)
+
+// WithIdentity makes the transport sign its static key with the identity
+// instead of a new key.
+func WithIdentity(id *identity.Identity) Option {
+	return func(t *Transport) {
+		t.identity = id
+	}
+}
+
+// WithCipher sets the cipher of the handshake, which is ChaChaPoly by default.
+func WithCipher(c Cipher) Option {
+	return func(t *Transport) {
+		t.cipher = c
+	}
+}
+
+// WithHandshakeTimeout sets the time an accepted connection has to finish the
+// handshake before it is closed.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.handshakeTimeout = d
+	}
+}
+
+// New creates a transport that secures the connections of underlaying. A new
+// Ed25519 identity is generated unless WithIdentity is used.
+func New(underlaying transport.Transport, opts ...Option) (Transport, error) {
+	t := Transport{underlaying: underlaying, cipher: ChaChaPoly, handshakeTimeout: DefaultHandshakeTimeout}
+	for _, opt := range opts {
+		opt(&t)
+	}
+
+	if t.identity == nil {
+		id, err := identity.Generate(identity.Ed25519)
+		if err != nil {
+			return Transport{}, err
+		}
+		t.identity = id
+	}
+
+	staticKey, err := generateKey()
+	if err != nil {
+		return Transport{}, err
+	}
+	t.staticKey = staticKey
+	return t, nil
+}
+
+func (t Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
+	return transport.ListenUpgraded(ctx, t.underlaying, t.handshakeTimeout, func(_ context.Context, c transport.Conn) (transport.Conn, error) {
+		return t.upgradeConn(c, false)
+	})
+}
+
+// Dial connects to the peer. The handshake is given up when ctx is done, and
+// if the ID of the peer is set the connection fails unless the peer
+// authenticates with the same ID.
+func (t Transport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
+	c, err := t.underlaying.Dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := transport.Upgrade(ctx, c, func(_ context.Context, c transport.Conn) (transport.Conn, error) {
+		return t.upgradeConn(c, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(p.ID()) != 0 && !bytes.Equal(p.ID(), conn.(*Conn).RemoteID()) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, ErrPeerIDMismatch)
+	}
+	return conn, nil
+}
+
+func (t Transport) ListenAddr() string {
+	return t.underlaying.ListenAddr()
+}
+
+func (t Transport) ID() []byte {
+	return t.identity.ID()
+}
+
+func (t Transport) upgradeConn(c transport.Conn, initiator bool) (*Conn, error) {
+	conn, err := t.handshake(c, initiator)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	return conn, nil
+}
+
+func (t Transport) handshake(c transport.Conn, initiator bool) (*Conn, error) {
+	hs, err := newHandshakeState(t.cipher, initiator, nil, t.staticKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := t.handshakePayload()
+	if err != nil {
+		return nil, err
+	}
+
+	// The initiator sends the first and last message, and the payload is
+	// sent with the static key in the second and third message.
+	var buf []byte
+	var remotePayload []byte
+	for !hs.done() {
+		if hs.initiatorSends() == initiator {
+			var msgPayload []byte
+			if hs.step > 0 {
+				msgPayload = payload
+			}
+			msg, err := hs.writeMessage(msgPayload)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeMessage(c, msg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		msg, err := readMessage(c, &buf)
+		if err != nil {
+			return nil, err
+		}
+		msgPayload, err := hs.readMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		if hs.rs != nil {
+			remotePayload = bytes.Clone(msgPayload)
+		}
+	}
+
+	remote, err := verifyHandshakePayload(remotePayload, hs.rs)
+	if err != nil {
+		return nil, err
+	}
+
+	send, recv, err := hs.split()
+	if err != nil {
+		return nil, err
+	}
+	remoteID, err := crypto.PeerID(remote.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(c, send, recv, remoteID, remote.ListeningPort), nil
+}
+
+func (t Transport) handshakePayload() ([]byte, error) {
+	signature, err := t.identity.Sign(staticKeySignatureMessage(t.staticKey.PublicKey()))
+	if err != nil {
+		return nil, err
+	}
+
+	return handshakePayload{
+		IdentityKey:   t.identity.PrivateKey().Public(),
+		Signature:     signature,
+		ListeningPort: transport.ListeningPort(t.ListenAddr()),
+	}.marshal()
+}
+
+// verifyHandshakePayload checks that the static key of the remote is signed by
+// the identity key in its payload.
+func verifyHandshakePayload(data []byte, staticKey *ecdh.PublicKey) (handshakePayload, error) {
+	payload, err := unmarshalHandshakePayload(data)
+	if err != nil {
+		return handshakePayload{}, err
+	}
+
+	err = payload.IdentityKey.Verify(staticKeySignatureMessage(staticKey), payload.Signature)
+	if err != nil {
+		return handshakePayload{}, fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	return payload, nil
+}
+
+func staticKeySignatureMessage(staticKey *ecdh.PublicKey) []byte {
+	return append([]byte(_staticKeySignaturePrefix), staticKey.Bytes()...)
+}
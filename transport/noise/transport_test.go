@@ -0,0 +1,248 @@
+package noise
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/gob"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/crypto"
+	"github.com/FluffyKebab/pearly/identity"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoiseTCP(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	id, err := identity.Generate(identity.ECDSA)
+	require.NoError(t, err)
+	client, err := New(tcp.New(port1), WithIdentity(id))
+	require.NoError(t, err)
+	require.Equal(t, id.ID(), client.ID())
+
+	server, err := New(tcp.New(port2))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connChan, errChan, err := server.Listen(ctx)
+	require.NoError(t, err)
+
+	conn, err := client.Dial(ctx, peer.New([]byte{}, "localhost:"+port2))
+	require.NoError(t, err)
+	require.Equal(t, server.ID(), conn.(*Conn).RemoteID())
+
+	msg := strings.Repeat("no one will be able to read this exept you server!! ", 5000)
+	go func() {
+		conn.Write([]byte(msg))
+		conn.Close()
+	}()
+
+	timeoutCtx, cancelCtx := context.WithDeadline(context.Background(), time.Now().Add(3*time.Second))
+	defer cancelCtx()
+
+	select {
+	case <-timeoutCtx.Done():
+		t.Fatalf("timeout")
+	case conn := <-connChan:
+		require.Equal(t, client.ID(), conn.(*Conn).RemoteID())
+		require.Equal(t, "127.0.0.1:"+port1, conn.(*Conn).RemoteAddr())
+
+		buf := new(strings.Builder)
+		_, err := io.Copy(buf, conn)
+		require.NoError(t, err)
+		require.Equal(t, msg, buf.String())
+		conn.Close()
+	case err := <-errChan:
+		require.NoError(t, err)
+	}
+}
+
+func TestNoiseSendAndReciveGOB(t *testing.T) {
+	client, err := New(tcp.New("1"))
+	require.NoError(t, err)
+	server, err := New(tcp.New("2"))
+	require.NoError(t, err)
+
+	c1, c2 := net.Pipe()
+	serverConnChan := make(chan *Conn)
+	go func() {
+		conn, err := server.upgradeConn(c2, false)
+		require.NoError(t, err)
+		serverConnChan <- conn
+	}()
+	conn, err := client.upgradeConn(c1, true)
+	require.NoError(t, err)
+	serverConn := <-serverConnChan
+	defer conn.Close()
+
+	type request struct {
+		Field1 string
+		Field2 []int
+	}
+	req := request{
+		Field1: "halo",
+		Field2: []int{4, 6, 2},
+	}
+
+	encoder := gob.NewEncoder(conn)
+	decoder := gob.NewDecoder(serverConn)
+	for i := 0; i < 10; i++ {
+		go encoder.Encode(req)
+
+		var requestGotten request
+		err = decoder.Decode(&requestGotten)
+		require.NoError(t, err)
+		require.Equal(t, req, requestGotten)
+	}
+}
+
+func TestNoiseRejectsUnsignedStaticKey(t *testing.T) {
+	server, err := New(tcp.New("2"))
+	require.NoError(t, err)
+	payload, err := server.handshakePayload()
+	require.NoError(t, err)
+
+	_, err = verifyHandshakePayload(payload, server.staticKey.PublicKey())
+	require.NoError(t, err)
+
+	// A static key not signed by the identity key of the server.
+	otherKey, err := generateKey()
+	require.NoError(t, err)
+	_, err = verifyHandshakePayload(payload, otherKey.PublicKey())
+	require.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestHandshakePayload(t *testing.T) {
+	id, err := identity.Generate(identity.Ed25519)
+	require.NoError(t, err)
+	tr, err := New(tcp.New("4000"), WithIdentity(id))
+	require.NoError(t, err)
+
+	data, err := tr.handshakePayload()
+	require.NoError(t, err)
+
+	// The identity key is a libp2p PublicKey message with the Ed25519 type
+	// and the raw key.
+	key := id.PrivateKey().Public().Std().(ed25519.PublicKey)
+	identityKey := append([]byte{0x08, 0x01, 0x12, byte(len(key))}, key...)
+	require.Equal(t, append([]byte{0x0a, byte(len(identityKey))}, identityKey...), data[:2+len(identityKey)])
+
+	// Fields unknown to pearly, like the stream muxers of libp2p, are
+	// ignored.
+	muxers := appendBytesField(nil, 2, []byte("/yamux/1.0.0"))
+	data = appendBytesField(data, _payloadExtensions, muxers)
+	payload, err := verifyHandshakePayload(data, tr.staticKey.PublicKey())
+	require.NoError(t, err)
+	require.Equal(t, "4000", payload.ListeningPort)
+	remoteID, err := crypto.PeerID(payload.IdentityKey)
+	require.NoError(t, err)
+	require.Equal(t, id.ID(), remoteID)
+
+	_, err = verifyHandshakePayload(data[:len(data)-1], tr.staticKey.PublicKey())
+	require.ErrorIs(t, err, ErrInvalidPayload)
+}
+
+func TestNoiseCiphers(t *testing.T) {
+	testCases := []struct {
+		client, server Cipher
+		ok             bool
+	}{
+		{ChaChaPoly, ChaChaPoly, true},
+		{AESGCM, AESGCM, true},
+		{ChaChaPoly, AESGCM, false},
+	}
+
+	for _, tc := range testCases {
+		client, err := New(tcp.New("1"), WithCipher(tc.client))
+		require.NoError(t, err)
+		server, err := New(tcp.New("2"), WithCipher(tc.server))
+		require.NoError(t, err)
+
+		c1, c2 := net.Pipe()
+		serverErr := make(chan error, 1)
+		go func() {
+			_, err := server.upgradeConn(c2, false)
+			serverErr <- err
+		}()
+		_, err = client.upgradeConn(c1, true)
+		if tc.ok {
+			require.NoError(t, err)
+			require.NoError(t, <-serverErr)
+		} else {
+			require.ErrorIs(t, err, ErrHandshake)
+			require.ErrorIs(t, <-serverErr, ErrHandshake)
+		}
+		c1.Close()
+	}
+}
+
+func TestDialHandshakeContext(t *testing.T) {
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	client, err := New(tcp.New(port))
+	require.NoError(t, err)
+
+	// The responder accepts the connection but never answers the handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(io.Discard, c)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	_, err = client.Dial(ctx, peer.New(nil, listener.Addr().String()))
+	require.ErrorIs(t, err, ErrHandshake)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDialChecksPeerID(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	client, err := New(tcp.New(port1))
+	require.NoError(t, err)
+	server, err := New(tcp.New(port2))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connChan, _, err := server.Listen(ctx)
+	require.NoError(t, err)
+	go func() {
+		for {
+			select {
+			case c := <-connChan:
+				c.Close()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	conn, err := client.Dial(ctx, peer.New(server.ID(), "localhost:"+port2))
+	require.NoError(t, err)
+	conn.Close()
+
+	_, err = client.Dial(ctx, peer.New(client.ID(), "localhost:"+port2))
+	require.ErrorIs(t, err, ErrPeerIDMismatch)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand/v2"
+	"slices"
 	"time"
 
 	"github.com/FluffyKebab/pearly/onion"
@@ -15,65 +16,272 @@ import (
 var (
 	ErrNotEnoughRelayServers = errors.New("to few relay servers found")
 	ErrConnectionFailed      = errors.New("connection failed")
+	ErrNoExitRelay           = errors.New("no relay allows exit to peer")
 )
 
+const (
+	_defaultNumRelays       = 3
+	_defaultNumRetries      = 3
+	_defaultCircuitLifetime = 10 * time.Minute
+)
+
+// RelaySource finds the relays circuits are built from, usually a
+// directory.Directory.
+type RelaySource interface {
+	Relays(ctx context.Context) ([]peer.Peer, error)
+}
+
+// ExitPolicyHaver is implemented by relays that only open streams to some
+// addresses when they are the exit of a circuit. Relays that do not implement
+// it are used as exits to all peers.
+type ExitPolicyHaver interface {
+	AllowsExit(addr string) bool
+}
+
+// Transport dials peers through onion circuits. Circuits are reused for
+// CircuitLifetime, and by default a circuit is only used for connections to
+// one peer, so that the exit relay can not link connections to different
+// peers.
 type Transport struct {
 	Underlying   transport.Transport
 	Client       onion.Client
 	RelayServers peer.Store
 	NumRelays    int
 	NumRetries   int
+
+	// RelayDirectory is used instead of RelayServers to find relays if it is
+	// set.
+	RelayDirectory RelaySource
+
+	// CircuitLifetime is how long a circuit is used for new connections.
+	// Circuits are closed when they are expired and have no open connections.
+	// Zero makes every dial create a new circuit.
+	CircuitLifetime time.Duration
+	// ShareCircuits allows connections to different peers to use the same
+	// circuit.
+	ShareCircuits bool
+
+	// pool is nil for transports that are not created with New, which do not
+	// reuse circuits.
+	pool *circuitPool
 }
 
 var _ transport.Transport = &Transport{}
 
+type Option func(*Transport)
+
+func WithNumRelays(n int) Option {
+	return func(t *Transport) {
+		t.NumRelays = n
+	}
+}
+
+func WithNumRetries(n int) Option {
+	return func(t *Transport) {
+		t.NumRetries = n
+	}
+}
+
+func WithCircuitLifetime(d time.Duration) Option {
+	return func(t *Transport) {
+		t.CircuitLifetime = d
+	}
+}
+
+// WithRelayDirectory makes the transport find relays with source instead of
+// the relay servers given to New, which can then be nil.
+func WithRelayDirectory(source RelaySource) Option {
+	return func(t *Transport) {
+		t.RelayDirectory = source
+	}
+}
+
+// WithSharedCircuits allows connections to different peers to use the same
+// circuit.
+func WithSharedCircuits() Option {
+	return func(t *Transport) {
+		t.ShareCircuits = true
+	}
+}
+
+// New creates a transport building circuits of three relays from
+// relayServers, which are reused for ten minutes unless other options are
+// given.
+func New(
+	underlying transport.Transport,
+	client onion.Client,
+	relayServers peer.Store,
+	opts ...Option,
+) *Transport {
+	t := &Transport{
+		Underlying:      underlying,
+		Client:          client,
+		RelayServers:    relayServers,
+		NumRelays:       _defaultNumRelays,
+		NumRetries:      _defaultNumRetries,
+		CircuitLifetime: _defaultCircuitLifetime,
+		pool:            newCircuitPool(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
 func (t *Transport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
-	peers := t.RelayServers.Peers()
-	if len(peers) < t.NumRelays {
-		return nil, fmt.Errorf("%w: have: %v, need: %v", ErrNotEnoughRelayServers, len(peers), t.NumRelays)
+	if t.pool == nil || t.CircuitLifetime <= 0 {
+		circuit, _, err := t.buildCircuit(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		s, err := circuit.OpenStream(ctx, p.PublicAddr())
+		if err != nil {
+			circuit.Close()
+			return nil, fmt.Errorf("%w: %w", ErrConnectionFailed, err)
+		}
+		return &circuitConn{Stream: s, onClose: func() { circuit.Close() }}, nil
 	}
 
-	seed := uint64(time.Now().Nanosecond())
+	key := t.isolationKey(p)
+	if pooled := t.pool.get(key, p.PublicAddr(), time.Now()); pooled != nil {
+		s, err := pooled.circuit.OpenStream(ctx, p.PublicAddr())
+		if err == nil {
+			return t.pool.wrap(pooled, s), nil
+		}
+		// The peer could not be reached through a working circuit with an
+		// exit relay that allows exit to it, so a new circuit would most
+		// likely fail as well.
+		if !errors.Is(err, onion.ErrCircuitClosed) {
+			return nil, fmt.Errorf("%w: %w", ErrConnectionFailed, err)
+		}
+	}
+
+	circuit, exit, err := t.buildCircuit(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	s, err := circuit.OpenStream(ctx, p.PublicAddr())
+	if err != nil {
+		circuit.Close()
+		return nil, fmt.Errorf("%w: %w", ErrConnectionFailed, err)
+	}
+	pooled := t.pool.add(key, circuit, exit, time.Now().Add(t.CircuitLifetime))
+	return t.pool.wrap(pooled, s), nil
+}
+
+func (t *Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
+	return t.Underlying.Listen(ctx)
+}
+
+func (t *Transport) ListenAddr() string {
+	return t.Underlying.ListenAddr()
+}
+
+// Close closes all circuits of the transport.
+func (t *Transport) Close() error {
+	if t.pool == nil {
+		return nil
+	}
+	return t.pool.closeAll()
+}
+
+// isolationKey returns the key of the circuits that connections to p can use.
+func (t *Transport) isolationKey(p peer.Peer) string {
+	if t.ShareCircuits {
+		return ""
+	}
+	if len(p.ID()) > 0 {
+		return "id:" + string(p.ID())
+	}
+	return "addr:" + p.PublicAddr()
+}
+
+// buildCircuit builds a circuit of random relays, where p is never used as a
+// relay and the exit relay allows exit to p. Relays that fail are replaced by
+// other relays. The circuit is returned with its exit relay.
+func (t *Transport) buildCircuit(ctx context.Context, p peer.Peer) (*onion.Circuit, peer.Peer, error) {
+	candidates, err := t.relayCandidates(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(candidates) < t.NumRelays || t.NumRelays <= 0 {
+		return nil, nil, fmt.Errorf("%w: have: %v, need: %v", ErrNotEnoughRelayServers, len(candidates), t.NumRelays)
+	}
+
+	seed := uint64(time.Now().UnixNano())
 	r := rand.New(rand.NewPCG(seed, seed))
-	relays := make([]peer.Peer, t.NumRelays+1)
-	for i := 0; i < len(relays); i++ {
-		selected := r.IntN(len(peers))
-		relays[i] = peers[selected]
-		relays = remove(peers, selected)
+	r.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	exit := slices.IndexFunc(candidates, func(relay peer.Peer) bool {
+		return allowsExit(relay, p.PublicAddr())
+	})
+	if exit == -1 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoExitRelay, p.PublicAddr())
 	}
-	relays[len(relays)-1] = p
+	last := t.NumRelays - 1
+	candidates[exit], candidates[last] = candidates[last], candidates[exit]
+
+	relays := candidates[:t.NumRelays]
+	spare := candidates[t.NumRelays:]
 
 	errs := make([]error, 0)
-	for i := 0; i < t.NumRetries; i++ {
-		c, failed, err := t.Client.EstablishCircuit(ctx, relays)
+	for i := 0; i < max(t.NumRetries, 1); i++ {
+		c, failed, err := t.Client.BuildCircuit(ctx, relays)
 		if err == nil {
-			return c, nil
+			return c, relays[last], nil
 		}
 
 		errs = append(errs, err)
+		if failed >= len(relays) {
+			return nil, nil, fmt.Errorf("invalid failed index returned from onion client")
+		}
 
-		relays = remove(relays, failed)
-		if len(peers) == 0 {
-			return nil, constructErr(errs)
+		// The exit relay can only be replaced by a relay that allows exit
+		// to p.
+		next := 0
+		if failed == last {
+			next = slices.IndexFunc(spare, func(relay peer.Peer) bool {
+				return allowsExit(relay, p.PublicAddr())
+			})
 		}
-		if failed >= len(relays) {
-			return nil, fmt.Errorf("invalid failed index returned from onion client")
+		if next == -1 || next >= len(spare) {
+			break
 		}
 
-		selected := r.IntN(len(peers))
-		relays[failed] = peers[selected]
-		peers = remove(peers, selected)
+		relays[failed] = spare[next]
+		spare = slices.Delete(spare, next, next+1)
 	}
 
-	return nil, constructErr(errs)
+	return nil, nil, constructErr(errs)
 }
 
-func (t *Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
-	return t.Underlying.Listen(ctx)
+// relayCandidates returns the relays that can be used in circuits to p.
+func (t *Transport) relayCandidates(ctx context.Context, p peer.Peer) ([]peer.Peer, error) {
+	var relays []peer.Peer
+	if t.RelayDirectory != nil {
+		var err error
+		relays, err = t.RelayDirectory.Relays(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNotEnoughRelayServers, err)
+		}
+	} else {
+		relays = t.RelayServers.Peers()
+	}
+
+	candidates := make([]peer.Peer, 0, len(relays))
+	for _, relay := range relays {
+		if relay != nil && relay.PublicAddr() != p.PublicAddr() {
+			candidates = append(candidates, relay)
+		}
+	}
+	return candidates, nil
 }
 
-func (t *Transport) ListenAddr() string {
-	return t.Underlying.ListenAddr()
+func allowsExit(relay peer.Peer, addr string) bool {
+	policy, ok := relay.(ExitPolicyHaver)
+	return !ok || policy.AllowsExit(addr)
 }
 
 func constructErr(errs []error) error {
@@ -84,8 +292,3 @@ func constructErr(errs []error) error {
 
 	return fmt.Errorf("%w: [%w]", ErrConnectionFailed, finalErr)
 }
-
-func remove(s []peer.Peer, i int) []peer.Peer {
-	return append(s[:i], s[i+1:]...)
-
-}
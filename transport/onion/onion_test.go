@@ -0,0 +1,265 @@
+package onion
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/kademila/dhtpeer"
+	"github.com/FluffyKebab/pearly/node/basic"
+	"github.com/FluffyKebab/pearly/onion"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/protocolmux/multistream"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportReusesCircuit(t *testing.T) {
+	tr := newTestTransport(t, 4, WithCircuitLifetime(time.Minute))
+	dest := startEchoNode(t)
+
+	conn1 := dialAndEcho(t, tr, dest)
+	conn2 := dialAndEcho(t, tr, dest)
+	require.Equal(t, 1, numCircuits(tr))
+
+	require.NoError(t, conn1.Close())
+	require.NoError(t, conn2.Close())
+	require.NoError(t, tr.Close())
+}
+
+func TestTransportIsolatesPeers(t *testing.T) {
+	tr := newTestTransport(t, 4, WithCircuitLifetime(time.Minute))
+
+	dialAndEcho(t, tr, startEchoNode(t))
+	dialAndEcho(t, tr, startEchoNode(t))
+	require.Equal(t, 2, numCircuits(tr))
+	require.NoError(t, tr.Close())
+}
+
+func TestTransportSharedCircuits(t *testing.T) {
+	tr := newTestTransport(t, 4, WithCircuitLifetime(time.Minute), WithSharedCircuits())
+
+	dialAndEcho(t, tr, startEchoNode(t))
+	dialAndEcho(t, tr, startEchoNode(t))
+	require.Equal(t, 1, numCircuits(tr))
+	require.NoError(t, tr.Close())
+}
+
+func TestTransportCircuitLifetime(t *testing.T) {
+	tr := newTestTransport(t, 4, WithCircuitLifetime(50*time.Millisecond))
+	dest := startEchoNode(t)
+
+	conn := dialAndEcho(t, tr, dest)
+	time.Sleep(100 * time.Millisecond)
+
+	// The expired circuit is kept until its last connection is closed.
+	dialAndEcho(t, tr, dest)
+	require.Equal(t, 2, numCircuits(tr))
+
+	require.NoError(t, conn.Close())
+	require.Equal(t, 1, numCircuits(tr))
+	require.NoError(t, tr.Close())
+}
+
+func TestTransportClosesExpiredCircuits(t *testing.T) {
+	tr := newTestTransport(t, 4, WithCircuitLifetime(50*time.Millisecond))
+
+	// Circuits without connections are closed when they expire, even if the
+	// transport is not used again.
+	conn := dialAndEcho(t, tr, startEchoNode(t))
+	tr.pool.lock.Lock()
+	var circuit *onion.Circuit
+	for _, circuits := range tr.pool.circuits {
+		circuit = circuits[0].circuit
+	}
+	tr.pool.lock.Unlock()
+	require.NoError(t, conn.Close())
+	require.Equal(t, 1, numCircuits(tr))
+
+	select {
+	case <-circuit.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expired circuit was not closed")
+	}
+	require.Equal(t, 0, numCircuits(tr))
+	require.NoError(t, tr.Close())
+}
+
+func TestTransportDoesNotPoolFailedCircuit(t *testing.T) {
+	tr := newTestTransport(t, 4, WithCircuitLifetime(time.Minute))
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	_, err = tr.Dial(context.Background(), peer.New(randomID(t), "127.0.0.1:"+port))
+	require.ErrorIs(t, err, ErrConnectionFailed)
+	require.Equal(t, 0, numCircuits(tr))
+}
+
+func TestTransportWithoutPool(t *testing.T) {
+	tr := newTestTransport(t, 4)
+	tr.pool = nil
+
+	conn := dialAndEcho(t, tr, startEchoNode(t))
+	require.NoError(t, conn.Close())
+}
+
+func TestTransportNotEnoughRelays(t *testing.T) {
+	tr := newTestTransport(t, 2)
+
+	_, err := tr.Dial(context.Background(), startEchoNode(t))
+	require.ErrorIs(t, err, ErrNotEnoughRelayServers)
+}
+
+func TestTransportExitPolicy(t *testing.T) {
+	tr := newTestTransport(t, 3, WithNumRelays(2))
+	dest := startEchoNode(t)
+
+	// Only one of the relays allows exit, so it must be the exit of every
+	// circuit.
+	relays := tr.RelayServers.Peers()
+	tr.RelayDirectory = relaySourceFunc(func(context.Context) ([]peer.Peer, error) {
+		return []peer.Peer{
+			exitPolicyPeer{relays[0], false},
+			exitPolicyPeer{relays[1], true},
+			exitPolicyPeer{relays[2], false},
+		}, nil
+	})
+	for i := 0; i < 5; i++ {
+		conn := dialAndEcho(t, tr, dest)
+		require.NoError(t, conn.Close())
+	}
+
+	tr.RelayDirectory = relaySourceFunc(func(context.Context) ([]peer.Peer, error) {
+		return []peer.Peer{exitPolicyPeer{relays[0], false}, exitPolicyPeer{relays[1], false}}, nil
+	})
+	_, err := tr.Dial(context.Background(), startEchoNode(t))
+	require.ErrorIs(t, err, ErrNoExitRelay)
+	require.NoError(t, tr.Close())
+}
+
+func TestTransportSharedCircuitsExitPolicy(t *testing.T) {
+	tr := newTestTransport(t, 3, WithNumRelays(2), WithCircuitLifetime(time.Minute), WithSharedCircuits())
+	dest1 := startEchoNode(t)
+	dest2 := startEchoNode(t)
+
+	// Each destination has its own exit relay, so a circuit to one of them
+	// can not be shared with the other.
+	relays := tr.RelayServers.Peers()
+	tr.RelayDirectory = relaySourceFunc(func(context.Context) ([]peer.Peer, error) {
+		return []peer.Peer{
+			exitPolicyPeer{relays[0], false},
+			addrExitPeer{relays[1], dest1.PublicAddr()},
+			addrExitPeer{relays[2], dest2.PublicAddr()},
+		}, nil
+	})
+	dialAndEcho(t, tr, dest1)
+	dialAndEcho(t, tr, dest2)
+	require.Equal(t, 2, numCircuits(tr))
+
+	// Later connections use the circuit with the right exit relay.
+	dialAndEcho(t, tr, dest1)
+	dialAndEcho(t, tr, dest2)
+	require.Equal(t, 2, numCircuits(tr))
+	require.NoError(t, tr.Close())
+}
+
+type relaySourceFunc func(ctx context.Context) ([]peer.Peer, error)
+
+func (f relaySourceFunc) Relays(ctx context.Context) ([]peer.Peer, error) {
+	return f(ctx)
+}
+
+type exitPolicyPeer struct {
+	peer.Peer
+	exit bool
+}
+
+func (p exitPolicyPeer) AllowsExit(string) bool {
+	return p.exit
+}
+
+// addrExitPeer only allows exit to one address.
+type addrExitPeer struct {
+	peer.Peer
+	addr string
+}
+
+func (p addrExitPeer) AllowsExit(addr string) bool {
+	return addr == p.addr
+}
+
+func newTestTransport(t *testing.T, numRelays int, opts ...Option) *Transport {
+	t.Helper()
+
+	relays := dhtpeer.NewStore(randomID(t), 20)
+	for i := 0; i < numRelays; i++ {
+		port, err := testutil.GetAvailablePort()
+		require.NoError(t, err)
+
+		n := basic.New(tcp.New(port), nil)
+		onion.RegisterService(n).Run()
+		_, err = n.Run(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, relays.AddPeer(peer.New(randomID(t), "127.0.0.1:"+port)))
+	}
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	client := onion.NewClient(multistream.NewMuxer(), tcp.New(port))
+	return New(tcp.New(port), client, relays, opts...)
+}
+
+func startEchoNode(t *testing.T) peer.Peer {
+	t.Helper()
+
+	port, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	n := basic.New(tcp.New(port), nil)
+	n.SetConnHandler(func(c transport.Conn) error {
+		_, err := io.Copy(c, c)
+		return err
+	})
+	_, err = n.Run(context.Background())
+	require.NoError(t, err)
+	return peer.New(randomID(t), "127.0.0.1:"+port)
+}
+
+func dialAndEcho(t *testing.T, tr *Transport, p peer.Peer) transport.Conn {
+	t.Helper()
+
+	conn, err := tr.Dial(context.Background(), p)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, len("hello"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+	return conn
+}
+
+func numCircuits(tr *Transport) int {
+	tr.pool.lock.Lock()
+	defer tr.pool.lock.Unlock()
+
+	n := 0
+	for _, circuits := range tr.pool.circuits {
+		n += len(circuits)
+	}
+	return n
+}
+
+func randomID(t *testing.T) []byte {
+	t.Helper()
+
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	require.NoError(t, err)
+	return id
+}
@@ -0,0 +1,135 @@
+package onion
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/FluffyKebab/pearly/onion"
+	"github.com/FluffyKebab/pearly/peer"
+)
+
+// circuitPool holds the circuits of a transport by isolation key.
+type circuitPool struct {
+	lock     *sync.Mutex
+	circuits map[string][]*pooledCircuit
+}
+
+type pooledCircuit struct {
+	key     string
+	circuit *onion.Circuit
+	// exit is the exit relay of the circuit, which decides what peers the
+	// circuit can be used for.
+	exit    peer.Peer
+	expires time.Time
+	// timer closes the circuit when it expires unless it has streams.
+	timer *time.Timer
+}
+
+func newCircuitPool() *circuitPool {
+	return &circuitPool{
+		lock:     &sync.Mutex{},
+		circuits: make(map[string][]*pooledCircuit),
+	}
+}
+
+// get returns a circuit with the key that is not expired and whose exit relay
+// allows exit to addr.
+func (p *circuitPool) get(key string, addr string, now time.Time) *pooledCircuit {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.prune(key, now)
+	for _, c := range p.circuits[key] {
+		if !now.After(c.expires) && allowsExit(c.exit, addr) {
+			return c
+		}
+	}
+	return nil
+}
+
+// prune removes the circuits with the key that are torn down, and closes and
+// removes the expired circuits without streams. It must be called with the
+// lock held.
+func (p *circuitPool) prune(key string, now time.Time) {
+	kept := p.circuits[key][:0]
+	for _, c := range p.circuits[key] {
+		if isDone(c.circuit) {
+			continue
+		}
+		if now.After(c.expires) && c.circuit.NumStreams() == 0 {
+			c.circuit.Close()
+			continue
+		}
+		kept = append(kept, c)
+	}
+
+	if len(kept) == 0 {
+		delete(p.circuits, key)
+	} else {
+		p.circuits[key] = kept
+	}
+}
+
+// add pools the circuit until it expires. It is closed when it expires, or
+// when its last stream is closed after that.
+func (p *circuitPool) add(key string, circuit *onion.Circuit, exit peer.Peer, expires time.Time) *pooledCircuit {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c := &pooledCircuit{key: key, circuit: circuit, exit: exit, expires: expires}
+	c.timer = time.AfterFunc(time.Until(expires), func() { p.release(c, time.Now()) })
+	p.circuits[key] = append(p.circuits[key], c)
+	return c
+}
+
+// wrap returns a connection that releases the circuit when it is closed.
+func (p *circuitPool) wrap(c *pooledCircuit, s *onion.Stream) *circuitConn {
+	return &circuitConn{Stream: s, onClose: func() { p.release(c, time.Now()) }}
+}
+
+// release closes the circuit if it is expired and has no streams.
+func (p *circuitPool) release(c *pooledCircuit, now time.Time) {
+	if now.After(c.expires) && c.circuit.NumStreams() == 0 {
+		p.lock.Lock()
+		p.prune(c.key, now)
+		p.lock.Unlock()
+	}
+}
+
+func (p *circuitPool) closeAll() error {
+	p.lock.Lock()
+	circuits := p.circuits
+	p.circuits = make(map[string][]*pooledCircuit)
+	p.lock.Unlock()
+
+	errs := make([]error, 0)
+	for _, pooled := range circuits {
+		for _, c := range pooled {
+			c.timer.Stop()
+			errs = append(errs, c.circuit.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isDone(c *onion.Circuit) bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// circuitConn is a stream of a circuit that calls onClose when it is closed.
+type circuitConn struct {
+	*onion.Stream
+	onClose func()
+}
+
+func (c *circuitConn) Close() error {
+	err := c.Stream.Close()
+	c.onClose()
+	return err
+}
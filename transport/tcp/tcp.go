@@ -43,11 +43,20 @@ func (t Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan er
 					return
 				}
 
-				errChan <- err
+				select {
+				case errChan <- err:
+				case <-ctx.Done():
+					return
+				}
 				continue
 			}
 
-			connChan <- connection{conn}
+			select {
+			case connChan <- connection{conn}:
+			case <-ctx.Done():
+				conn.Close()
+				return
+			}
 		}
 	}()
 
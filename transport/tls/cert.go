@@ -0,0 +1,85 @@
+package tls
+
+import (
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/FluffyKebab/pearly/crypto"
+	"github.com/FluffyKebab/pearly/identity"
+)
+
+const _certificateValidity = 10 * 365 * 24 * time.Hour
+
+var ErrInvalidCertificate = errors.New("invalid peer certificate")
+
+// newCertificate creates a self-signed certificate for the identity. The
+// certificate is signed with the identity key itself, so the key in the
+// certificate is the identity of the node.
+func newCertificate(id *identity.Identity) (cryptotls.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cryptotls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: hex.EncodeToString(id.ID())},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(_certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	privateKey := id.PrivateKey().Std()
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return cryptotls.Certificate{}, err
+	}
+
+	return cryptotls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  privateKey,
+	}, nil
+}
+
+// verifyCertificate checks that the peer sent exactly one valid certificate,
+// signed by its own key, and returns the ID derived from that key.
+// The certificates are not verified against any certificate authority.
+func verifyCertificate(rawCerts [][]byte) ([]byte, error) {
+	if len(rawCerts) != 1 {
+		return nil, fmt.Errorf("%w: expected one certificate, got %d", ErrInvalidCertificate, len(rawCerts))
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("%w: certificate is expired or not yet valid", ErrInvalidCertificate)
+	}
+
+	publicKey, err := crypto.PublicKeyFromStd(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+
+	err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+
+	id, err := crypto.PeerID(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,102 @@
+package tls
+
+import (
+	cryptotls "crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+// Conn is a TLS connection to a peer with a verified ID.
+type Conn struct {
+	tlsConn    *cryptotls.Conn
+	underlying transport.Conn
+	remoteID   []byte
+	remotePort string
+}
+
+var (
+	_ transport.Conn            = &Conn{}
+	_ transport.RemoteAddrHaver = &Conn{}
+	_ transport.RemoteIDHaver   = &Conn{}
+	_ io.ByteReader             = &Conn{}
+)
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	return c.tlsConn.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	return c.tlsConn.Write(p)
+}
+
+func (c *Conn) RemoteAddr() string {
+	remoteAddr := remoteAddr(c.underlying)
+	splitRemoteAddr := strings.Split(remoteAddr, ":")
+	if len(splitRemoteAddr) != 2 || c.remotePort == "" {
+		return remoteAddr
+	}
+	return strings.Join([]string{splitRemoteAddr[0], c.remotePort}, ":")
+}
+
+func (c *Conn) RemoteID() []byte {
+	return c.remoteID
+}
+
+func (c *Conn) Close() error {
+	return c.tlsConn.Close()
+}
+
+func (c *Conn) ReadByte() (byte, error) {
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(c, buf)
+	return buf[0], err
+}
+
+// netConn lets crypto/tls use a transport.Conn. Deadlines are not supported,
+// so the handshake is interrupted by closing the connection instead.
+type netConn struct {
+	transport.Conn
+}
+
+var _ net.Conn = netConn{}
+
+func (c netConn) LocalAddr() net.Addr {
+	return addr("")
+}
+
+func (c netConn) RemoteAddr() net.Addr {
+	return addr(remoteAddr(c.Conn))
+}
+
+func (c netConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c netConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c netConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type addr string
+
+func (a addr) Network() string {
+	return "pearly"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+func remoteAddr(c transport.Conn) string {
+	if remoteHaver, ok := c.(transport.RemoteAddrHaver); ok {
+		return remoteHaver.RemoteAddr()
+	}
+	return ""
+}
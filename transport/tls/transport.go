@@ -0,0 +1,201 @@
+package tls
+
+import (
+	"bytes"
+	"context"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/FluffyKebab/pearly/identity"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/transport"
+)
+
+// DefaultHandshakeTimeout is the time an accepted connection has to finish the
+// handshake.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrHandshake      = errors.New("tls handshake failed")
+	ErrPeerIDMismatch = errors.New("peer ID does not match the dialed ID")
+)
+
+// Transport secures the connections of the underlying transport with TLS 1.3
+// and mutual authentication. Each node has a self-signed certificate for its
+// identity key, and the ID of a peer is derived from the key in its
+// certificate.
+type Transport struct {
+	underlying       transport.Transport
+	identity         *identity.Identity
+	certificate      cryptotls.Certificate
+	handshakeTimeout time.Duration
+}
+
+var _ transport.Transport = Transport{}
+
+type Option func(*Transport)
+
+// WithIdentity makes the transport use a certificate for the identity instead
+// of for a new key.
+func WithIdentity(id *identity.Identity) Option {
+	return func(t *Transport) {
+		t.identity = id
+	}
+}
+
+// WithHandshakeTimeout sets the time an accepted connection has to finish the
+// handshake before it is closed.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.handshakeTimeout = d
+	}
+}
+
+// New creates a transport that secures the connections of underlying. A new
+// Ed25519 identity is generated unless WithIdentity is used.
+func New(underlying transport.Transport, opts ...Option) (Transport, error) {
+	t := Transport{underlying: underlying, handshakeTimeout: DefaultHandshakeTimeout}
+	for _, opt := range opts {
+		opt(&t)
+	}
+
+	if t.identity == nil {
+		id, err := identity.Generate(identity.Ed25519)
+		if err != nil {
+			return Transport{}, err
+		}
+		t.identity = id
+	}
+
+	certificate, err := newCertificate(t.identity)
+	if err != nil {
+		return Transport{}, err
+	}
+	t.certificate = certificate
+	return t, nil
+}
+
+func (t Transport) Listen(ctx context.Context) (<-chan transport.Conn, <-chan error, error) {
+	return transport.ListenUpgraded(ctx, t.underlying, t.handshakeTimeout, func(ctx context.Context, c transport.Conn) (transport.Conn, error) {
+		return t.upgradeConn(ctx, c, nil, false)
+	})
+}
+
+// Dial connects to the peer. If the ID of the peer is set, the handshake
+// fails unless the certificate of the peer has the same ID.
+func (t Transport) Dial(ctx context.Context, p peer.Peer) (transport.Conn, error) {
+	c, err := t.underlying.Dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.upgradeConn(ctx, c, p.ID(), true)
+}
+
+func (t Transport) ListenAddr() string {
+	return t.underlying.ListenAddr()
+}
+
+func (t Transport) ID() []byte {
+	return t.identity.ID()
+}
+
+func (t Transport) upgradeConn(ctx context.Context, c transport.Conn, expectedID []byte, client bool) (*Conn, error) {
+	conn, err := t.handshake(ctx, c, expectedID, client)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	return conn, nil
+}
+
+func (t Transport) handshake(ctx context.Context, c transport.Conn, expectedID []byte, client bool) (*Conn, error) {
+	var remoteID []byte
+	config := &cryptotls.Config{
+		MinVersion:             cryptotls.VersionTLS13,
+		Certificates:           []cryptotls.Certificate{t.certificate},
+		ClientAuth:             cryptotls.RequireAnyClientCert,
+		SessionTicketsDisabled: true,
+		// The certificates are self-signed, so the standard verification is
+		// replaced by verifyCertificate.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			id, err := verifyCertificate(rawCerts)
+			if err != nil {
+				return err
+			}
+			if len(expectedID) != 0 && !bytes.Equal(id, expectedID) {
+				return ErrPeerIDMismatch
+			}
+			remoteID = id
+			return nil
+		},
+	}
+
+	var tlsConn *cryptotls.Conn
+	if client {
+		tlsConn = cryptotls.Client(netConn{c}, config)
+	} else {
+		tlsConn = cryptotls.Server(netConn{c}, config)
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	// The peers send the port they listen on, so that RemoteAddr can be used
+	// to dial the peer.
+	var remotePort string
+	var err error
+	localPort := transport.ListeningPort(t.ListenAddr())
+	if client {
+		err = writePort(tlsConn, localPort)
+		if err == nil {
+			remotePort, err = readPort(tlsConn)
+		}
+	} else {
+		remotePort, err = readPort(tlsConn)
+		if err == nil {
+			err = writePort(tlsConn, localPort)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		tlsConn:    tlsConn,
+		underlying: c,
+		remoteID:   remoteID,
+		remotePort: remotePort,
+	}, nil
+}
+
+// writePort sends the port as a big-endian uint16. Zero is sent if the port
+// is not a number.
+func writePort(w io.Writer, port string) error {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		n = 0
+	}
+	_, err = w.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	return err
+}
+
+func readPort(r io.Reader) (string, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	port := binary.BigEndian.Uint16(buf)
+	if port == 0 {
+		return "", nil
+	}
+	return strconv.Itoa(int(port)), nil
+}
@@ -0,0 +1,115 @@
+package tls
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/identity"
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/FluffyKebab/pearly/testutil"
+	"github.com/FluffyKebab/pearly/transport/tcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSTCP(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	// RSA keys are signed with RSA-PSS in TLS 1.3.
+	id, err := identity.Generate(identity.RSA)
+	require.NoError(t, err)
+	client, err := New(tcp.New(port1), WithIdentity(id))
+	require.NoError(t, err)
+	require.Equal(t, id.ID(), client.ID())
+
+	server, err := New(tcp.New(port2))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connChan, errChan, err := server.Listen(ctx)
+	require.NoError(t, err)
+
+	conn, err := client.Dial(ctx, peer.New(server.ID(), "localhost:"+port2))
+	require.NoError(t, err)
+	require.Equal(t, server.ID(), conn.(*Conn).RemoteID())
+
+	msg := "no one will be able to read this exept you server!! trying very long message lets see if this breaks how long does it need to do to be not"
+	go func() {
+		conn.Write([]byte(msg))
+		conn.Close()
+	}()
+
+	timeoutCtx, cancelCtx := context.WithDeadline(context.Background(), time.Now().Add(3*time.Second))
+	defer cancelCtx()
+
+	select {
+	case <-timeoutCtx.Done():
+		t.Fatalf("timeout")
+	case conn := <-connChan:
+		require.Equal(t, client.ID(), conn.(*Conn).RemoteID())
+		require.Equal(t, "127.0.0.1:"+port1, conn.(*Conn).RemoteAddr())
+
+		buf := new(strings.Builder)
+		_, err := io.Copy(buf, conn)
+		require.NoError(t, err)
+		require.Equal(t, msg, buf.String())
+		conn.Close()
+	case err := <-errChan:
+		require.NoError(t, err)
+	}
+}
+
+func TestTLSRejectsWrongPeerID(t *testing.T) {
+	port1, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+	port2, err := testutil.GetAvailablePort()
+	require.NoError(t, err)
+
+	client, err := New(tcp.New(port1))
+	require.NoError(t, err)
+	server, err := New(tcp.New(port2))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, err = server.Listen(ctx)
+	require.NoError(t, err)
+
+	_, err = client.Dial(ctx, peer.New(client.ID(), "localhost:"+port2))
+	require.ErrorIs(t, err, ErrHandshake)
+	require.ErrorIs(t, err, ErrPeerIDMismatch)
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	for _, keyType := range []identity.KeyType{identity.Ed25519, identity.ECDSA, identity.RSA} {
+		nodeIdentity, err := identity.Generate(keyType)
+		require.NoError(t, err)
+		cert, err := newCertificate(nodeIdentity)
+		require.NoError(t, err)
+
+		id, err := verifyCertificate(cert.Certificate)
+		require.NoError(t, err)
+		require.Equal(t, nodeIdentity.ID(), id)
+	}
+
+	nodeIdentity, err := identity.Generate(identity.Ed25519)
+	require.NoError(t, err)
+	cert, err := newCertificate(nodeIdentity)
+	require.NoError(t, err)
+
+	_, err = verifyCertificate(nil)
+	require.ErrorIs(t, err, ErrInvalidCertificate)
+
+	// A certificate with a modified signature is rejected.
+	modified := append([]byte{}, cert.Certificate[0]...)
+	modified[len(modified)-1] ^= 1
+	_, err = verifyCertificate([][]byte{modified})
+	require.ErrorIs(t, err, ErrInvalidCertificate)
+}
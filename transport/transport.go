@@ -36,3 +36,56 @@ type Transport interface {
 	Listen(ctx context.Context) (<-chan Conn, <-chan error, error)
 	ListenAddr() string
 }
+
+// WrapConn returns wrapper extended with the RemoteAddrHaver and RemoteIDHaver
+// implementations of underlying. This makes it possible to wrap a connection
+// without hiding information about the remote. The wrapper can be retrieved
+// with Unwrap.
+func WrapConn(underlying Conn, wrapper Conn) Conn {
+	addrHaver, hasAddr := underlying.(RemoteAddrHaver)
+	idHaver, hasID := underlying.(RemoteIDHaver)
+
+	switch {
+	case hasAddr && hasID:
+		return wrappedConnWithAddrAndID{wrappedConn{wrapper}, addrHaver, idHaver}
+	case hasAddr:
+		return wrappedConnWithAddr{wrappedConn{wrapper}, addrHaver}
+	case hasID:
+		return wrappedConnWithID{wrappedConn{wrapper}, idHaver}
+	default:
+		return wrappedConn{wrapper}
+	}
+}
+
+// Unwrap returns the wrapper used to create c with WrapConn. If c was not
+// created by WrapConn, c is returned.
+func Unwrap(c Conn) Conn {
+	if w, ok := c.(interface{ wrapper() Conn }); ok {
+		return w.wrapper()
+	}
+	return c
+}
+
+type wrappedConn struct {
+	Conn
+}
+
+func (c wrappedConn) wrapper() Conn {
+	return c.Conn
+}
+
+type wrappedConnWithAddr struct {
+	wrappedConn
+	RemoteAddrHaver
+}
+
+type wrappedConnWithID struct {
+	wrappedConn
+	RemoteIDHaver
+}
+
+type wrappedConnWithAddrAndID struct {
+	wrappedConn
+	RemoteAddrHaver
+	RemoteIDHaver
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UpgradeFunc upgrades an accepted connection, usually by running a
+// handshake. It must close c if it fails, and give up when ctx is done.
+type UpgradeFunc func(ctx context.Context, c Conn) (Conn, error)
+
+// ListenUpgraded listens on underlying and upgrades the accepted connections.
+// Every connection is upgraded on its own, so a peer that stalls the upgrade
+// does not block other connections. A connection that is not upgraded within
+// timeout is closed, and the error is sent on the error channel.
+func ListenUpgraded(
+	ctx context.Context,
+	underlying Transport,
+	timeout time.Duration,
+	upgrade UpgradeFunc,
+) (<-chan Conn, <-chan error, error) {
+	connChan := make(chan Conn)
+	errChan := make(chan error)
+
+	underlyingConnChan, underlyingErrChan, err := underlying.Listen(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case c := <-underlyingConnChan:
+				go upgradeInbound(ctx, c, timeout, upgrade, connChan, errChan)
+			case err := <-underlyingErrChan:
+				SendOrDone(ctx, errChan, err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return connChan, errChan, nil
+}
+
+func upgradeInbound(
+	ctx context.Context,
+	c Conn,
+	timeout time.Duration,
+	upgrade UpgradeFunc,
+	connChan chan<- Conn,
+	errChan chan<- error,
+) {
+	upgradeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := Upgrade(upgradeCtx, c, upgrade)
+	if err != nil {
+		SendOrDone(ctx, errChan, err)
+		return
+	}
+	if !SendOrDone(ctx, connChan, conn) {
+		conn.Close()
+	}
+}
+
+// Upgrade upgrades c and closes it if ctx is done before the upgrade is
+// finished, so that upgrades that do not take a context can not block for
+// longer than ctx allows. The error of ctx is then part of the returned error.
+func Upgrade(ctx context.Context, c Conn, upgrade UpgradeFunc) (Conn, error) {
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+
+	conn, err := upgrade(ctx, c)
+	if !stop() {
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("upgrading connection: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("%w: %w", err, ctx.Err())
+	}
+	return conn, err
+}
+
+// SendOrDone sends v on c unless ctx is done first. It reports whether v was
+// sent.
+func SendOrDone[T any](ctx context.Context, c chan<- T, v T) bool {
+	select {
+	case c <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ListeningPort returns the port of a listen address, like "4000" for
+// "localhost:4000".
+func ListeningPort(listenAddr string) string {
+	splitAddr := strings.Split(listenAddr, ":")
+	return splitAddr[len(splitAddr)-1]
+}
@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/FluffyKebab/pearly/peer"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeTransport accepts the connections dialed on it, which are net.Pipe
+// connections.
+type pipeTransport struct {
+	conns chan Conn
+}
+
+func (t pipeTransport) Dial(_ context.Context, _ peer.Peer) (Conn, error) {
+	c1, c2 := net.Pipe()
+	t.conns <- c2
+	return c1, nil
+}
+
+func (t pipeTransport) Listen(_ context.Context) (<-chan Conn, <-chan error, error) {
+	return t.conns, make(chan error), nil
+}
+
+func (t pipeTransport) ListenAddr() string {
+	return ""
+}
+
+func TestListenUpgradedTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The upgrade blocks until the peer sends a byte.
+	underlying := pipeTransport{conns: make(chan Conn)}
+	connChan, errChan, err := ListenUpgraded(ctx, underlying, 200*time.Millisecond, func(_ context.Context, c Conn) (Conn, error) {
+		_, err := io.ReadFull(c, make([]byte, 1))
+		return c, err
+	})
+	require.NoError(t, err)
+
+	// The stalled peer does not block the upgrade of the next one.
+	stalled, err := underlying.Dial(ctx, peer.New(nil, ""))
+	require.NoError(t, err)
+	defer stalled.Close()
+	c, err := underlying.Dial(ctx, peer.New(nil, ""))
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte{1})
+	require.NoError(t, err)
+
+	select {
+	case c := <-connChan:
+		c.Close()
+	case err := <-errChan:
+		t.Fatalf("unexpected error: %v", err)
+	case <-ctx.Done():
+		t.Fatalf("timeout")
+	}
+
+	// The stalled connection is closed when the timeout is exceeded.
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-ctx.Done():
+		t.Fatalf("timeout")
+	}
+	_, err = stalled.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}